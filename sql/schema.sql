@@ -15,6 +15,13 @@ CREATE TABLE IF NOT EXISTS purchases (
   player_level      INTEGER NOT NULL DEFAULT 1 CHECK (player_level >= 1),
   created_at        TIMESTAMPTZ NOT NULL,
   enriched          BOOLEAN NOT NULL DEFAULT FALSE,
+  enrich_claimed_at TIMESTAMPTZ,
+
+  -- Provenance: the ingest that created or last updated the row
+  ingest_id         TEXT,
+  ingest_source     TEXT CHECK (ingest_source IN ('multipart', 'stream', 'webhook', 'cli', 'spool')),
+  source_file       TEXT,
+  source_line       INTEGER,
   
   -- Add constraints for data integrity
   CONSTRAINT purchases_transaction_id_not_empty CHECK (length(transaction_id) > 0),
@@ -22,6 +29,16 @@ CREATE TABLE IF NOT EXISTS purchases (
   CONSTRAINT purchases_game_title_not_empty CHECK (length(game_title) > 0)
 );
 
+-- Upgrade from purchases enriched without a claim lease
+ALTER TABLE purchases ADD COLUMN IF NOT EXISTS enrich_claimed_at TIMESTAMPTZ;
+
+-- Upgrade from purchases without provenance
+ALTER TABLE purchases
+  ADD COLUMN IF NOT EXISTS ingest_id     TEXT,
+  ADD COLUMN IF NOT EXISTS ingest_source TEXT CHECK (ingest_source IN ('multipart', 'stream', 'webhook', 'cli', 'spool')),
+  ADD COLUMN IF NOT EXISTS source_file   TEXT,
+  ADD COLUMN IF NOT EXISTS source_line   INTEGER;
+
 -- Player loyalty points table
 CREATE TABLE IF NOT EXISTS player_loyalty (
   player_id         TEXT PRIMARY KEY,
@@ -32,6 +49,132 @@ CREATE TABLE IF NOT EXISTS player_loyalty (
   CONSTRAINT player_loyalty_player_id_not_empty CHECK (length(player_id) > 0)
 );
 
+-- Refunds and chargebacks, at most one of each per purchase; each takes back
+-- the loyalty points its amount earned, out of what the purchase still holds
+CREATE TABLE IF NOT EXISTS refunds (
+  id                BIGSERIAL PRIMARY KEY,
+  transaction_id    TEXT NOT NULL REFERENCES purchases(transaction_id) ON DELETE CASCADE,
+  event_type        TEXT NOT NULL CHECK (event_type IN ('refund', 'chargeback')),
+  amount_cents      INTEGER NOT NULL CHECK (amount_cents >= 0),
+  created_at        TIMESTAMPTZ NOT NULL,
+  ingest_id         TEXT,
+  claimed_at        TIMESTAMPTZ,
+  processed         BOOLEAN NOT NULL DEFAULT FALSE,
+  points_earned     INTEGER NOT NULL DEFAULT 0,
+  points_due        INTEGER NOT NULL DEFAULT 0,
+  points_deducted   INTEGER NOT NULL DEFAULT 0 CHECK (points_deducted >= 0),
+  deduction_capped  BOOLEAN NOT NULL DEFAULT FALSE,
+  processed_at      TIMESTAMPTZ
+);
+
+-- Every change to a player's loyalty balance: the credit a purchase earned
+-- and the (possibly capped) deduction of its refund, chargeback or the
+-- rollback of the ingest that wrote it. A credit taken back by a rollback is
+-- marked reversed, so the purchase can earn points again if re-ingested.
+CREATE TABLE IF NOT EXISTS loyalty_ledger (
+  id                BIGSERIAL PRIMARY KEY,
+  player_id         TEXT NOT NULL,
+  transaction_id    TEXT NOT NULL,
+  kind              TEXT NOT NULL CHECK (kind IN ('purchase', 'refund', 'chargeback', 'rollback')),
+  points            INTEGER NOT NULL,
+  ingest_id         TEXT,
+  reversed          BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Prior image of a purchase, recorded every time an ingest changes it, and
+-- where the new version came from
+CREATE TABLE IF NOT EXISTS purchase_revisions (
+  id                BIGSERIAL PRIMARY KEY,
+  purchase_id       BIGINT NOT NULL REFERENCES purchases(id) ON DELETE CASCADE,
+  transaction_id    TEXT NOT NULL,
+  ingest_id         TEXT,
+  ingest_source     TEXT,
+  source_file       TEXT,
+  line_number       INTEGER,
+  changed_fields    TEXT[] NOT NULL DEFAULT '{}',
+  previous          JSONB NOT NULL,
+  revised_at        TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Lines rejected during lenient ingestion, downloadable per ingest
+CREATE TABLE IF NOT EXISTS ingest_rejects (
+  ingest_id         TEXT NOT NULL,
+  line_number       INTEGER NOT NULL,
+  byte_offset       BIGINT NOT NULL,
+  raw               TEXT NOT NULL,
+  reason            TEXT NOT NULL,
+  created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+  PRIMARY KEY (ingest_id, line_number)
+);
+
+-- Asynchronous ingest jobs. A running job is leased to the runner in
+-- claimed_by, which renews lease_expires_at while it works on the job.
+CREATE TABLE IF NOT EXISTS ingest_jobs (
+  id                TEXT PRIMARY KEY,
+  state             TEXT NOT NULL DEFAULT 'queued' CHECK (state IN ('queued', 'running', 'succeeded', 'failed')),
+  file_name         TEXT NOT NULL DEFAULT '',
+  upload_bytes      BIGINT,
+  content_encoding  TEXT NOT NULL DEFAULT '',
+  options           JSONB NOT NULL DEFAULT '{}',
+  lines_processed   INTEGER NOT NULL DEFAULT 0,
+  created_count     INTEGER NOT NULL DEFAULT 0,
+  updated_count     INTEGER NOT NULL DEFAULT 0,
+  rejected_count    INTEGER NOT NULL DEFAULT 0,
+  error             TEXT,
+  result            JSONB,
+  created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  started_at        TIMESTAMPTZ,
+  finished_at       TIMESTAMPTZ,
+  claimed_by        TEXT,
+  lease_expires_at  TIMESTAMPTZ
+);
+
+-- Uploads of queued and running jobs, in chunks, so any runner can read them
+CREATE TABLE IF NOT EXISTS ingest_job_uploads (
+  job_id            TEXT NOT NULL REFERENCES ingest_jobs(id) ON DELETE CASCADE,
+  seq               INTEGER NOT NULL,
+  data              BYTEA NOT NULL,
+
+  PRIMARY KEY (job_id, seq)
+);
+
+-- Last handled line of each resumable upload (client Upload-ID or content
+-- hash) and the ingest that last advanced it, until the upload completes
+CREATE TABLE IF NOT EXISTS ingest_checkpoints (
+  upload_id         TEXT PRIMARY KEY,
+  last_line         INTEGER NOT NULL CHECK (last_line >= 0),
+  ingest_id         TEXT,
+  updated_at        TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Responses of /ingest requests sent with an Idempotency-Key; status_code is
+-- NULL while the first request is still running, which renews claimed_at
+CREATE TABLE IF NOT EXISTS ingest_idempotency_keys (
+  key               TEXT PRIMARY KEY,
+  body_hash         TEXT NOT NULL,
+  status_code       INTEGER,
+  location          TEXT,
+  response          BYTEA,
+  created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  claimed_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at        TIMESTAMPTZ NOT NULL
+);
+
+-- Ledger of successfully ingested files, keyed by the hash of their
+-- decompressed contents; only the first ingest of a file is kept
+CREATE TABLE IF NOT EXISTS ingest_files (
+  id                BIGSERIAL PRIMARY KEY,
+  hash              TEXT NOT NULL,
+  size              BIGINT NOT NULL,
+  line_count        INTEGER NOT NULL,
+  file_name         TEXT NOT NULL DEFAULT '',
+  uploader          TEXT NOT NULL DEFAULT '',
+  ingest_id         TEXT NOT NULL,
+  ingested_at       TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
 -- Indexes for performance
 CREATE INDEX IF NOT EXISTS idx_purchases_id ON purchases(id);
 CREATE INDEX IF NOT EXISTS idx_purchases_transaction_id ON purchases(transaction_id);
@@ -48,4 +191,29 @@ CREATE INDEX IF NOT EXISTS idx_purchases_player_platform ON purchases(player_id,
 CREATE INDEX IF NOT EXISTS idx_purchases_genre_amount ON purchases(genre, amount_cents);
 
 -- Player loyalty indexes
-CREATE INDEX IF NOT EXISTS idx_player_loyalty_updated_at ON player_loyalty(updated_at);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_player_loyalty_updated_at ON player_loyalty(updated_at);
+
+-- Revision history index
+CREATE INDEX IF NOT EXISTS idx_purchase_revisions_transaction_id ON purchase_revisions(transaction_id, id);
+
+-- Ingest job queue index
+CREATE INDEX IF NOT EXISTS idx_ingest_jobs_queued ON ingest_jobs(created_at) WHERE state = 'queued';
+CREATE INDEX IF NOT EXISTS idx_ingest_jobs_lease ON ingest_jobs(lease_expires_at) WHERE state = 'running';
+
+-- Refund reversal queue index
+CREATE INDEX IF NOT EXISTS idx_refunds_unprocessed ON refunds(id) WHERE processed = false;
+
+-- At most one refund and one chargeback per purchase
+CREATE UNIQUE INDEX IF NOT EXISTS idx_refunds_transaction_event ON refunds(transaction_id, event_type);
+
+-- Idempotency key expiry index
+CREATE INDEX IF NOT EXISTS idx_ingest_idempotency_keys_expires_at ON ingest_idempotency_keys(expires_at);
+
+-- One ledger entry per file, so concurrent ingests of it cannot both succeed
+CREATE UNIQUE INDEX IF NOT EXISTS idx_ingest_files_hash ON ingest_files(hash);
+
+-- Provenance index, for finding the purchases of one ingest
+CREATE INDEX IF NOT EXISTS idx_purchases_ingest_id ON purchases(ingest_id, id);
+
+-- At most one outstanding loyalty credit per purchase
+CREATE UNIQUE INDEX IF NOT EXISTS idx_loyalty_ledger_credit ON loyalty_ledger(transaction_id) WHERE kind = 'purchase' AND NOT reversed;
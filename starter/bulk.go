@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// BulkStore loads large batches of purchases in a single transaction
+type BulkStore interface {
+	// BeginBulk starts a bulk load for the ingest and upload in ref, written
+	// under ref.Policy. Nothing is visible until Commit succeeds.
+	BeginBulk(ctx context.Context, ref LineRef) (BulkWriter, error)
+}
+
+// BulkResult tallies the records of a committed bulk load the same way they
+// would have been counted if upserted one at a time in file order
+type BulkResult struct {
+	Created    int
+	Updated    int
+	Ignored    int
+	Conflicted int
+}
+
+// BulkWriter receives the records of one bulk load
+type BulkWriter interface {
+	// Add queues a record for the load
+	Add(ctx context.Context, rec Record) error
+
+	// Commit merges all added records into purchases. lastLine advances the
+	// upload checkpoint; conflict is called for each record flagged under RejectOnDiff.
+	Commit(ctx context.Context, lastLine int, conflict func(Conflict)) (BulkResult, error)
+
+	// Rollback abandons the load; it is a no-op after Commit
+	Rollback() error
+}
+
+// bulkMergeTimeout bounds the staging-to-purchases merge, which touches every row of the load
+const bulkMergeTimeout = 5 * time.Minute
+
+var stagingColumns = []string{
+	"line", "transaction_id", "player_id", "player_username", "game_title", "item_type",
+	"genre", "platform", "amount_cents", "currency", "player_level", "created_at",
+}
+
+const createStagingSQL = `
+	CREATE TEMP TABLE purchases_staging (
+		line              INTEGER NOT NULL,
+		transaction_id    TEXT NOT NULL,
+		player_id         TEXT NOT NULL,
+		player_username   TEXT NOT NULL,
+		game_title        TEXT NOT NULL,
+		item_type         TEXT NOT NULL,
+		genre             TEXT NOT NULL,
+		platform          TEXT NOT NULL,
+		amount_cents      INTEGER NOT NULL,
+		currency          TEXT NOT NULL,
+		player_level      INTEGER NOT NULL,
+		created_at        TIMESTAMPTZ NOT NULL
+	) ON COMMIT DROP`
+
+// stagingWinnerOrder picks which occurrence of a repeated transaction_id in
+// the staging table is merged under each policy
+var stagingWinnerOrder = map[ConflictPolicy]string{
+	LastWriteWins:      "line DESC",
+	FirstWriteWins:     "line",
+	NewerCreatedAtWins: "created_at DESC, line",
+	RejectOnDiff:       "line",
+}
+
+// mergeStagingSQL merges the winning occurrence of every transaction_id in
+// the staging table, in file order, with ingest $1, source $2 and file name $3
+// as provenance, records the prior image of updated rows and counts the rows
+// that were newly inserted
+func mergeStagingSQL(policy ConflictPolicy) string {
+	return `
+	WITH winners AS (
+		SELECT DISTINCT ON (transaction_id) *
+		FROM purchases_staging
+		ORDER BY transaction_id, ` + stagingWinnerOrder[policy] + `
+	), previous AS (
+		SELECT p.* FROM purchases p
+		JOIN winners w ON w.transaction_id = p.transaction_id
+	), merged AS (` + insertPurchaseSQL + `
+		SELECT transaction_id, player_id, player_username, game_title, item_type,
+			genre, platform, amount_cents, currency, player_level, created_at,
+			NULLIF($1::text, ''), NULLIF($2::text, ''), NULLIF($3::text, ''), line
+		FROM winners
+		ORDER BY line` + onConflictSQL[policy] + `
+		RETURNING *, (xmax = 0) AS created
+	), revision AS (` + insertRevisionSQL + `
+		SELECT cur.id, cur.transaction_id, NULLIF($1::text, ''), w.line,
+			` + changedFieldsSQL("cur", "prev") + `, to_jsonb(prev),
+			NULLIF($2::text, ''), NULLIF($3::text, '')
+		FROM merged cur
+		JOIN previous prev ON prev.id = cur.id
+		JOIN winners w ON w.transaction_id = cur.transaction_id
+		WHERE NOT cur.created AND ` + distinctFieldsSQL("cur", "prev") + `
+	)
+	SELECT COUNT(*) FILTER (WHERE created) FROM merged`
+}
+
+// staleStagingSQL counts staged records that NewerCreatedAtWins ignores: those
+// not strictly newer than the stored row and every earlier line of the load.
+// It must run before the merge.
+const staleStagingSQL = `
+	SELECT COUNT(*) FROM (
+		SELECT s.created_at, GREATEST(p.created_at, MAX(s.created_at) OVER (
+			PARTITION BY s.transaction_id ORDER BY s.line
+			ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING
+		)) AS newest_before
+		FROM purchases_staging s
+		LEFT JOIN purchases p ON p.transaction_id = s.transaction_id
+	) ranked
+	WHERE created_at <= newest_before`
+
+// unchangedStagingSQL counts staged records that LastWriteWins ignores: those
+// identical to the version before them, which is the previous line of their
+// transaction_id or else the stored row. It must run before the merge.
+var unchangedStagingSQL = `
+	WITH ordered AS (
+		SELECT s.*, LAG(s.line) OVER (PARTITION BY s.transaction_id ORDER BY s.line) AS prev_line
+		FROM purchases_staging s
+	)
+	SELECT COUNT(*)
+	FROM ordered s
+	LEFT JOIN purchases_staging e ON e.transaction_id = s.transaction_id AND e.line = s.prev_line
+	LEFT JOIN purchases p ON p.transaction_id = s.transaction_id AND s.prev_line IS NULL
+	WHERE (e.line IS NOT NULL AND NOT ` + distinctFieldsSQL("s", "e") + `)
+		OR (p.id IS NOT NULL AND NOT ` + distinctFieldsSQL("s", "p") + `)`
+
+// conflictingStagingSQL finds staged records that differ from the stored
+// version. Run after a RejectOnDiff merge, the stored version is either the
+// pre-existing row or the first occurrence in the load.
+const conflictingStagingSQL = `
+	SELECT s.line, s.transaction_id, s.player_id, s.player_username, s.game_title, s.item_type,
+		s.genre, s.platform, s.amount_cents, s.currency, s.player_level, s.created_at,
+		p.player_id, p.player_username, p.game_title, p.item_type,
+		p.genre, p.platform, p.amount_cents, p.currency, p.player_level, p.created_at
+	FROM purchases_staging s
+	JOIN purchases p ON p.transaction_id = s.transaction_id
+	WHERE (s.player_id, s.player_username, s.game_title, s.item_type, s.genre,
+			s.platform, s.amount_cents, s.currency, s.player_level, s.created_at)
+		IS DISTINCT FROM (p.player_id, p.player_username, p.game_title, p.item_type, p.genre,
+			p.platform, p.amount_cents, p.currency, p.player_level, p.created_at)
+	ORDER BY s.line`
+
+// pgBulkWriter streams records into a temporary staging table with COPY
+type pgBulkWriter struct {
+	tx      *sql.Tx
+	copy    *sql.Stmt
+	ref     LineRef
+	records int
+	done    bool
+}
+
+// BeginBulk implements BulkStore.BeginBulk
+func (s *pgStore) BeginBulk(ctx context.Context, ref LineRef) (BulkWriter, error) {
+	if ref.Policy == "" {
+		ref.Policy = LastWriteWins
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin bulk load %s: %w", ref.IngestID, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, createStagingSQL); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("create staging table: %w", err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("purchases_staging", stagingColumns...))
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("start copy: %w", err)
+	}
+
+	return &pgBulkWriter{tx: tx, copy: stmt, ref: ref}, nil
+}
+
+// Add implements BulkWriter.Add
+func (w *pgBulkWriter) Add(ctx context.Context, rec Record) error {
+	p := rec.Purchase
+	_, err := w.copy.ExecContext(ctx,
+		rec.Line, p.TransactionID, p.PlayerID, p.PlayerUsername, p.GameTitle, p.ItemType,
+		p.Genre, p.Platform, p.AmountCents, p.Currency, p.PlayerLevel, p.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("copy purchase %s: %w", p.TransactionID, err)
+	}
+	w.records++
+	return nil
+}
+
+// Commit implements BulkWriter.Commit
+func (w *pgBulkWriter) Commit(ctx context.Context, lastLine int, conflict func(Conflict)) (BulkResult, error) {
+	defer w.Rollback()
+
+	// An Exec without arguments flushes the COPY buffer
+	if _, err := w.copy.ExecContext(ctx); err != nil {
+		return BulkResult{}, fmt.Errorf("flush copy: %w", err)
+	}
+	if err := w.copy.Close(); err != nil {
+		return BulkResult{}, fmt.Errorf("finish copy: %w", err)
+	}
+
+	mergeCtx, cancel := context.WithTimeout(ctx, bulkMergeTimeout)
+	defer cancel()
+
+	var res BulkResult
+	switch w.ref.Policy {
+	case NewerCreatedAtWins:
+		if err := w.tx.QueryRowContext(mergeCtx, staleStagingSQL).Scan(&res.Ignored); err != nil {
+			return BulkResult{}, fmt.Errorf("count stale staged purchases: %w", err)
+		}
+	case LastWriteWins:
+		if err := w.tx.QueryRowContext(mergeCtx, unchangedStagingSQL).Scan(&res.Ignored); err != nil {
+			return BulkResult{}, fmt.Errorf("count unchanged staged purchases: %w", err)
+		}
+	}
+
+	if err := w.tx.QueryRowContext(mergeCtx, mergeStagingSQL(w.ref.Policy),
+		w.ref.IngestID, w.ref.Source, w.ref.FileName).Scan(&res.Created); err != nil {
+		return BulkResult{}, fmt.Errorf("merge staged purchases: %w", err)
+	}
+
+	if w.ref.Policy == RejectOnDiff {
+		n, err := w.reportConflicts(mergeCtx, conflict)
+		if err != nil {
+			return BulkResult{}, err
+		}
+		res.Conflicted = n
+	}
+
+	if w.ref.UploadID != "" {
+		if _, err := w.tx.ExecContext(mergeCtx, saveCheckpointSQL, w.ref.UploadID, lastLine, w.ref.IngestID); err != nil {
+			return BulkResult{}, fmt.Errorf("save checkpoint %s: %w", w.ref.UploadID, err)
+		}
+	}
+
+	if err := w.tx.Commit(); err != nil {
+		return BulkResult{}, fmt.Errorf("commit bulk load: %w", err)
+	}
+	w.done = true
+
+	// Every record past the first of its transaction_id either updated the
+	// stored version or was left out by the policy
+	rest := w.records - res.Created - res.Ignored - res.Conflicted
+	switch w.ref.Policy {
+	case FirstWriteWins, RejectOnDiff:
+		res.Ignored += rest
+	default:
+		res.Updated = rest
+	}
+	return res, nil
+}
+
+// reportConflicts passes every staged record that differs from its stored version to fn
+func (w *pgBulkWriter) reportConflicts(ctx context.Context, fn func(Conflict)) (int, error) {
+	rows, err := w.tx.QueryContext(ctx, conflictingStagingSQL)
+	if err != nil {
+		return 0, fmt.Errorf("query conflicting purchases: %w", err)
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var (
+			line           int
+			staged, stored Purchase
+		)
+		err := rows.Scan(&line, &staged.TransactionID,
+			&staged.PlayerID, &staged.PlayerUsername, &staged.GameTitle, &staged.ItemType,
+			&staged.Genre, &staged.Platform, &staged.AmountCents, &staged.Currency, &staged.PlayerLevel, &staged.CreatedAt,
+			&stored.PlayerID, &stored.PlayerUsername, &stored.GameTitle, &stored.ItemType,
+			&stored.Genre, &stored.Platform, &stored.AmountCents, &stored.Currency, &stored.PlayerLevel, &stored.CreatedAt)
+		if err != nil {
+			return 0, fmt.Errorf("scan conflicting purchase: %w", err)
+		}
+		n++
+		if fn != nil {
+			fn(Conflict{Line: line, TransactionID: staged.TransactionID, Fields: diffPurchases(stored, staged)})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterate conflicting purchases: %w", err)
+	}
+	return n, nil
+}
+
+// Rollback implements BulkWriter.Rollback
+func (w *pgBulkWriter) Rollback() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.copy.Close()
+	return w.tx.Rollback()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Exit statuses of the ingest subcommand
+const (
+	exitFailed   = 1 // a file could not be ingested
+	exitUsage    = 2 // bad flags or arguments
+	exitRejected = 3 // every file was ingested, but some lines were rejected
+)
+
+// IngestCommand backfills NDJSON files straight into the store, for the
+// ingest subcommand. Each file is ingested like a lenient upload: invalid
+// lines are rejected rather than stopping the file, and refunds and
+// chargebacks are applied too.
+type IngestCommand struct {
+	Store      Store
+	Timestamps *TimestampParser // parses created_at values; nil uses the defaults
+	Limits     IngestLimits     // MaxLineBytes and MaxRecords bound each file
+
+	// Progress, if set, receives a progress line every ProgressInterval
+	// and at the end of each file; Rejects receives each rejected line
+	Progress         io.Writer
+	ProgressInterval time.Duration
+	Rejects          io.Writer
+
+	// Totals adds up the outcome of every file ingested so far
+	Totals IngestResponse
+}
+
+// IngestFile ingests one file, gzipped or not, under an ingest ID of its
+// own; name is used in messages and as purchase provenance. Rejected lines
+// are also saved for /ingest/batches/{id}/rejects.
+func (c *IngestCommand) IngestFile(ctx context.Context, name string, r io.Reader) error {
+	ingestID, err := newIngestID()
+	if err != nil {
+		return err
+	}
+
+	var (
+		progress IngestProgress
+		lastShow = time.Now()
+	)
+	show := func() {
+		if c.Progress != nil {
+			fmt.Fprintf(c.Progress, "%s: %d lines, %d created, %d updated, %d rejected\n",
+				name, progress.Lines, progress.Created, progress.Updated, progress.Rejected)
+		}
+	}
+	ing := Ingester{
+		Store: c.Store,
+		Options: IngestOptions{
+			Lenient:      true,
+			Uploader:     "cli",
+			MaxLineBytes: c.Limits.MaxLineBytes,
+			MaxRecords:   c.Limits.MaxRecords,
+		},
+		FileName:   name,
+		Source:     SourceCLI,
+		Timestamps: c.Timestamps,
+		Progress: func(p IngestProgress) {
+			progress = p
+			if now := time.Now(); c.ProgressInterval > 0 && now.Sub(lastShow) >= c.ProgressInterval {
+				lastShow = now
+				show()
+			}
+		},
+	}
+	resp, err := ing.Run(ctx, ingestID, r)
+	progress.IngestResponse = resp
+	show()
+
+	// Rejects are saved even when the file fails part-way
+	if c.Rejects != nil && resp.Rejected > 0 {
+		serr := c.Store.StreamRejects(context.WithoutCancel(ctx), ingestID, func(rej LineError) error {
+			_, err := fmt.Fprintf(c.Rejects, "%s:%d: %s\n", name, rej.Line, rej.Reason)
+			return err
+		})
+		if serr != nil && err == nil {
+			err = fmt.Errorf("load rejects: %w", serr)
+		}
+	}
+	if c.Progress != nil && resp.DeductionsCapped > 0 {
+		fmt.Fprintf(c.Progress, "%s: %d deductions capped at the player's balance: %s\n",
+			name, resp.DeductionsCapped, strings.Join(resp.CappedTransactions, ", "))
+	}
+
+	c.Totals.Created += resp.Created
+	c.Totals.Updated += resp.Updated
+	c.Totals.Rejected += resp.Rejected
+	c.Totals.Ignored += resp.Ignored
+	c.Totals.Reversals += resp.Reversals
+	c.Totals.ReversalsIgnored += resp.ReversalsIgnored
+	c.Totals.ReversalsPending += resp.ReversalsPending
+	c.Totals.DeductionsCapped += resp.DeductionsCapped
+	room := max(maxReportedConflicts-len(c.Totals.CappedTransactions), 0)
+	c.Totals.CappedTransactions = append(c.Totals.CappedTransactions, resp.CappedTransactions[:min(room, len(resp.CappedTransactions))]...)
+	c.Totals.tally()
+	if err != nil {
+		return fmt.Errorf("%s (ingest %s): %w", name, ingestID, err)
+	}
+	return nil
+}
+
+// runIngestCommand runs `ingest [flags] file...`, where a file of - reads
+// standard input, and returns the exit status
+func runIngestCommand(args []string) int {
+	fs := flag.NewFlagSet("ingest", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: ingest [flags] file... (- reads standard input)")
+		fmt.Fprintln(fs.Output(), "Exits with 1 if a file fails, 3 if lines were rejected.")
+		fs.PrintDefaults()
+	}
+	var (
+		dbURL    = fs.String("db", getEnvOrDefault("DATABASE_URL", ""), "Database connection string")
+		interval = fs.Duration("progress", 5*time.Second, "How often a progress line is printed (0 disables)")
+
+		tsFlags    = addTimestampFlags(fs)
+		limitFlags = addLimitFlags(fs)
+	)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 || *dbURL == "" {
+		fs.Usage()
+		return exitUsage
+	}
+
+	tp, err := tsFlags.parser()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	db, err := connectDB(ctx, *dbURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	defer db.Close()
+
+	cmd := IngestCommand{
+		Store:            &pgStore{db: db},
+		Timestamps:       tp,
+		Limits:           limitFlags.limits(),
+		Progress:         os.Stderr,
+		ProgressInterval: *interval,
+		Rejects:          os.Stderr,
+	}
+	status := 0
+	for _, path := range fs.Args() {
+		if err := ingestPath(ctx, &cmd, path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = exitFailed
+			if ctx.Err() != nil {
+				break
+			}
+		}
+	}
+
+	fmt.Printf("created=%d updated=%d rejected=%d\n", cmd.Totals.Created, cmd.Totals.Updated, cmd.Totals.Rejected)
+	if status == 0 && cmd.Totals.Rejected > 0 {
+		status = exitRejected
+	}
+	return status
+}
+
+// ingestPath ingests a file by path, or standard input for -
+func ingestPath(ctx context.Context, cmd *IngestCommand, path string) error {
+	if path == "-" {
+		return cmd.IngestFile(ctx, "stdin", os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cmd.IngestFile(ctx, path, f)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompressionGrace is the amount of output allowed before the ratio guard
+// kicks in, so small but highly compressible files are not rejected
+const decompressionGrace = 1 << 20
+
+// decodeUpload returns a reader over the decompressed contents of an upload.
+// Gzip is detected from the declared content encoding or from the magic bytes,
+// and decompressed as it is read. A maxRatio > 0 aborts the read once the
+// output grows beyond maxRatio times the compressed input consumed so far.
+func decodeUpload(r io.Reader, contentEncoding string, maxRatio float64) (io.Reader, error) {
+	compressed := &countingReader{r: r}
+	br := bufio.NewReader(compressed)
+
+	isGzip := false
+	switch enc := strings.ToLower(strings.TrimSpace(contentEncoding)); enc {
+	case "gzip", "x-gzip":
+		isGzip = true
+	case "", "identity":
+		magic, _ := br.Peek(len(gzipMagic))
+		isGzip = bytes.Equal(magic, gzipMagic)
+	default:
+		return nil, fmt.Errorf("%w: unsupported content encoding %q", ErrBadInput, enc)
+	}
+
+	if !isGzip {
+		return br, nil
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid gzip stream: %v", ErrInvalidFormat, err)
+	}
+	if maxRatio <= 0 {
+		return zr, nil
+	}
+	return &ratioLimitedReader{r: zr, compressed: compressed, maxRatio: maxRatio}, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// read returns the number of bytes read so far; unlike n, it may be called
+// while another goroutine is reading
+func (c *countingReader) read() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// ratioLimitedReader guards against decompression bombs by comparing the
+// decompressed output with the compressed input consumed
+type ratioLimitedReader struct {
+	r          io.Reader
+	compressed *countingReader
+	out        int64
+	maxRatio   float64
+}
+
+func (l *ratioLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.out += int64(n)
+	if l.out > decompressionGrace && float64(l.out) > l.maxRatio*float64(l.compressed.n) {
+		return n, fmt.Errorf("%w: decompressed size exceeds %gx the compressed size", ErrBadInput, l.maxRatio)
+	}
+	return n, err
+}
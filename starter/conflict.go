@@ -0,0 +1,67 @@
+package main
+
+import "fmt"
+
+// ConflictPolicy decides which version of a transaction wins when the same
+// transaction_id is ingested more than once, within one file or across ingests
+type ConflictPolicy string
+
+const (
+	// LastWriteWins overwrites the stored purchase with every new version
+	// that differs from it
+	LastWriteWins ConflictPolicy = "last-write-wins"
+
+	// FirstWriteWins keeps the first stored version and ignores later ones
+	FirstWriteWins ConflictPolicy = "first-write-wins"
+
+	// NewerCreatedAtWins replaces the stored version only with one whose
+	// created_at is strictly later
+	NewerCreatedAtWins ConflictPolicy = "newer-created_at-wins"
+
+	// RejectOnDiff keeps the first stored version, ignores identical
+	// duplicates and reports duplicates with differing fields as conflicts
+	RejectOnDiff ConflictPolicy = "reject-on-diff"
+)
+
+// ParseConflictPolicy validates a policy name; empty selects LastWriteWins
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case "":
+		return LastWriteWins, nil
+	case LastWriteWins, FirstWriteWins, NewerCreatedAtWins, RejectOnDiff:
+		return p, nil
+	default:
+		return "", fmt.Errorf("%w: unknown conflict policy %q", ErrBadInput, s)
+	}
+}
+
+// Conflict is a duplicate transaction whose fields differ from the version
+// that is already stored
+type Conflict struct {
+	Line          int      `json:"line"`
+	TransactionID string   `json:"transaction_id"`
+	Fields        []string `json:"fields"`
+}
+
+// diffPurchases returns the names of the ingested fields that differ between two purchases
+func diffPurchases(a, b Purchase) []string {
+	var fields []string
+	add := func(name string, differs bool) {
+		if differs {
+			fields = append(fields, name)
+		}
+	}
+
+	add("player_id", a.PlayerID != b.PlayerID)
+	add("player_username", a.PlayerUsername != b.PlayerUsername)
+	add("game_title", a.GameTitle != b.GameTitle)
+	add("item_type", a.ItemType != b.ItemType)
+	add("genre", a.Genre != b.Genre)
+	add("platform", a.Platform != b.Platform)
+	add("amount_cents", a.AmountCents != b.AmountCents)
+	add("currency", a.Currency != b.Currency)
+	add("player_level", a.PlayerLevel != b.PlayerLevel)
+	add("created_at", !a.CreatedAt.Equal(b.CreatedAt))
+
+	return fields
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RawRecord is one record read by a Decoder, before it is validated
+type RawRecord struct {
+	Input  PurchaseInput
+	Line   int    // 1-based line number; the element number in a JSON array
+	Offset int64  // byte offset of the start of the record
+	Raw    []byte // the record as read, valid until the next call to Next
+
+	// Version is the schema_version the record was sent with; Input has
+	// already been upgraded to CurrentSchemaVersion
+	Version int
+
+	// Err is set when this record could not be decoded; the following
+	// records can still be read
+	Err error
+}
+
+// Decoder reads the records of an upload one at a time, so that memory use
+// does not grow with the size of the upload
+type Decoder interface {
+	// Next returns the next record, or io.EOF after the last one. Any other
+	// error means the rest of the input cannot be read.
+	Next() (RawRecord, error)
+}
+
+// lineSkipper is implemented by decoders that can pass over leading lines
+// without decoding them, for resuming an upload
+type lineSkipper interface {
+	skipLines(n int)
+}
+
+// lineLimiter is implemented by decoders that can refuse records longer
+// than a limit before buffering them whole
+type lineLimiter interface {
+	limitLines(max int)
+}
+
+// recordReadAhead is how far past the end of a record of the maximum size a
+// decoder behind a recordLimitReader may read ahead
+const recordReadAhead = 64 * 1024
+
+// errRecordTooLong is returned by a recordLimitReader to the decoder reading
+// through it, which reports it as a LimitError
+var errRecordTooLong = errors.New("record too long")
+
+// recordLimitReader caps what a decoder buffering whole records can read
+// past the start of the record it is decoding, so that an oversized record
+// is cut off rather than read into memory
+type recordLimitReader struct {
+	r     io.Reader
+	max   int64 // 0 = no limit
+	start int64 // offset of the record being decoded
+	n     int64 // bytes read
+}
+
+func (l *recordLimitReader) Read(p []byte) (int, error) {
+	if l.max > 0 {
+		room := l.start + l.max + recordReadAhead - l.n
+		if room <= 0 {
+			return 0, errRecordTooLong
+		}
+		if int64(len(p)) > room {
+			p = p[:room]
+		}
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// limitError reports a record of size bytes, or one cut off by
+// errRecordTooLong if err is set, as exceeding the limit
+func (l *recordLimitReader) limitError(line int, size int64, err error) *LimitError {
+	if l.max == 0 || (!errors.Is(err, errRecordTooLong) && size <= l.max) {
+		return nil
+	}
+	return &LimitError{Limit: "max_line_bytes", Max: l.max, Line: line, Offset: l.start}
+}
+
+// Format is an upload format with the Content-Types and file extensions
+// that select it
+type Format struct {
+	Name       string
+	MediaTypes []string
+	Extensions []string // including the dot, e.g. ".csv"
+	NewDecoder func(io.Reader) Decoder
+}
+
+// FormatNDJSON is used when neither Content-Type nor file name select a format
+const FormatNDJSON = "ndjson"
+
+var formats = map[string]Format{}
+
+// RegisterFormat makes a format available to ingests. It panics if the name
+// is already registered.
+func RegisterFormat(f Format) {
+	if _, dup := formats[f.Name]; dup {
+		panic("ingest: RegisterFormat called twice for format " + f.Name)
+	}
+	formats[f.Name] = f
+}
+
+func init() {
+	RegisterFormat(Format{
+		Name:       FormatNDJSON,
+		MediaTypes: []string{"application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines"},
+		Extensions: []string{".ndjson", ".jsonl"},
+		NewDecoder: NewNDJSONDecoder,
+	})
+	RegisterFormat(Format{
+		Name:       "json",
+		MediaTypes: []string{"application/json"},
+		Extensions: []string{".json"},
+		NewDecoder: NewJSONArrayDecoder,
+	})
+	RegisterFormat(Format{
+		Name:       "csv",
+		MediaTypes: []string{"text/csv"},
+		Extensions: []string{".csv"},
+		NewDecoder: NewCSVDecoder,
+	})
+	RegisterFormat(Format{
+		Name:       "tsv",
+		MediaTypes: []string{"text/tab-separated-values"},
+		Extensions: []string{".tsv", ".tab"},
+		NewDecoder: NewTSVDecoder,
+	})
+}
+
+// LookupFormat returns a registered format by name; empty selects NDJSON
+func LookupFormat(name string) (Format, error) {
+	if name == "" {
+		name = FormatNDJSON
+	}
+	f, ok := formats[name]
+	if !ok {
+		return Format{}, fmt.Errorf("%w: unknown format %q", ErrBadInput, name)
+	}
+	return f, nil
+}
+
+// formatForMediaType returns the format registered for a Content-Type
+func formatForMediaType(contentType string) (Format, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return Format{}, false
+	}
+	for _, f := range formats {
+		for _, mt := range f.MediaTypes {
+			if mt == mediaType {
+				return f, true
+			}
+		}
+	}
+	return Format{}, false
+}
+
+// DetectFormat selects the format of an upload from its Content-Type or,
+// failing that, the extension of its file name, ignoring a trailing .gz.
+// Uploads that match neither are read as NDJSON.
+func DetectFormat(contentType, fileName string) Format {
+	if f, ok := formatForMediaType(contentType); ok {
+		return f
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(fileName), ".gz")
+	ext := path.Ext(name)
+	for _, f := range formats {
+		for _, e := range f.Extensions {
+			if e == ext {
+				return f
+			}
+		}
+	}
+	return formats[FormatNDJSON]
+}
+
+// formatMediaTypes lists every registered Content-Type, for error messages
+func formatMediaTypes() []string {
+	var types []string
+	for _, f := range formats {
+		types = append(types, f.MediaTypes...)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ndjsonDecoder reads one JSON object per line, skipping blank lines
+type ndjsonDecoder struct {
+	lr      *lineReader
+	pd      *PurchaseDecoder
+	skip    int
+	current []byte // the last record upgraded to the current schema version
+}
+
+// NewNDJSONDecoder returns a Decoder for newline-delimited JSON
+func NewNDJSONDecoder(r io.Reader) Decoder {
+	return &ndjsonDecoder{lr: newLineReader(r), pd: NewPurchaseDecoder()}
+}
+
+func (d *ndjsonDecoder) skipLines(n int) {
+	d.skip = n
+}
+
+func (d *ndjsonDecoder) limitLines(max int) {
+	d.lr.max = max
+}
+
+func (d *ndjsonDecoder) Next() (RawRecord, error) {
+	rec, err := d.next()
+	if err != nil {
+		return RawRecord{}, err
+	}
+	d.current = decodeJSONRecord(&rec, d.pd)
+	return rec, nil
+}
+
+func (d *ndjsonDecoder) buffered() bool {
+	return d.lr.br.Buffered() > 0
+}
+
+// next reads the next non-blank line without decoding it
+func (d *ndjsonDecoder) next() (RawRecord, error) {
+	for {
+		line, err := d.lr.next()
+		var limit *LimitError
+		if err == io.EOF || errors.As(err, &limit) {
+			return RawRecord{}, err
+		}
+		if err != nil {
+			return RawRecord{}, fmt.Errorf("reading line %d: %w", d.lr.line, err)
+		}
+
+		if d.lr.line <= d.skip {
+			continue
+		}
+		trimmed := bytes.TrimSpace(line)
+		if len(trimmed) == 0 {
+			continue
+		}
+
+		return RawRecord{Line: d.lr.line, Offset: d.lr.start, Raw: trimmed}, nil
+	}
+}
+
+// jsonArrayDecoder streams the elements of a top-level JSON array
+type jsonArrayDecoder struct {
+	dec     *json.Decoder
+	limit   *recordLimitReader
+	pd      *PurchaseDecoder
+	started bool
+	index   int
+	raw     json.RawMessage
+	current []byte // the last record upgraded to the current schema version
+}
+
+// NewJSONArrayDecoder returns a Decoder for a JSON array of records. The
+// array is read element by element rather than as a whole.
+func NewJSONArrayDecoder(r io.Reader) Decoder {
+	limit := &recordLimitReader{r: r}
+	return &jsonArrayDecoder{dec: json.NewDecoder(limit), limit: limit, pd: NewPurchaseDecoder()}
+}
+
+func (d *jsonArrayDecoder) limitLines(max int) {
+	d.limit.max = int64(max)
+}
+
+func (d *jsonArrayDecoder) Next() (RawRecord, error) {
+	rec, err := d.next()
+	if err != nil {
+		return RawRecord{}, err
+	}
+	d.current = decodeJSONRecord(&rec, d.pd)
+	return rec, nil
+}
+
+func (d *jsonArrayDecoder) buffered() bool {
+	r, ok := d.dec.Buffered().(interface{ Len() int })
+	return ok && r.Len() > 0
+}
+
+// next reads the next array element without decoding it
+func (d *jsonArrayDecoder) next() (RawRecord, error) {
+	if !d.started {
+		tok, err := d.dec.Token()
+		if err == io.EOF {
+			return RawRecord{}, io.EOF
+		}
+		if err != nil {
+			return RawRecord{}, fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+		}
+		if tok != json.Delim('[') {
+			return RawRecord{}, fmt.Errorf("%w: expected a JSON array", ErrInvalidFormat)
+		}
+		d.started = true
+	}
+
+	d.limit.start = d.dec.InputOffset()
+	if !d.dec.More() {
+		if _, err := d.dec.Token(); err != nil {
+			return RawRecord{}, fmt.Errorf("%w: after element %d: %v", ErrInvalidFormat, d.index, unexpectedEOF(err))
+		}
+		if _, err := d.dec.Token(); err != io.EOF {
+			return RawRecord{}, fmt.Errorf("%w: data after the JSON array", ErrInvalidFormat)
+		}
+		return RawRecord{}, io.EOF
+	}
+
+	// A malformed element leaves the decoder unable to find the next one
+	err := d.dec.Decode(&d.raw)
+	if limit := d.limit.limitError(d.index+1, int64(len(d.raw)), err); limit != nil {
+		return RawRecord{}, limit
+	}
+	if err != nil {
+		return RawRecord{}, fmt.Errorf("%w: element %d: %v", ErrInvalidFormat, d.index+1, unexpectedEOF(err))
+	}
+	d.index++
+
+	return RawRecord{
+		Line:   d.index,
+		Offset: d.dec.InputOffset() - int64(len(d.raw)),
+		Raw:    d.raw,
+	}, nil
+}
+
+// unexpectedEOF reports a premature end of input as such
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// csvColumns maps header names to the PurchaseInput fields they fill
+var csvColumns = map[string]func(in *PurchaseInput, v string) error{
+	"transaction_id":  func(in *PurchaseInput, v string) error { in.TransactionID = v; return nil },
+	"player_id":       func(in *PurchaseInput, v string) error { in.PlayerID = v; return nil },
+	"player_username": func(in *PurchaseInput, v string) error { in.PlayerUsername = v; return nil },
+	"game_title":      func(in *PurchaseInput, v string) error { in.GameTitle = v; return nil },
+	"item_type":       func(in *PurchaseInput, v string) error { in.ItemType = v; return nil },
+	"genre":           func(in *PurchaseInput, v string) error { in.Genre = v; return nil },
+	"platform":        func(in *PurchaseInput, v string) error { in.Platform = v; return nil },
+	"amount_cents":    func(in *PurchaseInput, v string) error { return parseCSVInt(&in.AmountCents, v) },
+	"currency":        func(in *PurchaseInput, v string) error { in.Currency = v; return nil },
+	"player_level":    func(in *PurchaseInput, v string) error { return parseCSVInt(&in.PlayerLevel, v) },
+	"created_at":      func(in *PurchaseInput, v string) error { in.CreatedAt = Timestamp(v); return nil },
+	"event_type":      func(in *PurchaseInput, v string) error { in.EventType = v; return nil },
+}
+
+// parseCSVInt parses an integer column; an empty value is zero
+func parseCSVInt(dst *int, v string) error {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		*dst = 0
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", v)
+	}
+	*dst = n
+	return nil
+}
+
+// csvDecoder reads delimited text whose header row names the columns.
+// Header names match the NDJSON field names, ignoring case and surrounding
+// space; columns with other names are ignored.
+type csvDecoder struct {
+	r       *csv.Reader
+	limit   *recordLimitReader
+	line    int      // last line of the last row read
+	columns []string // field name of each column, "" if ignored
+	unknown string   // first ignored column name, for strict mode
+
+	// filled holds the fields with a non-empty value in the last record
+	filled map[string]bool
+
+	raw bytes.Buffer
+	w   *csv.Writer
+}
+
+// NewCSVDecoder returns a Decoder for comma-separated values with a header row
+func NewCSVDecoder(r io.Reader) Decoder {
+	return newDelimitedDecoder(r, ',')
+}
+
+// NewTSVDecoder returns a Decoder for tab-separated values with a header row.
+// Quotes have no special meaning.
+func NewTSVDecoder(r io.Reader) Decoder {
+	d := newDelimitedDecoder(r, '\t')
+	d.r.LazyQuotes = true
+	return d
+}
+
+func newDelimitedDecoder(r io.Reader, comma rune) *csvDecoder {
+	limit := &recordLimitReader{r: r}
+	d := &csvDecoder{r: csv.NewReader(limit), limit: limit, filled: make(map[string]bool)}
+	d.r.Comma = comma
+	d.r.ReuseRecord = true
+	d.w = csv.NewWriter(&d.raw)
+	d.w.Comma = comma
+	return d
+}
+
+func (d *csvDecoder) limitLines(max int) {
+	d.limit.max = int64(max)
+}
+
+// read reads the next row, refusing rows longer than the limit
+func (d *csvDecoder) read() ([]string, error) {
+	d.limit.start = d.r.InputOffset()
+	fields, err := d.r.Read()
+	// The size counts the line ending, but for one byte
+	size := d.r.InputOffset() - d.limit.start - 1
+	if limit := d.limit.limitError(d.line+1, size, err); limit != nil {
+		return nil, limit
+	}
+	var parseErr *csv.ParseError
+	switch n := len(fields); {
+	case errors.As(err, &parseErr):
+		d.line = parseErr.Line
+	case n > 0:
+		line, _ := d.r.FieldPos(n - 1)
+		d.line = line + strings.Count(fields[n-1], "\n")
+	}
+	return fields, err
+}
+
+// readHeader maps the header row to field names
+func (d *csvDecoder) readHeader() error {
+	header, err := d.read()
+	if err != nil {
+		return err
+	}
+
+	d.columns = make([]string, len(header))
+	seen := make(map[string]bool, len(header))
+	for i, name := range header {
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := csvColumns[name]; !ok {
+			if d.unknown == "" && name != "" {
+				d.unknown = name
+			}
+			continue
+		}
+		if seen[name] {
+			return fmt.Errorf("%w: header has column %q more than once", ErrInvalidFormat, name)
+		}
+		seen[name] = true
+		d.columns[i] = name
+	}
+	if !seen["transaction_id"] {
+		return fmt.Errorf("%w: header has no transaction_id column", ErrInvalidFormat)
+	}
+	return nil
+}
+
+func (d *csvDecoder) Next() (RawRecord, error) {
+	if d.columns == nil {
+		if err := d.readHeader(); err != nil {
+			var limit *LimitError
+			if err == io.EOF || errors.Is(err, ErrInvalidFormat) || errors.As(err, &limit) {
+				return RawRecord{}, err
+			}
+			return RawRecord{}, fmt.Errorf("%w: reading header: %v", ErrInvalidFormat, err)
+		}
+	}
+
+	offset := d.r.InputOffset()
+	fields, err := d.read()
+	var limit *LimitError
+	if err == io.EOF || errors.As(err, &limit) {
+		return RawRecord{}, err
+	}
+
+	// Parse errors, such as a wrong number of fields, affect only their row
+	var parseErr *csv.ParseError
+	if err != nil && !errors.As(err, &parseErr) {
+		return RawRecord{}, fmt.Errorf("reading row: %w", err)
+	}
+
+	rec := RawRecord{Offset: offset, Version: CurrentSchemaVersion}
+	if parseErr != nil {
+		rec.Line = parseErr.StartLine
+		rec.Err = fmt.Errorf("%w: %v", ErrInvalidFormat, parseErr.Err)
+	} else {
+		rec.Line, _ = d.r.FieldPos(0)
+	}
+
+	clear(d.filled)
+	for i, v := range fields {
+		if i >= len(d.columns) || d.columns[i] == "" {
+			continue
+		}
+		d.filled[d.columns[i]] = strings.TrimSpace(v) != ""
+		if err := csvColumns[d.columns[i]](&rec.Input, v); err != nil && rec.Err == nil {
+			rec.Err = fmt.Errorf("%w: %s: %v", ErrInvalidFormat, d.columns[i], err)
+		}
+	}
+
+	d.raw.Reset()
+	d.w.Write(fields)
+	d.w.Flush()
+	rec.Raw = bytes.TrimRight(d.raw.Bytes(), "\r\n")
+	return rec, nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+// StoredTransaction is what the store already holds for a transaction_id
+type StoredTransaction struct {
+	Purchase Purchase
+	Refunds  map[EventType]Refund // the refund and chargeback of the purchase, if any
+}
+
+// LookupStore answers the read-only queries of a dry run
+type LookupStore interface {
+	// LookupTransactions returns the stored purchase, and refund if any, of
+	// each of the given transaction_ids that exists. Unknown IDs are absent.
+	LookupTransactions(ctx context.Context, transactionIDs []string) (map[string]StoredTransaction, error)
+}
+
+// DryRunResponse predicts the outcome of an ingest without writing anything.
+// The counts are those the ingest would report if nothing changed in between.
+type DryRunResponse struct {
+	IngestResponse
+	DryRun  bool        `json:"dry_run"`
+	Rejects []LineError `json:"rejects"` // the first maxReportedRejects rejected lines
+}
+
+// maxReportedRejects bounds the rejected lines carried in a dry run response
+const maxReportedRejects = 1000
+
+// dryRunLookupBatch is the number of records whose transaction_ids are looked up at once
+const dryRunLookupBatch = 500
+
+// DryRun validates r like Run and predicts which records would be created,
+// updated, ignored or conflict under the conflict policy, using only reads.
+// Every invalid line is reported, whether or not the options are lenient;
+// refunds of unknown purchases are rejected as a lenient ingest would.
+// A resumable upload skips the lines its checkpoint says were committed, as
+// Run would; the duplicate file ledger is still checked against the whole file.
+func (ing Ingester) DryRun(ctx context.Context, r io.Reader) (DryRunResponse, error) {
+	resp := DryRunResponse{DryRun: true, Rejects: []LineError{}}
+
+	format, err := LookupFormat(ing.Options.Format)
+	if err != nil {
+		return resp, err
+	}
+
+	_, upload, err := openUpload(r, ing.ContentEncoding, ing.MaxDecompressionRatio)
+	if err != nil {
+		return resp, err
+	}
+	r = upload
+
+	reject := func(rej LineError) {
+		resp.Rejected++
+		if len(resp.Rejects) < maxReportedRejects {
+			resp.Rejects = append(resp.Rejects, rej)
+		}
+	}
+
+	// known holds the state each transaction_id would have after the records
+	// predicted so far; absent IDs have not been looked up yet
+	known := make(map[string]*StoredTransaction)
+	var pending []Record
+
+	flush := func() error {
+		var ids []string
+		for _, rec := range pending {
+			id := recordTransactionID(rec)
+			if _, ok := known[id]; !ok {
+				known[id] = nil
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) > 0 {
+			stored, err := ing.Store.LookupTransactions(ctx, ids)
+			if err != nil {
+				return err
+			}
+			for id, st := range stored {
+				known[id] = &st
+			}
+		}
+
+		for _, rec := range pending {
+			if err := ing.predict(rec, known, &resp.IngestResponse); err != nil {
+				reject(LineError{Line: rec.Line, Offset: rec.Offset, Reason: err.Error(), Err: err})
+				continue
+			}
+			resp.addVersions(rec.Version, 1)
+		}
+		pending = pending[:0]
+		resp.tally()
+		return nil
+	}
+
+	opts := ing.streamOptions()
+	if ing.Options.UploadID != "" {
+		if opts.SkipLines, err = ing.Store.GetCheckpoint(ctx, ing.Options.UploadID); err != nil {
+			return resp, err
+		}
+		resp.Skipped = opts.SkipLines
+	}
+	opts.Reject = func(rej LineError) error {
+		// Rejects are reported in line order, after the records before them
+		if err := flush(); err != nil {
+			return err
+		}
+		reject(rej)
+		return nil
+	}
+	err = StreamRecords(ctx, format.NewDecoder(r), opts, func(rec Record) error {
+		pending = append(pending, rec)
+		if len(pending) < dryRunLookupBatch {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	resp.tally()
+	if err != nil {
+		return resp, err
+	}
+
+	if _, err := io.Copy(io.Discard, upload); err != nil {
+		return resp, fmt.Errorf("read upload: %w", err)
+	}
+	original, err := ing.Store.FindIngestFile(ctx, upload.sum())
+	switch {
+	case err == nil:
+		resp.DuplicateOf = &original
+	case !errors.Is(err, ErrNotFound):
+		return resp, err
+	}
+	return resp, nil
+}
+
+// recordTransactionID is the transaction_id a record writes
+func recordTransactionID(rec Record) string {
+	if rec.Refund != nil {
+		return rec.Refund.TransactionID
+	}
+	return rec.Purchase.TransactionID
+}
+
+// predict counts the outcome the store would report for rec, mirroring
+// AddPurchase and AddRefund, and updates known accordingly. A refund of an
+// unknown purchase is returned as an ErrBadInput error.
+func (ing Ingester) predict(rec Record, known map[string]*StoredTransaction, resp *IngestResponse) error {
+	id := recordTransactionID(rec)
+	st := known[id]
+
+	if r := rec.Refund; r != nil {
+		if st == nil {
+			return fmt.Errorf("%w: %s references unknown transaction_id %q", ErrBadInput, r.EventType, id)
+		}
+		prev, ok := st.Refunds[r.EventType]
+		switch {
+		case ok && prev.Processed:
+			// Already reversed; the event is kept as is
+			resp.Ignored++
+			resp.ReversalsIgnored++
+			return nil
+		case ok:
+			resp.Updated++
+		default:
+			resp.Created++
+		}
+		if st.Refunds == nil {
+			st.Refunds = make(map[EventType]Refund)
+		}
+		// An enriched purchase has the event reversed at once; whether its
+		// deduction would be capped depends on the balance at the time
+		reversal := *r
+		reversal.Processed = st.Purchase.Enriched
+		st.Refunds[r.EventType] = reversal
+		resp.Reversals++
+		if !reversal.Processed {
+			resp.ReversalsPending++
+		}
+		return nil
+	}
+
+	p := rec.Purchase
+	if st == nil {
+		resp.Created++
+		known[id] = &StoredTransaction{Purchase: p}
+		return nil
+	}
+
+	switch ing.Options.ConflictPolicy {
+	case FirstWriteWins:
+		resp.Ignored++
+	case NewerCreatedAtWins:
+		if !st.Purchase.CreatedAt.Before(p.CreatedAt) {
+			resp.Ignored++
+			return nil
+		}
+		resp.Updated++
+		st.Purchase = p
+	case RejectOnDiff:
+		if fields := diffPurchases(st.Purchase, p); len(fields) > 0 {
+			resp.addConflict(Conflict{Line: rec.Line, TransactionID: id, Fields: fields})
+		} else {
+			resp.Ignored++
+		}
+	default:
+		if len(diffPurchases(st.Purchase, p)) == 0 {
+			resp.Ignored++
+			return nil
+		}
+		resp.Updated++
+		st.Purchase = p
+	}
+	return nil
+}
+
+// ingestDryRun checks a multipart upload without ingesting it; see handleIngest
+func (s *Server) ingestDryRun(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseIngestOptions(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resumable, err := parseBoolParam(r, "resumable")
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limits := s.limitsFor(r)
+	opts.MaxLineBytes, opts.MaxRecords = limits.MaxLineBytes, limits.MaxRecords
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeJSONError(w, "Missing or invalid file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if opts.UploadID == "" && resumable {
+		if opts.UploadID, err = hashUpload(file); err != nil {
+			writeJSONError(w, "Failed to read file", http.StatusInternalServerError)
+			return
+		}
+	}
+	opts.Format = DetectFormat(header.Header.Get("Content-Type"), header.Filename).Name
+
+	ing := Ingester{
+		Store:                 s.store,
+		Options:               opts,
+		ContentEncoding:       header.Header.Get("Content-Encoding"),
+		MaxDecompressionRatio: s.cfg.MaxDecompressionRatio,
+		Timestamps:            s.cfg.Timestamps,
+		Schema:                s.cfg.Schema,
+		Decoders:              s.cfg.Decoders,
+	}
+	resp, err := ing.DryRun(r.Context(), file)
+	if err != nil {
+		log.Printf("dry run of %s failed: %v", header.Filename, err)
+		writeIngestError(w, resp.IngestResponse, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// LookupTransactions implements LookupStore.LookupTransactions
+func (s *pgStore) LookupTransactions(ctx context.Context, transactionIDs []string) (map[string]StoredTransaction, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stored := make(map[string]StoredTransaction, len(transactionIDs))
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT`+purchaseColumns+` FROM purchases WHERE transaction_id = ANY($1)`, pq.Array(transactionIDs))
+	if err != nil {
+		return nil, fmt.Errorf("look up purchases: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p, err := scanPurchase(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan purchase: %w", err)
+		}
+		stored[p.TransactionID] = StoredTransaction{Purchase: p}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate purchases: %w", err)
+	}
+
+	refunds, err := s.db.QueryContext(ctx,
+		`SELECT`+refundColumns+` FROM refunds WHERE transaction_id = ANY($1)`, pq.Array(transactionIDs))
+	if err != nil {
+		return nil, fmt.Errorf("look up refunds: %w", err)
+	}
+	defer refunds.Close()
+	for refunds.Next() {
+		r, err := scanRefund(refunds)
+		if err != nil {
+			return nil, fmt.Errorf("scan refund: %w", err)
+		}
+		st := stored[r.TransactionID]
+		if st.Refunds == nil {
+			st.Refunds = make(map[EventType]Refund)
+		}
+		st.Refunds[r.EventType] = r
+		stored[r.TransactionID] = st
+	}
+	if err := refunds.Err(); err != nil {
+		return nil, fmt.Errorf("iterate refunds: %w", err)
+	}
+	return stored, nil
+}
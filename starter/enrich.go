@@ -8,41 +8,166 @@ import (
 	"time"
 )
 
+// EnrichmentStore is the storage the enrichment pipeline works against
+type EnrichmentStore interface {
+	PurchaseStore
+
+	// CreditLoyalty adds the points a purchase earned to its player's balance.
+	// Each purchase is credited at most once, however often it is called.
+	CreditLoyalty(ctx context.Context, p Purchase, points int) error
+
+	// ClaimRefundsForReversal leases up to batch unprocessed refunds whose
+	// purchase has already been enriched
+	ClaimRefundsForReversal(ctx context.Context, batch int) ([]Refund, error)
+
+	// ReverseLoyalty deducts the points the amount of a refund or chargeback
+	// earned, out of those its purchase has not given back yet and capped at
+	// the player's balance, and returns the processed event
+	ReverseLoyalty(ctx context.Context, r Refund) (Refund, error)
+}
+
 // WorkerPool manages concurrent purchase enrichment workers
 type WorkerPool struct {
-	Workers int           // Number of worker goroutines
-	Batch   int           // Number of purchases to claim per batch
-	Store   PurchaseStore // Database store interface
+	Workers int             // Number of worker goroutines
+	Batch   int             // Number of purchases to claim per batch
+	Store   EnrichmentStore // Database store interface
+	Poll    time.Duration   // Wait between claims when there is nothing to do
 }
 
 // Run starts the worker pool with the given context
 // Workers will stop when context is cancelled or an error occurs
 func (wp WorkerPool) Run(ctx context.Context) error {
-	// TODO: Implement this.
-	
-	return nil
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+		cancel()
+	}
+
+	jobs := make(chan []Purchase)
+	for i := 1; i <= max(wp.Workers, 1); i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			if err := wp.worker(ctx, id, jobs); err != nil {
+				fail(err)
+			}
+		}(i)
+	}
+
+	err := wp.dispatch(ctx, jobs)
+	close(jobs)
+	wg.Wait()
+
+	if err != nil {
+		fail(err)
+	}
+	return firstErr
+}
+
+// dispatch claims batches of purchases for the workers and reverses refunds
+// until ctx is cancelled. Refunds are only claimed once their purchase is
+// enriched, so the points being reversed have been credited.
+func (wp WorkerPool) dispatch(ctx context.Context, jobs chan<- []Purchase) error {
+	poll := wp.Poll
+	if poll <= 0 {
+		poll = time.Second
+	}
+
+	for {
+		batch, err := Retry(ctx, 3, 100*time.Millisecond, func(ctx context.Context) ([]Purchase, error) {
+			return wp.Store.ClaimBatchForEnrichment(ctx, wp.Batch)
+		})
+		if err != nil {
+			return fmt.Errorf("claim purchases: %w", err)
+		}
+		if len(batch) > 0 {
+			select {
+			case jobs <- batch:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		reversed, err := wp.reverseRefunds(ctx)
+		if err != nil {
+			return err
+		}
+
+		if len(batch) == 0 && reversed == 0 {
+			select {
+			case <-time.After(poll):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
 }
 
 // worker processes purchase enrichment jobs
 func (wp WorkerPool) worker(ctx context.Context, workerID int, jobs <-chan []Purchase) error {
 	log.Printf("Worker %d started", workerID)
-	
-	// TODO: Implement this. We want to update the player loyalty points for each purchase.
+
+	for batch := range jobs {
+		for _, purchase := range batch {
+			if err := wp.enrichPurchase(ctx, purchase); err != nil {
+				return fmt.Errorf("worker %d: %w", workerID, err)
+			}
+		}
+	}
 	return nil
 }
 
 // enrichPurchase enriches a single purchase with computed data
 func (wp WorkerPool) enrichPurchase(ctx context.Context, purchase Purchase) error {
-	// TODO: Implement purchase enrichment logic
+	points := loyaltyPoints(purchase)
+	err := wp.Store.CreditLoyalty(ctx, purchase, points)
+	if err != nil {
+		return fmt.Errorf("failed to credit loyalty points: %w", err)
+	}
 
-		
 	// Mark purchase as enriched
-	err := wp.Store.MarkEnriched(ctx, purchase.ID)
+	err = wp.Store.MarkEnriched(ctx, purchase.ID)
 	if err != nil {
 		return fmt.Errorf("failed to mark purchase as enriched: %w", err)
 	}
-	
+
 	log.Printf("Enriched purchase %s", purchase.TransactionID)
-	
+
 	return nil
-}
\ No newline at end of file
+}
+
+// reverseRefunds processes one batch of refunds and chargebacks and returns
+// how many were reversed
+func (wp WorkerPool) reverseRefunds(ctx context.Context) (int, error) {
+	refunds, err := wp.Store.ClaimRefundsForReversal(ctx, wp.Batch)
+	if err != nil {
+		return 0, fmt.Errorf("claim refunds: %w", err)
+	}
+
+	for _, r := range refunds {
+		reversed, err := wp.Store.ReverseLoyalty(ctx, r)
+		if err != nil {
+			return 0, fmt.Errorf("failed to reverse %s of %s: %w", r.EventType, r.TransactionID, err)
+		}
+		if reversed.DeductionCapped {
+			log.Printf("Reversed %s of %s: deducted %d of %d points, capped at the available balance",
+				reversed.EventType, reversed.TransactionID, reversed.PointsDeducted, reversed.PointsDue)
+		} else {
+			log.Printf("Reversed %s of %s: deducted %d points", reversed.EventType, reversed.TransactionID, reversed.PointsDeducted)
+		}
+	}
+	return len(refunds), nil
+}
+
+// loyaltyPoints is the number of points a purchase earns: one per whole
+// unit of its currency
+func loyaltyPoints(p Purchase) int {
+	return p.AmountCents / 100
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// JobProgress is the payload of a progress event of an ingest job
+type JobProgress struct {
+	Lines    int   `json:"lines"` // the last line read
+	Created  int   `json:"created"`
+	Updated  int   `json:"updated"`
+	Rejected int   `json:"rejected"`
+	Bytes    int64 `json:"bytes"` // bytes of the upload consumed
+
+	// TotalBytes and EstimatedCompletion are only known while the job runs
+	// in this process
+	TotalBytes          int64      `json:"total_bytes,omitempty"`
+	EstimatedCompletion *time.Time `json:"estimated_completion,omitempty"`
+}
+
+// newJobProgress builds a progress event, estimating completion from the
+// rate at which the upload has been consumed since the job started
+func newJobProgress(p IngestProgress, totalBytes int64, started, now time.Time) JobProgress {
+	jp := JobProgress{
+		Lines:      p.Lines,
+		Created:    p.Created,
+		Updated:    p.Updated,
+		Rejected:   p.Rejected,
+		Bytes:      p.Bytes,
+		TotalBytes: totalBytes,
+	}
+	if p.Bytes > 0 && totalBytes >= p.Bytes {
+		elapsed := now.Sub(started)
+		remaining := time.Duration(float64(elapsed) * float64(totalBytes-p.Bytes) / float64(p.Bytes))
+		eta := now.Add(remaining).UTC()
+		jp.EstimatedCompletion = &eta
+	}
+	return jp
+}
+
+// progressFromJob builds a progress event from the totals stored with a job
+func progressFromJob(job IngestJob) JobProgress {
+	return JobProgress{Lines: job.LinesProcessed, Created: job.Created, Updated: job.Updated, Rejected: job.Rejected}
+}
+
+// JobSummary is the final event of an ingest job: its IngestResponse, with
+// the error that failed the job, if any
+type JobSummary struct {
+	State JobState `json:"state"`
+	Error string   `json:"error,omitempty"`
+	IngestResponse
+}
+
+// summaryFromJob builds the final event of a job finished by another
+// process from the result stored with it
+func summaryFromJob(job IngestJob) JobSummary {
+	summary := JobSummary{State: job.State, Error: job.Error}
+	if job.Result != nil {
+		summary.IngestResponse = *job.Result
+	}
+	return summary
+}
+
+// jobEventRetention is how long the summary of a finished job stays
+// available to clients that start watching late
+const jobEventRetention = time.Minute
+
+// JobEvents fans the progress of the ingest jobs running in this process out
+// to the clients watching them. Watchers see the latest state rather than
+// every update, so a slow client cannot hold up a job. A nil *JobEvents
+// discards everything.
+type JobEvents struct {
+	mu    sync.Mutex
+	feeds map[string]*jobFeed
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewJobEvents returns an empty JobEvents
+func NewJobEvents() *JobEvents {
+	return &JobEvents{feeds: make(map[string]*jobFeed), closed: make(chan struct{})}
+}
+
+// Close ends every event stream, so that server shutdown does not wait for
+// the jobs being watched
+func (je *JobEvents) Close() {
+	je.closeOnce.Do(func() { close(je.closed) })
+}
+
+// jobFeed is the latest state of one job and the clients watching it
+type jobFeed struct {
+	snapshot jobSnapshot
+	watchers map[*JobWatch]struct{}
+}
+
+// jobSnapshot is the state of a job as seen by a watcher
+type jobSnapshot struct {
+	seq      int  // incremented by every update
+	running  bool // a job runner of this process is running the job
+	progress *JobProgress
+	summary  *JobSummary // set once the job has finished
+}
+
+// update changes the state of a job and wakes its watchers; the caller holds je.mu
+func (je *JobEvents) update(id string, fn func(*jobSnapshot)) {
+	f, ok := je.feeds[id]
+	if !ok {
+		f = &jobFeed{watchers: make(map[*JobWatch]struct{})}
+		je.feeds[id] = f
+	}
+	fn(&f.snapshot)
+	f.snapshot.seq++
+	for w := range f.watchers {
+		select {
+		case w.updates <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Start marks a job as running in this process
+func (je *JobEvents) Start(id string) {
+	if je == nil {
+		return
+	}
+	je.mu.Lock()
+	defer je.mu.Unlock()
+	je.update(id, func(s *jobSnapshot) {
+		*s = jobSnapshot{seq: s.seq, running: true}
+	})
+}
+
+// Progress publishes the running totals of a job
+func (je *JobEvents) Progress(id string, p JobProgress) {
+	if je == nil {
+		return
+	}
+	je.mu.Lock()
+	defer je.mu.Unlock()
+	je.update(id, func(s *jobSnapshot) {
+		s.progress = &p
+	})
+}
+
+// Finish publishes the summary of a job and forgets the job once late
+// watchers have had jobEventRetention to pick it up
+func (je *JobEvents) Finish(id string, summary JobSummary) {
+	if je == nil {
+		return
+	}
+	je.mu.Lock()
+	defer je.mu.Unlock()
+	je.update(id, func(s *jobSnapshot) {
+		s.running, s.summary = false, &summary
+	})
+
+	f := je.feeds[id]
+	time.AfterFunc(jobEventRetention, func() {
+		je.mu.Lock()
+		defer je.mu.Unlock()
+		if je.feeds[id] == f {
+			delete(je.feeds, id)
+		}
+	})
+}
+
+// Abandon marks a job as no longer running in this process without a
+// summary, e.g. at shutdown; watchers go back to following the store
+func (je *JobEvents) Abandon(id string) {
+	if je == nil {
+		return
+	}
+	je.mu.Lock()
+	defer je.mu.Unlock()
+	je.update(id, func(s *jobSnapshot) {
+		s.running = false
+	})
+	je.release(id)
+}
+
+// release forgets a job nobody is running or watching; the caller holds je.mu
+func (je *JobEvents) release(id string) {
+	f, ok := je.feeds[id]
+	if ok && !f.snapshot.running && f.snapshot.summary == nil && len(f.watchers) == 0 {
+		delete(je.feeds, id)
+	}
+}
+
+// JobWatch follows the events of one job for one client
+type JobWatch struct {
+	events  *JobEvents
+	id      string
+	updates chan struct{}
+	closed  <-chan struct{} // closed when the stream must end
+}
+
+// Watch starts following a job, whether or not it has started yet. The
+// watch must be closed when the client goes away.
+func (je *JobEvents) Watch(id string) *JobWatch {
+	w := &JobWatch{events: je, id: id, updates: make(chan struct{}, 1)}
+	if je == nil {
+		return w
+	}
+	w.closed = je.closed
+	je.mu.Lock()
+	defer je.mu.Unlock()
+	f, ok := je.feeds[id]
+	if !ok {
+		f = &jobFeed{watchers: make(map[*JobWatch]struct{})}
+		je.feeds[id] = f
+	}
+	f.watchers[w] = struct{}{}
+	return w
+}
+
+// latest returns the current state of the job
+func (w *JobWatch) latest() jobSnapshot {
+	if w.events == nil {
+		return jobSnapshot{}
+	}
+	w.events.mu.Lock()
+	defer w.events.mu.Unlock()
+	if f, ok := w.events.feeds[w.id]; ok {
+		return f.snapshot
+	}
+	return jobSnapshot{}
+}
+
+// Close stops following the job
+func (w *JobWatch) Close() {
+	if w.events == nil {
+		return
+	}
+	w.events.mu.Lock()
+	defer w.events.mu.Unlock()
+	if f, ok := w.events.feeds[w.id]; ok {
+		delete(f.watchers, w)
+		w.events.release(w.id)
+	}
+}
+
+// jobEventsKeepAlive is how often a comment is sent on an otherwise idle
+// event stream, so that proxies do not close it
+const jobEventsKeepAlive = 15 * time.Second
+
+// handleJobEvents streams the progress of an async ingest job as
+// Server-Sent Events: "progress" events with the running totals while the
+// job is queued or running, then a single "summary" event with the final
+// IngestResponse, after which the stream ends. Jobs running in this process
+// are followed live; others through the totals they store every
+// jobProgressInterval.
+func (s *Server) handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	ctx, id := r.Context(), r.PathValue("id")
+	job, err := s.store.GetJob(ctx, id)
+	if err != nil {
+		writeJSONError(w, "Ingest job not found", statusForError(err))
+		return
+	}
+
+	// The stream lasts as long as the job, well past the server write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("job %s events: clearing write deadline failed: %v", id, err)
+	}
+
+	watch := s.cfg.JobEvents.Watch(id)
+	defer watch.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	poll := time.NewTicker(jobProgressInterval)
+	defer poll.Stop()
+
+	var (
+		seq       = -1 // of the last snapshot sent
+		sent      *JobProgress
+		lastWrite = time.Now()
+	)
+	send := func(event string, data any) bool {
+		if err := writeEvent(w, event, data); err != nil {
+			return false
+		}
+		lastWrite = time.Now()
+		return rc.Flush() == nil
+	}
+
+	for {
+		snap := watch.latest()
+		switch {
+		case snap.summary != nil:
+			send("summary", snap.summary)
+			return
+		case snap.running:
+			if snap.seq != seq && snap.progress != nil {
+				if !send("progress", snap.progress) {
+					return
+				}
+				seq = snap.seq
+			}
+		case job.State == JobSucceeded || job.State == JobFailed:
+			send("summary", summaryFromJob(job))
+			return
+		default:
+			// Queued, or running in another process
+			if p := progressFromJob(job); sent == nil || p != *sent {
+				if !send("progress", p) {
+					return
+				}
+				sent = &p
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-watch.closed:
+			return
+		case <-watch.updates:
+		case <-poll.C:
+			if !snap.running {
+				if job, err = s.store.GetJob(ctx, id); err != nil {
+					if ctx.Err() == nil {
+						log.Printf("job %s events: %v", id, err)
+					}
+					return
+				}
+			}
+			if time.Since(lastWrite) >= jobEventsKeepAlive {
+				if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil || rc.Flush() != nil {
+					return
+				}
+				lastWrite = time.Now()
+			}
+		}
+	}
+}
+
+// writeEvent writes one Server-Sent Event with a JSON payload
+func writeEvent(w io.Writer, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("encode %s event: %w", event, err)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
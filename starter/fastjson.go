@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxInterned bounds the strings a PurchaseDecoder keeps for reuse, so
+// that a feed of ever-new values cannot grow it without limit
+const maxInterned = 4096
+
+// PurchaseDecoder decodes JSON records into PurchaseInput without
+// reflection. Records in the usual shape are decoded with one allocation
+// for the string fields, and the values of enumerated fields such as
+// platform and currency are shared between records. Anything unusual,
+// such as escaped strings, is left to encoding/json, so the result is
+// always that of json.Unmarshal. A PurchaseDecoder is not safe for
+// concurrent use.
+type PurchaseDecoder struct {
+	interned map[string]string
+
+	data []byte
+	pos  int
+	line string // data as a string, made once the first field needs it
+}
+
+// NewPurchaseDecoder returns an empty PurchaseDecoder
+func NewPurchaseDecoder() *PurchaseDecoder {
+	return &PurchaseDecoder{interned: make(map[string]string)}
+}
+
+// Decode decodes data into in, like json.Unmarshal
+func (d *PurchaseDecoder) Decode(data []byte, in *PurchaseInput) error {
+	if d.TryDecode(data, in) {
+		return nil
+	}
+	*in = PurchaseInput{}
+	return json.Unmarshal(data, in)
+}
+
+// TryDecode decodes data into in if it can do so without encoding/json.
+// It returns false, with in partly set, for records it leaves to Decode:
+// invalid JSON, values of the wrong type, escaped strings, nested unknown
+// fields and field names that differ from the schema in case only.
+func (d *PurchaseDecoder) TryDecode(data []byte, in *PurchaseInput) bool {
+	*in = PurchaseInput{}
+	d.data, d.pos, d.line = data, 0, ""
+	defer func() { d.data, d.line = nil, "" }()
+
+	d.skipSpace()
+	if !d.consume('{') {
+		return false
+	}
+	d.skipSpace()
+	if d.consume('}') {
+		return d.end()
+	}
+
+	for {
+		d.skipSpace()
+		key, ok := d.rawString()
+		if !ok {
+			return false
+		}
+		d.skipSpace()
+		if !d.consume(':') {
+			return false
+		}
+		d.skipSpace()
+		if !d.field(key, in) {
+			return false
+		}
+
+		d.skipSpace()
+		switch {
+		case d.consume(','):
+		case d.consume('}'):
+			return d.end()
+		default:
+			return false
+		}
+	}
+}
+
+// field decodes the value of one field
+func (d *PurchaseDecoder) field(key []byte, in *PurchaseInput) bool {
+	switch string(key) {
+	case "transaction_id":
+		return d.stringValue(&in.TransactionID, false)
+	case "player_id":
+		return d.stringValue(&in.PlayerID, false)
+	case "player_username":
+		return d.stringValue(&in.PlayerUsername, false)
+	case "game_title":
+		return d.stringValue(&in.GameTitle, false)
+	case "item_type":
+		return d.stringValue(&in.ItemType, true)
+	case "genre":
+		return d.stringValue(&in.Genre, true)
+	case "platform":
+		return d.stringValue(&in.Platform, true)
+	case "amount_cents":
+		return d.intValue(&in.AmountCents)
+	case "currency":
+		return d.stringValue(&in.Currency, true)
+	case "player_level":
+		return d.intValue(&in.PlayerLevel)
+	case "created_at":
+		return d.timestampValue(&in.CreatedAt)
+	case "event_type":
+		return d.stringValue(&in.EventType, true)
+	}
+
+	// encoding/json matches field names case-insensitively
+	for _, name := range purchaseInputFields {
+		if strings.EqualFold(name, string(key)) {
+			return false
+		}
+	}
+	return d.skipScalar()
+}
+
+// purchaseInputFields are the JSON names of the PurchaseInput fields
+var purchaseInputFields = []string{
+	"transaction_id", "player_id", "player_username", "game_title", "item_type", "genre",
+	"platform", "amount_cents", "currency", "player_level", "created_at", "event_type",
+}
+
+// end reports whether only whitespace follows the record
+func (d *PurchaseDecoder) end() bool {
+	d.skipSpace()
+	return d.pos == len(d.data)
+}
+
+func (d *PurchaseDecoder) skipSpace() {
+	for d.pos < len(d.data) {
+		switch d.data[d.pos] {
+		case ' ', '\t', '\n', '\r':
+			d.pos++
+		default:
+			return
+		}
+	}
+}
+
+// consume skips c if it is the next byte
+func (d *PurchaseDecoder) consume(c byte) bool {
+	if d.pos < len(d.data) && d.data[d.pos] == c {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+// literal skips word if it comes next
+func (d *PurchaseDecoder) literal(word string) bool {
+	if len(d.data)-d.pos < len(word) {
+		return false
+	}
+	for i := 0; i < len(word); i++ {
+		if d.data[d.pos+i] != word[i] {
+			return false
+		}
+	}
+	d.pos += len(word)
+	return true
+}
+
+// rawString reads a string without escapes and returns its contents, which
+// are valid UTF-8 without control characters
+func (d *PurchaseDecoder) rawString() ([]byte, bool) {
+	if !d.consume('"') {
+		return nil, false
+	}
+	start := d.pos
+	ascii := true
+	for ; d.pos < len(d.data); d.pos++ {
+		switch c := d.data[d.pos]; {
+		case c == '"':
+			s := d.data[start:d.pos]
+			d.pos++
+			if !ascii && !utf8.Valid(s) {
+				return nil, false
+			}
+			return s, true
+		case c == '\\' || c < 0x20:
+			return nil, false
+		case c >= utf8.RuneSelf:
+			ascii = false
+		}
+	}
+	return nil, false
+}
+
+// str returns the contents of the string just read, s
+func (d *PurchaseDecoder) str(s []byte) string {
+	end := d.pos - 1 // s ends just before the closing quote
+	return d.substr(end-len(s), end)
+}
+
+// substr returns d.data[start:end] as a string, sharing one allocation for
+// all the strings of the record
+func (d *PurchaseDecoder) substr(start, end int) string {
+	if d.line == "" {
+		d.line = string(d.data)
+	}
+	return d.line[start:end]
+}
+
+// intern returns a shared copy of a string value
+func (d *PurchaseDecoder) intern(s []byte) string {
+	if v, ok := d.interned[string(s)]; ok {
+		return v
+	}
+	if len(d.interned) >= maxInterned {
+		return d.str(s)
+	}
+	v := string(s)
+	d.interned[v] = v
+	return v
+}
+
+// stringValue decodes a string field; null leaves it unchanged, as it
+// does with encoding/json
+func (d *PurchaseDecoder) stringValue(dst *string, intern bool) bool {
+	if d.literal("null") {
+		return true
+	}
+	s, ok := d.rawString()
+	if !ok {
+		return false
+	}
+	if intern {
+		*dst = d.intern(s)
+	} else {
+		*dst = d.str(s)
+	}
+	return true
+}
+
+// maxIntDigits is the most digits parsed without checking for overflow
+const maxIntDigits = 18
+
+// intValue decodes an integer field; null leaves it unchanged
+func (d *PurchaseDecoder) intValue(dst *int) bool {
+	if d.literal("null") {
+		return true
+	}
+	start := d.pos
+	if !d.number() {
+		return false
+	}
+	lit := d.data[start:d.pos]
+
+	neg := lit[0] == '-'
+	if neg {
+		lit = lit[1:]
+	}
+	if len(lit) > maxIntDigits {
+		return false
+	}
+	n := 0
+	for _, c := range lit {
+		if c < '0' || c > '9' {
+			return false // a fraction or exponent, which encoding/json rejects
+		}
+		n = n*10 + int(c-'0')
+	}
+	if neg {
+		n = -n
+	}
+	*dst = n
+	return true
+}
+
+// timestampValue decodes created_at, which may be a string or a number;
+// null clears it, as Timestamp.UnmarshalJSON does
+func (d *PurchaseDecoder) timestampValue(dst *Timestamp) bool {
+	switch {
+	case d.literal("null"):
+		*dst = ""
+		return true
+	case d.pos < len(d.data) && d.data[d.pos] == '"':
+		s, ok := d.rawString()
+		if !ok {
+			return false
+		}
+		*dst = Timestamp(d.str(s))
+		return true
+	}
+
+	start := d.pos
+	if !d.number() {
+		return false
+	}
+	*dst = Timestamp(d.substr(start, d.pos))
+	return true
+}
+
+// number skips a JSON number
+func (d *PurchaseDecoder) number() bool {
+	d.consume('-')
+	switch {
+	case d.consume('0'):
+	case d.digits() == 0:
+		return false
+	}
+	if d.consume('.') && d.digits() == 0 {
+		return false
+	}
+	if d.consume('e') || d.consume('E') {
+		if !d.consume('+') {
+			d.consume('-')
+		}
+		if d.digits() == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// digits skips a run of decimal digits and returns its length
+func (d *PurchaseDecoder) digits() int {
+	start := d.pos
+	for d.pos < len(d.data) && d.data[d.pos] >= '0' && d.data[d.pos] <= '9' {
+		d.pos++
+	}
+	return d.pos - start
+}
+
+// skipScalar skips the value of an unknown field if it is a string,
+// number, true, false or null
+func (d *PurchaseDecoder) skipScalar() bool {
+	if d.pos >= len(d.data) {
+		return false
+	}
+	switch d.data[d.pos] {
+	case '"':
+		_, ok := d.rawString()
+		return ok
+	case 't':
+		return d.literal("true")
+	case 'f':
+		return d.literal("false")
+	case 'n':
+		return d.literal("null")
+	default:
+		return d.number()
+	}
+}
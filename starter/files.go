@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+)
+
+// DuplicateFilePolicy decides what happens when a file that was already
+// ingested is uploaded again
+type DuplicateFilePolicy string
+
+const (
+	// DuplicateFilesWarn ingests the file and reports the original ingest
+	DuplicateFilesWarn DuplicateFilePolicy = "warn"
+
+	// DuplicateFilesRefuse rejects the upload with 409 and the original ingest
+	DuplicateFilesRefuse DuplicateFilePolicy = "refuse"
+)
+
+// ErrDuplicateFile is returned by an ingest refusing a file that was
+// ingested before
+var ErrDuplicateFile = errors.New("file was already ingested")
+
+// ParseDuplicateFilePolicy validates a policy name; empty selects DuplicateFilesWarn
+func ParseDuplicateFilePolicy(s string) (DuplicateFilePolicy, error) {
+	switch p := DuplicateFilePolicy(s); p {
+	case "":
+		return DuplicateFilesWarn, nil
+	case DuplicateFilesWarn, DuplicateFilesRefuse:
+		return p, nil
+	default:
+		return "", fmt.Errorf("%w: unknown duplicate file policy %q", ErrBadInput, s)
+	}
+}
+
+// IngestFile is an entry of the ingest_files ledger: the first successful
+// ingest of a file, identified by the hash of its decompressed contents, so
+// a file is recognised whether or not it is gzipped
+type IngestFile struct {
+	Hash       string    `json:"hash"`
+	Size       int64     `json:"size"`
+	Lines      int       `json:"lines"`
+	FileName   string    `json:"file_name,omitempty"`
+	Uploader   string    `json:"uploader,omitempty"`
+	IngestID   string    `json:"ingest_id"`
+	IngestedAt time.Time `json:"ingested_at"`
+}
+
+// FileStore keeps the ledger of ingested files
+type FileStore interface {
+	// FindIngestFile returns the ingest of a file hash, or ErrNotFound
+	FindIngestFile(ctx context.Context, hash string) (IngestFile, error)
+
+	// RecordIngestFile adds f to the ledger. If the same hash was ingested
+	// before, f is left out and the earlier entry is returned with duplicate set.
+	RecordIngestFile(ctx context.Context, f IngestFile) (original IngestFile, duplicate bool, err error)
+}
+
+// hashingReader hashes and counts the bytes read through it
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, h: sha256.New()}
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	hr.n += int64(n)
+	return n, err
+}
+
+// openUpload decodes an upload like decodeUpload, hashing its decompressed
+// contents as they are read; raw counts the bytes of the upload itself
+func openUpload(r io.Reader, contentEncoding string, maxRatio float64) (raw *countingReader, contents *hashingReader, err error) {
+	raw = &countingReader{r: r}
+	decoded, err := decodeUpload(raw, contentEncoding, maxRatio)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, newHashingReader(decoded), nil
+}
+
+// hashFile returns the hash of the decompressed contents of a seekable
+// upload, as kept in the ingest_files ledger, and rewinds it
+func hashFile(f io.ReadSeeker, contentEncoding string, maxRatio float64) (string, error) {
+	_, contents, err := openUpload(f, contentEncoding, maxRatio)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(io.Discard, contents); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return contents.sum(), nil
+}
+
+// sum returns the hash in the "sha256:<hex>" form also used by hashUpload
+func (hr *hashingReader) sum() string {
+	return "sha256:" + hex.EncodeToString(hr.h.Sum(nil))
+}
+
+const ingestFileColumns = `
+	hash, size, line_count, file_name, uploader, ingest_id, ingested_at`
+
+// scanIngestFile reads a row selected with ingestFileColumns
+func scanIngestFile(row interface{ Scan(...any) error }) (IngestFile, error) {
+	var f IngestFile
+	err := row.Scan(&f.Hash, &f.Size, &f.Lines, &f.FileName, &f.Uploader, &f.IngestID, &f.IngestedAt)
+	return f, err
+}
+
+// FindIngestFile implements FileStore.FindIngestFile
+func (s *pgStore) FindIngestFile(ctx context.Context, hash string) (IngestFile, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	f, err := scanIngestFile(s.db.QueryRowContext(ctx, `
+		SELECT`+ingestFileColumns+`
+		FROM ingest_files
+		WHERE hash = $1`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return IngestFile{}, ErrNotFound
+	}
+	if err != nil {
+		return IngestFile{}, fmt.Errorf("find ingest file %s: %w", hash, err)
+	}
+	return f, nil
+}
+
+// RecordIngestFile implements FileStore.RecordIngestFile
+func (s *pgStore) RecordIngestFile(ctx context.Context, f IngestFile) (IngestFile, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	// The unique hash decides between concurrent ingests of the same file
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO ingest_files (hash, size, line_count, file_name, uploader, ingest_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (hash) DO NOTHING`, f.Hash, f.Size, f.Lines, f.FileName, f.Uploader, f.IngestID)
+	if err != nil {
+		return IngestFile{}, false, fmt.Errorf("record ingest file %s: %w", f.Hash, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 1 {
+		return IngestFile{}, false, nil
+	}
+
+	original, err := scanIngestFile(s.db.QueryRowContext(ctx, `
+		SELECT`+ingestFileColumns+`
+		FROM ingest_files
+		WHERE hash = $1`, f.Hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		// Rolled back in the meantime
+		return IngestFile{}, false, fmt.Errorf("ingest file %s vanished while recording it", f.Hash)
+	}
+	if err != nil {
+		return IngestFile{}, false, fmt.Errorf("get ingest file %s: %w", f.Hash, err)
+	}
+	return original, true, nil
+}
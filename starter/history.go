@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PurchaseRevision is the image of a purchase as it was before an update
+type PurchaseRevision struct {
+	ID            int64        `json:"id"`
+	IngestID      string       `json:"ingest_id,omitempty"`     // ingest that made the update
+	IngestSource  IngestSource `json:"ingest_source,omitempty"` // channel of that ingest
+	SourceFile    string       `json:"source_file,omitempty"`   // file holding the new version, if any
+	Line          int          `json:"line,omitempty"`          // line of that ingest holding the new version
+	ChangedFields []string     `json:"changed_fields"`
+	Previous      Purchase     `json:"previous"`
+	RevisedAt     time.Time    `json:"revised_at"`
+}
+
+// HistoryStore reads the revision history of purchases
+type HistoryStore interface {
+	// PurchaseHistory returns the current purchase and its revisions, oldest
+	// first. Returns ErrNotFound if the purchase does not exist.
+	PurchaseHistory(ctx context.Context, transactionID string) (Purchase, []PurchaseRevision, error)
+}
+
+// revisionFields are the ingested columns compared when recording a revision
+var revisionFields = []string{
+	"player_id", "player_username", "game_title", "item_type", "genre",
+	"platform", "amount_cents", "currency", "player_level", "created_at",
+}
+
+// changedFieldsSQL builds an expression listing the revisionFields that
+// differ between the row aliases cur and prev
+func changedFieldsSQL(cur, prev string) string {
+	cases := make([]string, len(revisionFields))
+	for i, f := range revisionFields {
+		cases[i] = fmt.Sprintf("CASE WHEN %s.%s IS DISTINCT FROM %s.%s THEN '%s' END", cur, f, prev, f, f)
+	}
+	return "array_remove(ARRAY[" + strings.Join(cases, ", ") + "]::text[], NULL)"
+}
+
+// distinctFieldsSQL builds a condition that holds when any of the
+// revisionFields differs between the row aliases a and b
+func distinctFieldsSQL(a, b string) string {
+	as, bs := make([]string, len(revisionFields)), make([]string, len(revisionFields))
+	for i, f := range revisionFields {
+		as[i], bs[i] = a+"."+f, b+"."+f
+	}
+	return "(" + strings.Join(as, ", ") + ") IS DISTINCT FROM (" + strings.Join(bs, ", ") + ")"
+}
+
+// insertRevisionSQL starts the INSERT that records the prior image of updated purchases
+const insertRevisionSQL = `
+	INSERT INTO purchase_revisions (purchase_id, transaction_id, ingest_id, line_number, changed_fields, previous,
+		ingest_source, source_file)`
+
+// PurchaseHistory implements HistoryStore.PurchaseHistory
+func (s *pgStore) PurchaseHistory(ctx context.Context, transactionID string) (Purchase, []PurchaseRevision, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	current, err := s.getPurchase(ctx, transactionID)
+	if err != nil {
+		return Purchase{}, nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, COALESCE(ingest_id, ''), COALESCE(ingest_source, ''), COALESCE(source_file, ''),
+			COALESCE(line_number, 0), changed_fields, previous, revised_at
+		FROM purchase_revisions
+		WHERE transaction_id = $1
+		ORDER BY id`, transactionID)
+	if err != nil {
+		return Purchase{}, nil, fmt.Errorf("query revisions of %s: %w", transactionID, err)
+	}
+	defer rows.Close()
+
+	revisions := []PurchaseRevision{}
+	for rows.Next() {
+		var (
+			rev      PurchaseRevision
+			previous []byte
+		)
+		err := rows.Scan(&rev.ID, &rev.IngestID, &rev.IngestSource, &rev.SourceFile,
+			&rev.Line, pq.Array(&rev.ChangedFields), &previous, &rev.RevisedAt)
+		if err != nil {
+			return Purchase{}, nil, fmt.Errorf("scan revision: %w", err)
+		}
+		// The row image is stored with to_jsonb, whose keys match the Purchase JSON tags
+		if err := json.Unmarshal(previous, &rev.Previous); err != nil {
+			return Purchase{}, nil, fmt.Errorf("decode revision %d: %w", rev.ID, err)
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return Purchase{}, nil, fmt.Errorf("iterate revisions: %w", err)
+	}
+
+	return current, revisions, nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyRecord is the outcome stored under an Idempotency-Key
+type IdempotencyRecord struct {
+	Key        string
+	BodyHash   string
+	Completed  bool   // false while the first request is still running
+	StatusCode int    // response status, once completed
+	Location   string // Location header of the response, if any
+	Response   []byte // JSON response body, once completed
+	ExpiresAt  time.Time
+}
+
+// IdempotencyStore remembers the responses of requests sent with an Idempotency-Key
+type IdempotencyStore interface {
+	// ClaimIdempotencyKey reserves an unused or expired key for a request
+	// whose body hashes to bodyHash, keeping it for retention. A key still
+	// in progress is taken over by the same request once it has not been
+	// renewed for lease, as its first request must have died. If the key is
+	// held by another request, its record is returned with claimed false.
+	ClaimIdempotencyKey(ctx context.Context, key, bodyHash string, retention, lease time.Duration) (rec IdempotencyRecord, claimed bool, err error)
+
+	// RenewIdempotencyKey keeps a claimed key from being taken over while its
+	// request is still running
+	RenewIdempotencyKey(ctx context.Context, key string) error
+
+	// CompleteIdempotencyKey stores the final response of a claimed key
+	CompleteIdempotencyKey(ctx context.Context, key string, status int, location string, response []byte) error
+
+	// ReleaseIdempotencyKey forgets a claimed key whose request failed on
+	// the server side, so that a retry runs it again
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+
+	// PurgeIdempotencyKeys deletes expired keys and returns how many were removed
+	PurgeIdempotencyKeys(ctx context.Context) (int64, error)
+}
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// defaultIdempotencyLease is how long a request holds its Idempotency-Key
+// without renewing it when ServerConfig.IdempotencyLease is unset
+const defaultIdempotencyLease = time.Minute
+
+// withIdempotencyKey runs an ingest handler at most once per Idempotency-Key.
+// A replay with the same key and upload gets the stored response back; a
+// replay with a different upload, or while the first request is still
+// running, gets 409. Server errors and panics are not stored, so they can be
+// retried; the key of a request that died with its process is taken over by
+// a retry once its lease runs out.
+func (s *Server) withIdempotencyKey(w http.ResponseWriter, r *http.Request, key string, next http.HandlerFunc) {
+	if len(key) > maxIdempotencyKeyLength {
+		writeJSONError(w, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength), http.StatusBadRequest)
+		return
+	}
+
+	bodyHash, err := ingestRequestHash(r)
+	if err != nil {
+		writeJSONError(w, "Missing or invalid file", http.StatusBadRequest)
+		return
+	}
+
+	lease := s.cfg.IdempotencyLease
+	if lease <= 0 {
+		lease = defaultIdempotencyLease
+	}
+	rec, claimed, err := s.store.ClaimIdempotencyKey(r.Context(), key, bodyHash, s.cfg.IdempotencyRetention, lease)
+	if err != nil {
+		log.Printf("claim idempotency key %q failed: %v", key, err)
+		writeJSONError(w, "Failed to check Idempotency-Key", http.StatusInternalServerError)
+		return
+	}
+
+	if !claimed {
+		switch {
+		case rec.BodyHash != bodyHash:
+			writeJSONError(w, "Idempotency-Key was already used with a different request", http.StatusConflict)
+		case !rec.Completed:
+			writeJSONError(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+		default:
+			if rec.Location != "" {
+				w.Header().Set("Location", rec.Location)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(rec.StatusCode)
+			w.Write(rec.Response)
+		}
+		return
+	}
+
+	// The client may be gone, but the outcome must still be recorded. Unless
+	// a response is stored, the key is released, even when next panics.
+	ctx := context.WithoutCancel(r.Context())
+	completed := false
+	defer func() {
+		if completed {
+			return
+		}
+		if err := s.store.ReleaseIdempotencyKey(ctx, key); err != nil {
+			log.Printf("release idempotency key %q failed: %v", key, err)
+		}
+	}()
+	stop := s.renewIdempotencyKey(ctx, key, lease)
+	defer stop()
+
+	rw := &recordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	next(rw, r)
+	stop()
+
+	if rw.status >= http.StatusInternalServerError {
+		return
+	}
+	if err := s.store.CompleteIdempotencyKey(ctx, key, rw.status, w.Header().Get("Location"), rw.body.Bytes()); err != nil {
+		log.Printf("store response for idempotency key %q failed: %v", key, err)
+		return
+	}
+	completed = true
+}
+
+// renewIdempotencyKey renews a claimed key every third of its lease until
+// the returned function is first called
+func (s *Server) renewIdempotencyKey(ctx context.Context, key string, lease time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := s.store.RenewIdempotencyKey(ctx, key); err != nil {
+				log.Printf("renew idempotency key %q failed: %v", key, err)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+// ingestRequestHash identifies an ingest request by its uploaded file and the
+// parameters that affect its outcome. The raw multipart body is not used, as
+// its boundary differs between otherwise identical retries.
+func ingestRequestHash(r *http.Request) (string, error) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", r.URL.Query().Encode(), r.Header.Get("Upload-ID"), header.Header.Get("Content-Encoding"))
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordingResponseWriter passes a response through while keeping a copy of it
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingResponseWriter) WriteHeader(code int) {
+	rw.status = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingResponseWriter) Write(p []byte) (int, error) {
+	rw.body.Write(p)
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// ClaimIdempotencyKey implements IdempotencyStore.ClaimIdempotencyKey
+func (s *pgStore) ClaimIdempotencyKey(ctx context.Context, key, bodyHash string, retention, lease time.Duration) (IdempotencyRecord, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO ingest_idempotency_keys (key, body_hash, claimed_at, expires_at)
+		VALUES ($1, $2, NOW(), NOW() + $3 * INTERVAL '1 second')
+		ON CONFLICT (key) DO UPDATE SET
+			body_hash   = EXCLUDED.body_hash,
+			status_code = NULL,
+			location    = NULL,
+			response    = NULL,
+			created_at  = NOW(),
+			claimed_at  = NOW(),
+			expires_at  = EXCLUDED.expires_at
+		WHERE ingest_idempotency_keys.expires_at <= NOW()
+			OR (ingest_idempotency_keys.status_code IS NULL
+				AND ingest_idempotency_keys.body_hash = EXCLUDED.body_hash
+				AND ingest_idempotency_keys.claimed_at <= NOW() - $4 * INTERVAL '1 second')`,
+		key, bodyHash, retention.Seconds(), lease.Seconds())
+	if err != nil {
+		return IdempotencyRecord{}, false, fmt.Errorf("claim idempotency key: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 1 {
+		return IdempotencyRecord{Key: key, BodyHash: bodyHash}, true, nil
+	}
+
+	rec := IdempotencyRecord{Key: key}
+	var (
+		status   sql.NullInt64
+		location sql.NullString
+	)
+	err = s.db.QueryRowContext(ctx, `
+		SELECT body_hash, status_code, location, response, expires_at
+		FROM ingest_idempotency_keys
+		WHERE key = $1`, key).Scan(&rec.BodyHash, &status, &location, &rec.Response, &rec.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Released or purged in the meantime
+		return IdempotencyRecord{}, false, fmt.Errorf("idempotency key %q vanished while claiming it", key)
+	}
+	if err != nil {
+		return IdempotencyRecord{}, false, fmt.Errorf("get idempotency key: %w", err)
+	}
+	rec.Completed = status.Valid
+	rec.StatusCode = int(status.Int64)
+	rec.Location = location.String
+	return rec, false, nil
+}
+
+// RenewIdempotencyKey implements IdempotencyStore.RenewIdempotencyKey
+func (s *pgStore) RenewIdempotencyKey(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE ingest_idempotency_keys SET claimed_at = NOW() WHERE key = $1 AND status_code IS NULL`, key)
+	if err != nil {
+		return fmt.Errorf("renew idempotency key: %w", err)
+	}
+	return nil
+}
+
+// CompleteIdempotencyKey implements IdempotencyStore.CompleteIdempotencyKey
+func (s *pgStore) CompleteIdempotencyKey(ctx context.Context, key string, status int, location string, response []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE ingest_idempotency_keys
+		SET status_code = $2, location = NULLIF($3, ''), response = $4
+		WHERE key = $1 AND status_code IS NULL`, key, status, location, response)
+	if err != nil {
+		return fmt.Errorf("complete idempotency key: %w", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey implements IdempotencyStore.ReleaseIdempotencyKey
+func (s *pgStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		`DELETE FROM ingest_idempotency_keys WHERE key = $1 AND status_code IS NULL`, key)
+	if err != nil {
+		return fmt.Errorf("release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// PurgeIdempotencyKeys implements IdempotencyStore.PurgeIdempotencyKeys
+func (s *pgStore) PurgeIdempotencyKeys(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM ingest_idempotency_keys WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("purge idempotency keys: %w", err)
+	}
+	return res.RowsAffected()
+}
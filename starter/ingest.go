@@ -3,25 +3,823 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"strings"
+	"sync"
+	"time"
 )
 
+// LineError describes a single NDJSON line that could not be turned into a purchase
+type LineError struct {
+	Line   int    `json:"line"`   // 1-based line number
+	Offset int64  `json:"offset"` // byte offset of the start of the line
+	Raw    string `json:"raw"`
+	Field  string `json:"field,omitempty"` // the field at fault, when known
+	Reason string `json:"reason"`
+	Err    error  `json:"-"`
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d (offset %d): %s", e.Line, e.Offset, e.Reason)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// Record is a decoded event together with its position in the input
+type Record struct {
+	Line     int
+	Offset   int64
+	Purchase Purchase
+	Refund   *Refund // set instead of Purchase for refund and chargeback events
+	Version  int     // the schema_version the record was sent with
+}
+
+// StreamOptions controls how StreamNDJSONWithOptions treats its input
+type StreamOptions struct {
+	// Reject, when set, enables lenient mode: invalid lines are passed to
+	// Reject and skipped instead of aborting the stream.
+	Reject func(LineError) error
 
-// StreamNDJSON parses newline-delimited JSON and calls fn for each purchase
+	// SkipLines is the number of leading lines to pass over without decoding,
+	// used to resume an upload after its last committed line
+	SkipLines int
+
+	// Timestamps parses created_at values; nil uses the defaults
+	Timestamps *TimestampParser
+
+	// Schema selects the records checked for unknown and absent fields.
+	// Only decoders that can tell absent fields apart support this.
+	Schema SchemaPolicy
+
+	// Decoders is the number of goroutines decoding and validating JSON
+	// records while the next ones are read; fn and Reject are still called
+	// one at a time, in file order. 0 or 1 decodes on the calling goroutine.
+	Decoders int
+
+	// MaxLineBytes fails the stream with a *LimitError at the first line
+	// longer than this, for decoders reading one record per line, and
+	// MaxRecords at the record after the first MaxRecords past SkipLines.
+	// Both apply in lenient mode too; 0 means no limit.
+	MaxLineBytes int
+	MaxRecords   int
+}
+
+// StreamNDJSON parses newline-delimited JSON and calls fn for each purchase.
+// Refund and chargeback events are not purchases; like invalid lines, they
+// fail the stream with a *LineError wrapping ErrBadInput.
 func StreamNDJSON(ctx context.Context, r io.Reader, fn func(Purchase) error) error {
-	// TODO: Implement this.
-	
+	return StreamNDJSONWithOptions(ctx, r, StreamOptions{}, func(rec Record) error {
+		if rec.Refund != nil {
+			err := fmt.Errorf("%w: %s events are not purchases", ErrBadInput, rec.Refund.EventType)
+			return &LineError{Line: rec.Line, Offset: rec.Offset, Field: "event_type", Reason: err.Error(), Err: err}
+		}
+		return fn(rec.Purchase)
+	})
+}
+
+// StreamNDJSONWithOptions parses newline-delimited JSON one line at a time and
+// calls fn for each valid event. Blank lines are skipped.
+func StreamNDJSONWithOptions(ctx context.Context, r io.Reader, opts StreamOptions, fn func(Record) error) error {
+	return StreamRecords(ctx, NewNDJSONDecoder(r), opts, fn)
+}
+
+// StreamRecords reads records from dec, validates them and calls fn for
+// each valid event, in file order
+func StreamRecords(ctx context.Context, dec Decoder, opts StreamOptions, fn func(Record) error) error {
+	if s, ok := dec.(lineSkipper); ok && opts.SkipLines > 0 {
+		s.skipLines(opts.SkipLines)
+	}
+	if l, ok := dec.(lineLimiter); ok && opts.MaxLineBytes > 0 {
+		l.limitLines(opts.MaxLineBytes)
+	}
+	if rr, ok := dec.(rawJSONReader); ok && opts.Decoders > 1 {
+		return streamParallel(ctx, rr, opts, fn)
+	}
+
+	records := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		raw, err := dec.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if raw.Line <= opts.SkipLines {
+			continue
+		}
+		if err := countRecord(&records, raw, opts); err != nil {
+			return err
+		}
+
+		var strict func() error
+		if c, ok := dec.(strictChecker); ok {
+			strict = func() error { return c.checkStrict(raw) }
+		}
+		rec, err := validateRecord(raw, opts, strict)
+		if err := deliver(raw, rec, err, opts, fn); err != nil {
+			return err
+		}
+	}
+}
+
+// validateRecord checks a decoded record, in strict mode with strict if the
+// decoder supports it, and converts it by event type
+func validateRecord(raw RawRecord, opts StreamOptions, strict func() error) (Record, error) {
+	if raw.Err != nil {
+		return Record{}, raw.Err
+	}
+	if strict != nil && opts.Schema.strict(raw.Input.Platform) {
+		if err := strict(); err != nil {
+			return Record{}, err
+		}
+	}
+
+	rec, err := recordFromInput(raw.Input, opts.Timestamps)
+	rec.Line, rec.Offset, rec.Version = raw.Line, raw.Offset, raw.Version
+	return rec, err
+}
+
+// countRecord counts a record read past opts.SkipLines and fails once there
+// are more than opts.MaxRecords
+func countRecord(n *int, raw RawRecord, opts StreamOptions) error {
+	if raw.Line <= opts.SkipLines {
+		return nil
+	}
+	*n++
+	if opts.MaxRecords > 0 && *n > opts.MaxRecords {
+		return &LimitError{Limit: "max_records", Max: int64(opts.MaxRecords), Line: raw.Line, Offset: raw.Offset}
+	}
 	return nil
 }
 
+// deliver passes a validated record to fn, or its error to opts.Reject.
+// Lines up to opts.SkipLines are passed over.
+func deliver(raw RawRecord, rec Record, err error, opts StreamOptions, fn func(Record) error) error {
+	if raw.Line <= opts.SkipLines {
+		return nil
+	}
+
+	if err != nil {
+		lineErr := LineError{
+			Line:   raw.Line,
+			Offset: raw.Offset,
+			Raw:    string(raw.Raw),
+			Field:  fieldOf(err),
+			Reason: err.Error(),
+			Err:    err,
+		}
+		if opts.Reject == nil {
+			return &lineErr
+		}
+		return opts.Reject(lineErr)
+	}
+
+	if err := fn(rec); err != nil {
+		return fmt.Errorf("line %d: %w", raw.Line, err)
+	}
+	return nil
+}
+
+// recordFromInput validates a decoded record and converts it by event type
+func recordFromInput(input PurchaseInput, tp *TimestampParser) (Record, error) {
+	switch EventType(input.EventType) {
+	case "", EventPurchase:
+		p, err := input.toPurchase(tp)
+		return Record{Purchase: p}, err
+	case EventRefund, EventChargeback:
+		r, err := input.toRefund(tp)
+		if err != nil {
+			return Record{}, err
+		}
+		return Record{Refund: &r}, nil
+	default:
+		return Record{}, fmt.Errorf("%w: invalid event_type %q", ErrBadInput, input.EventType)
+	}
+}
+
+// lineReader splits a stream into lines while tracking line numbers and byte offsets.
+// The slice returned by next is only valid until the following call.
+type lineReader struct {
+	br     *bufio.Reader
+	buf    []byte
+	max    int   // longest line accepted, without its newline; 0 = no limit
+	line   int   // number of the line last returned
+	start  int64 // offset of the line last returned
+	offset int64 // offset of the next unread byte
+}
+
+func newLineReader(r io.Reader) *lineReader {
+	return &lineReader{br: bufio.NewReaderSize(r, 64*1024)}
+}
+
+func (lr *lineReader) next() ([]byte, error) {
+	lr.buf = lr.buf[:0]
+	lr.start = lr.offset
+
+	for {
+		chunk, err := lr.br.ReadSlice('\n')
+		lr.buf = append(lr.buf, chunk...)
+		lr.offset += int64(len(chunk))
+
+		n := len(lr.buf)
+		if err == nil {
+			n-- // the newline
+		}
+		if lr.max > 0 && n > lr.max {
+			return nil, &LimitError{Limit: "max_line_bytes", Max: int64(lr.max), Line: lr.line + 1, Offset: lr.start}
+		}
+
+		switch err {
+		case nil:
+			lr.line++
+			return lr.buf, nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			if len(lr.buf) == 0 {
+				return nil, io.EOF
+			}
+			lr.line++
+			return lr.buf, nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+// IngestOptions are the per-request settings of an ingest. They are stored
+// with asynchronous jobs, so every field must round-trip through JSON.
+type IngestOptions struct {
+	// Lenient skips invalid lines and records them as rejects instead of
+	// aborting the ingest at the first one
+	Lenient bool `json:"lenient,omitempty"`
+
+	// UploadID makes the ingest resumable: lines committed by an earlier
+	// attempt with the same ID are skipped
+	UploadID string `json:"upload_id,omitempty"`
+
+	// ConflictPolicy decides which version of a repeated transaction_id wins
+	ConflictPolicy ConflictPolicy `json:"conflict_policy,omitempty"`
+
+	// Uploader identifies who sent the upload in the ingest_files ledger
+	Uploader string `json:"uploader,omitempty"`
+
+	// RefuseDuplicate fails an ingest of a file that is already in the
+	// ingest_files ledger with ErrDuplicateFile
+	RefuseDuplicate bool `json:"refuse_duplicate,omitempty"`
+
+	// Format names the registered format of the upload; empty means NDJSON
+	Format string `json:"format,omitempty"`
+
+	// Strict checks every record in strict schema mode, whatever the
+	// Ingester's SchemaPolicy says for its platform
+	Strict bool `json:"strict,omitempty"`
+
+	// MaxLineBytes and MaxRecords are the sender's IngestLimits on the
+	// lines and records of the upload; 0 means no limit
+	MaxLineBytes int `json:"max_line_bytes,omitempty"`
+	MaxRecords   int `json:"max_records,omitempty"`
+}
+
+// IngestProgress is the state of a running ingest
+type IngestProgress struct {
+	IngestResponse
+	Lines int   // the last line read
+	Bytes int64 // bytes of the upload consumed, before decompression
+}
+
+// Ingester streams NDJSON purchases and refunds into the store and tallies the outcome
+type Ingester struct {
+	Store   Store
+	Options IngestOptions
+
+	// ContentEncoding is the declared encoding of the upload; gzip is also
+	// detected from the data itself when it is empty
+	ContentEncoding string
+
+	// MaxDecompressionRatio caps decompressed/compressed size for gzip uploads (0 = no cap)
+	MaxDecompressionRatio float64
+
+	// BulkThreshold switches to the COPY-based bulk path once more than this
+	// many records have been read (0 = always upsert one at a time)
+	BulkThreshold int
 
+	// Progress, if set, is called with the running totals after every record
+	Progress func(IngestProgress)
 
-// ValidatePurchaseInput performs basic validation on purchase input
+	// FileName, when set, records a successful ingest in the ingest_files
+	// ledger under the hash of the decompressed upload, and reports an
+	// earlier ingest of the same file in DuplicateOf. It is also kept as
+	// purchase provenance.
+	FileName string
+
+	// Source is recorded as the provenance of every purchase written
+	Source IngestSource
+
+	// Timestamps parses created_at values; nil uses the defaults
+	Timestamps *TimestampParser
+
+	// Schema selects the records checked in strict schema mode
+	Schema SchemaPolicy
+
+	// Decoders is the number of goroutines decoding and validating records;
+	// Writers the number writing them to the store, each on a connection of
+	// its own. Outcomes are still counted and reported in file order.
+	// 0 or 1 does the work on the calling goroutine.
+	Decoders int
+	Writers  int
+
+	// RejectFlushInterval, if set, saves rejected lines at least this often
+	// rather than only in full batches, so those of a long-running feed can
+	// be read from /ingest/batches/{id}/rejects while it runs
+	RejectFlushInterval time.Duration
+}
+
+// streamOptions returns the decoding settings of the ingest
+func (ing Ingester) streamOptions() StreamOptions {
+	opts := StreamOptions{
+		Timestamps:   ing.Timestamps,
+		Schema:       ing.Schema,
+		Decoders:     ing.Decoders,
+		MaxLineBytes: ing.Options.MaxLineBytes,
+		MaxRecords:   ing.Options.MaxRecords,
+	}
+	if ing.Options.Strict {
+		opts.Schema = SchemaPolicy{Strict: true}
+	}
+	return opts
+}
+
+// Run ingests r under the given ingest ID. Rejected lines are saved in
+// batches as they arrive, and what is left when the stream has been consumed
+// or fails. On error the totals of the records committed before the failure
+// are returned as well.
+//
+// With a BulkThreshold, records are held back until the threshold is crossed;
+// larger inputs are then loaded in a single COPY transaction, smaller ones
+// are upserted one at a time at the end. Refunds in a bulk load are added
+// after the COPY commits, since they may reference purchases loaded by it.
+//
+// In lenient mode, refunds of unknown purchases are rejected like invalid lines.
+//
+// The checkpoint of a resumable upload is cleared once the upload has been
+// ingested in full, so its Upload-ID may be reused.
+//
+// A seekable upload is checked against the ingest_files ledger before
+// anything is written, and refused as a duplicate without writing. Otherwise
+// a duplicate is only recognised once it has been read in full and is
+// recorded, which also decides between concurrent ingests of the same file:
+// exactly one succeeds, and the others keep what they wrote, as it is the
+// same records the original wrote.
+//
+// Resumable uploads are written by a single writer whatever Writers is, so
+// that each write checkpoints the upload in its own transaction, in file
+// order. When an ingest with several writers fails, writes still in flight
+// are cancelled; those that had already committed are counted all the same.
+func (ing Ingester) Run(ctx context.Context, ingestID string, r io.Reader) (IngestResponse, error) {
+	resp := IngestResponse{IngestID: ingestID}
+	if err := ing.refuseDuplicate(ctx, r, &resp); err != nil {
+		return resp, err
+	}
+	rejects := &rejectBuffer{store: ing.Store, ingestID: ingestID}
+	if ing.RejectFlushInterval > 0 {
+		defer rejects.flushEvery(ctx, ing.RejectFlushInterval)()
+	}
+
+	raw, upload, err := openUpload(r, ing.ContentEncoding, ing.MaxDecompressionRatio)
+	if err != nil {
+		return resp, err
+	}
+	r = upload
+
+	uploadID := ing.Options.UploadID
+	opts := ing.streamOptions()
+	if uploadID != "" {
+		if opts.SkipLines, err = ing.Store.GetCheckpoint(ctx, uploadID); err != nil {
+			return resp, err
+		}
+		resp.Skipped = opts.SkipLines
+	}
+
+	var (
+		// lastDone is the last line that was committed or rejected with
+		// every line before it handled as well; lastSeen is the last line read
+		lastDone = opts.SkipLines
+		lastSeen = opts.SkipLines
+		pending  []Record
+		bulk     BulkWriter
+		deferred []Record // refunds held back until the bulk load commits
+
+		// bulkVersions counts the schema_versions of the bulk load, which
+		// are only ingested once it commits
+		bulkVersions = make(map[int]int)
+	)
+
+	report := func() {
+		resp.tally()
+		if ing.Progress != nil {
+			ing.Progress(IngestProgress{IngestResponse: resp, Lines: lastSeen, Bytes: raw.read()})
+		}
+	}
+
+	// count adds a committed record to the totals
+	count := func(rec Record, res UpsertResult) {
+		resp.addReversal(rec, res)
+		resp.addVersions(rec.Version, 1)
+		switch {
+		case res.Created:
+			resp.Created++
+		case res.Updated:
+			resp.Updated++
+		case len(res.Conflict) > 0:
+			resp.addConflict(Conflict{Line: rec.Line, TransactionID: rec.Purchase.TransactionID, Fields: res.Conflict})
+		default:
+			resp.Ignored++
+		}
+	}
+
+	// settle counts the outcome of writing a record
+	settle := func(rec Record, res UpsertResult, err error) error {
+		if err != nil {
+			if !ing.Options.Lenient || !errors.Is(err, ErrBadInput) {
+				return err
+			}
+			resp.Rejected++
+			lastDone = rec.Line
+			report()
+			return rejects.add(ctx, LineError{Line: rec.Line, Offset: rec.Offset, Reason: err.Error(), Err: err})
+		}
+		count(rec, res)
+		lastDone = rec.Line
+		report()
+		return nil
+	}
+
+	addOne := func(rec Record) error {
+		res, err := ing.write(ctx, rec, ing.lineRef(ingestID, rec.Line))
+		return settle(rec, res, err)
+	}
+
+	rejectLine := func(rej LineError) error {
+		resp.Rejected++
+		if len(pending) == 0 && bulk == nil {
+			lastDone = rej.Line
+		}
+		report()
+		return rejects.add(ctx, rej)
+	}
+
+	// With several writers, outcomes are settled in file order as the
+	// writes complete. A resumable upload keeps to one, since its writes
+	// checkpoint it and must commit in file order.
+	submit := addOne
+	var pool *writerPool
+	if ing.Writers > 1 && uploadID == "" {
+		pool = newWriterPool(ctx, ing.Writers, func(ctx context.Context, rec Record) (UpsertResult, error) {
+			return ing.write(ctx, rec, ing.lineRef(ingestID, rec.Line))
+		}, func(it *writeItem) error {
+			if it.reject != nil {
+				return rejectLine(*it.reject)
+			}
+			return settle(it.rec, it.res, it.err)
+		})
+		defer pool.close()
+		submit = pool.submit
+	}
+
+	if ing.Options.Lenient {
+		opts.Reject = func(rej LineError) error {
+			lastSeen = rej.Line
+			if pool != nil {
+				return pool.submitReject(rej)
+			}
+			return rejectLine(rej)
+		}
+	}
+
+	format, err := LookupFormat(ing.Options.Format)
+	if err != nil {
+		return resp, err
+	}
+
+	err = StreamRecords(ctx, format.NewDecoder(r), opts, func(rec Record) error {
+		lastSeen = rec.Line
+		if ing.BulkThreshold <= 0 {
+			return submit(rec)
+		}
+
+		// Records held back for the bulk load are counted once it commits,
+		// but their lines are read
+		defer report()
+		switch {
+		case bulk != nil && rec.Refund != nil:
+			deferred = append(deferred, rec)
+			return nil
+		case bulk != nil:
+			bulkVersions[rec.Version]++
+			return bulk.Add(ctx, rec)
+		}
+
+		pending = append(pending, rec)
+		if len(pending) <= ing.BulkThreshold {
+			return nil
+		}
+
+		var err error
+		ref := ing.lineRef(ingestID, 0)
+		if bulk, err = ing.Store.BeginBulk(ctx, ref); err != nil {
+			return err
+		}
+		for _, p := range pending {
+			if p.Refund != nil {
+				deferred = append(deferred, p)
+				continue
+			}
+			bulkVersions[p.Version]++
+			if err := bulk.Add(ctx, p); err != nil {
+				return err
+			}
+		}
+		pending = nil
+		return nil
+	})
+
+	switch {
+	case bulk != nil && err != nil:
+		bulk.Rollback()
+	case bulk != nil:
+		// The checkpoint must not pass a refund that has not been added yet
+		committed := lastSeen
+		if len(deferred) > 0 {
+			committed = deferred[0].Line - 1
+		}
+
+		var res BulkResult
+		if res, err = bulk.Commit(ctx, committed, resp.addConflict); err == nil {
+			resp.Created += res.Created
+			resp.Updated += res.Updated
+			resp.Ignored += res.Ignored
+			for version, n := range bulkVersions {
+				resp.addVersions(version, n)
+			}
+			lastDone = committed
+			report()
+		}
+		for _, rec := range deferred {
+			if err != nil {
+				break
+			}
+			err = addOne(rec)
+		}
+		if err == nil {
+			lastDone = lastSeen
+		}
+	case err == nil:
+		for _, rec := range pending {
+			if err = submit(rec); err != nil {
+				break
+			}
+		}
+		if err == nil && pool != nil {
+			err = pool.drain()
+		}
+		if err == nil {
+			lastDone = lastSeen
+		}
+	}
+	if pool != nil {
+		pool.close()
+		// Records written after the one that failed are in the store all the same
+		for _, it := range pool.committed() {
+			count(it.rec, it.res)
+		}
+	}
+	resp.tally()
+
+	if serr := rejects.flush(ctx); serr != nil && err == nil {
+		err = serr
+	}
+	if err == nil && ing.FileName != "" {
+		err = ing.recordFile(ctx, ingestID, upload, lastSeen, &resp)
+	}
+	switch {
+	case uploadID == "":
+	case err == nil, errors.Is(err, ErrDuplicateFile):
+		// Complete, even if refused as a duplicate: a later upload under the
+		// same ID is new data
+		if cerr := ing.Store.ClearCheckpoint(ctx, uploadID); cerr != nil {
+			log.Printf("ingest %s: clearing checkpoint for upload %s failed: %v", ingestID, uploadID, cerr)
+		}
+	case lastDone > opts.SkipLines:
+		// Trailing rejects are not covered by the per-purchase checkpoint
+		if cerr := ing.Store.SaveCheckpoint(ctx, uploadID, ingestID, lastDone); cerr != nil {
+			log.Printf("ingest %s: saving checkpoint for upload %s failed: %v", ingestID, uploadID, cerr)
+		}
+	}
+	return resp, err
+}
+
+// rejectBatchSize is how many rejected lines Run buffers before saving them
+const rejectBatchSize = 500
+
+// rejectBuffer saves the rejected lines of an ingest in batches as they
+// arrive, so they neither pile up in memory nor wait for the end of the input
+type rejectBuffer struct {
+	store    RejectStore
+	ingestID string
+
+	mu    sync.Mutex
+	batch []LineError
+}
+
+// add buffers a rejected line, saving the batch once it is full
+func (b *rejectBuffer) add(ctx context.Context, rej LineError) error {
+	b.mu.Lock()
+	b.batch = append(b.batch, rej)
+	full := len(b.batch) >= rejectBatchSize
+	b.mu.Unlock()
+	if !full {
+		return nil
+	}
+	return b.flush(ctx)
+}
+
+// flushEvery also saves the buffered rejected lines every interval, until
+// the returned function is called. Lines whose save fails stay buffered for
+// the next attempt.
+func (b *rejectBuffer) flushEvery(ctx context.Context, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := b.flush(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("ingest %s: %v", b.ingestID, err)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// flush saves the buffered rejected lines
+func (b *rejectBuffer) flush(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.batch) == 0 {
+		return nil
+	}
+	if err := b.store.SaveRejects(ctx, b.ingestID, b.batch); err != nil {
+		return fmt.Errorf("save rejected lines: %w", err)
+	}
+	b.batch = nil
+	return nil
+}
+
+// write adds a record to the store
+func (ing Ingester) write(ctx context.Context, rec Record, ref LineRef) (UpsertResult, error) {
+	if rec.Refund != nil {
+		return ing.Store.AddRefund(ctx, *rec.Refund, ref)
+	}
+	return ing.Store.AddPurchase(ctx, rec.Purchase, ref)
+}
+
+// lineRef describes a line of this ingest to the store
+func (ing Ingester) lineRef(ingestID string, line int) LineRef {
+	return LineRef{
+		IngestID: ingestID,
+		UploadID: ing.Options.UploadID,
+		Line:     line,
+		Policy:   ing.Options.ConflictPolicy,
+		Source:   ing.Source,
+		FileName: ing.FileName,
+	}
+}
+
+// refuseDuplicate returns ErrDuplicateFile, pointing resp at the original
+// ingest, if RefuseDuplicate is set and r is a seekable upload whose
+// decompressed contents are in the ingest_files ledger. r is rewound.
+func (ing Ingester) refuseDuplicate(ctx context.Context, r io.Reader, resp *IngestResponse) error {
+	f, ok := r.(io.ReadSeeker)
+	if !ing.Options.RefuseDuplicate || !ok {
+		return nil
+	}
+	hash, err := hashFile(f, ing.ContentEncoding, ing.MaxDecompressionRatio)
+	if err != nil {
+		return fmt.Errorf("hash upload: %w", err)
+	}
+	original, err := ing.Store.FindIngestFile(ctx, hash)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return nil
+	case err != nil:
+		return fmt.Errorf("check for duplicate file: %w", err)
+	}
+	resp.DuplicateOf = &original
+	return fmt.Errorf("%w by %s", ErrDuplicateFile, original.IngestID)
+}
+
+// recordFile adds a completed upload to the ingest_files ledger and points
+// resp at the original ingest if the same file was ingested before. With
+// RefuseDuplicate, ErrDuplicateFile is returned for such a file; it was
+// recorded while this ingest ran, since refuseDuplicate found none before.
+func (ing Ingester) recordFile(ctx context.Context, ingestID string, upload *hashingReader, lines int, resp *IngestResponse) error {
+	// Anything after the last line, such as trailing blank lines, is part of the file
+	if _, err := io.Copy(io.Discard, upload); err != nil {
+		return fmt.Errorf("read upload: %w", err)
+	}
+
+	original, duplicate, err := ing.Store.RecordIngestFile(ctx, IngestFile{
+		Hash:     upload.sum(),
+		Size:     upload.n,
+		Lines:    lines,
+		FileName: ing.FileName,
+		Uploader: ing.Options.Uploader,
+		IngestID: ingestID,
+	})
+	if err != nil {
+		return err
+	}
+	if !duplicate {
+		return nil
+	}
+	resp.DuplicateOf = &original
+	if !ing.Options.RefuseDuplicate {
+		return nil
+	}
+	return fmt.Errorf("%w by %s", ErrDuplicateFile, original.IngestID)
+}
+
+// newIngestID returns a random identifier for one ingest run
+func newIngestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate ingest id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ValidatePurchaseInput performs basic validation on purchase input, reading
+// created_at with the default TimestampParser
 func ValidatePurchaseInput(input PurchaseInput) error {
-	// TODO: Add validation rules
+	if err := validatePurchaseFields(input); err != nil {
+		return err
+	}
+	_, err := defaultTimestamps.Parse(input.CreatedAt, input.Platform)
+	return err
+}
 
+// validatePurchaseFields validates everything but created_at, whose
+// parsing is configurable
+func validatePurchaseFields(input PurchaseInput) error {
+	switch {
+	case strings.TrimSpace(input.TransactionID) == "":
+		return fmt.Errorf("%w: transaction_id is required", ErrBadInput)
+	case strings.TrimSpace(input.PlayerID) == "":
+		return fmt.Errorf("%w: player_id is required", ErrBadInput)
+	case strings.TrimSpace(input.GameTitle) == "":
+		return fmt.Errorf("%w: game_title is required", ErrBadInput)
+	case !validItemTypes[input.ItemType]:
+		return fmt.Errorf("%w: invalid item_type %q", ErrBadInput, input.ItemType)
+	case !validPlatforms[input.Platform]:
+		return fmt.Errorf("%w: invalid platform %q", ErrBadInput, input.Platform)
+	case input.AmountCents < 0:
+		return fmt.Errorf("%w: amount_cents must be >= 0, got %d", ErrBadInput, input.AmountCents)
+	case input.PlayerLevel < 1:
+		return fmt.Errorf("%w: player_level must be >= 1, got %d", ErrBadInput, input.PlayerLevel)
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// Allowed values, mirroring the CHECK constraints in sql/schema.sql
+var (
+	validItemTypes = map[string]bool{
+		"game": true, "dlc": true, "cosmetic": true, "currency": true, "season_pass": true,
+	}
+	validPlatforms = map[string]bool{
+		"steam": true, "epic": true, "xbox": true, "playstation": true, "nintendo": true, "mobile": true,
+	}
+)
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// JobState is the lifecycle state of an asynchronous ingest job
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+// IngestJob is an upload queued for background ingestion
+type IngestJob struct {
+	ID              string        `json:"id"`
+	State           JobState      `json:"state"`
+	FileName        string        `json:"file_name"`
+	UploadBytes     int64         `json:"upload_bytes"`
+	ContentEncoding string        `json:"content_encoding,omitempty"` // declared by the file part of the upload
+	Options         IngestOptions `json:"options"`
+	LinesProcessed  int           `json:"lines_processed"`
+	Created         int           `json:"created"`
+	Updated         int           `json:"updated"`
+	Rejected        int           `json:"rejected"`
+	Error           string        `json:"error,omitempty"`
+	CreatedAt       time.Time     `json:"created_at"`
+	StartedAt       *time.Time    `json:"started_at,omitempty"`
+	FinishedAt      *time.Time    `json:"finished_at,omitempty"`
+	ElapsedSeconds  float64       `json:"elapsed_seconds,omitempty"`
+
+	// Result is the final IngestResponse of a finished job
+	Result *IngestResponse `json:"result,omitempty"`
+
+	// ClaimedBy is the runner holding the job while it runs, until
+	// LeaseExpiresAt unless the runner renews the lease
+	ClaimedBy      string     `json:"-"`
+	LeaseExpiresAt *time.Time `json:"-"`
+}
+
+// JobStore persists asynchronous ingest jobs
+type JobStore interface {
+	// CreateJob records a new job in the queued state together with its
+	// upload, which is kept in the database so any runner can claim the job
+	CreateJob(ctx context.Context, job IngestJob, upload io.Reader) (IngestJob, error)
+
+	// GetJob returns a job by ID, or ErrNotFound
+	GetJob(ctx context.Context, id string) (IngestJob, error)
+
+	// OpenJobUpload returns a reader of the upload of a job, or ErrNotFound
+	OpenJobUpload(ctx context.Context, id string) (io.Reader, error)
+
+	// ClaimJob moves the oldest queued job to running using FOR UPDATE SKIP LOCKED,
+	// leased to runner for the given duration. Returns ErrNotFound when the
+	// queue is empty.
+	ClaimJob(ctx context.Context, runner string, lease time.Duration) (IngestJob, error)
+
+	// RenewJobLease extends the lease of a running job. Returns ErrNotFound
+	// if runner no longer holds it.
+	RenewJobLease(ctx context.Context, id, runner string, lease time.Duration) error
+
+	// UpdateJobProgress stores the running totals of a job
+	UpdateJobProgress(ctx context.Context, id string, progress IngestResponse) error
+
+	// FinishJob stores the final result and moves the job to succeeded, or to
+	// failed when jobErr is non-nil, and deletes its upload. Returns
+	// ErrNotFound if runner no longer holds the job.
+	FinishJob(ctx context.Context, id, runner string, result IngestResponse, jobErr error) error
+
+	// RequeueExpiredJobs returns running jobs whose lease has expired, as
+	// their runner stopped or lost the database, to the queue
+	RequeueExpiredJobs(ctx context.Context) (int, error)
+}
+
+// JobRunner executes queued ingest jobs in the background
+type JobRunner struct {
+	Workers int           // Number of jobs processed concurrently
+	Poll    time.Duration // Delay between queue polls when idle
+	Store   Store
+
+	MaxDecompressionRatio float64 // cap on decompressed/compressed size of gzip uploads
+	BulkThreshold         int     // uploads with more records use the COPY bulk path (0 = never)
+
+	Timestamps *TimestampParser // parses created_at values; nil uses the defaults
+	Schema     SchemaPolicy     // records checked in strict schema mode
+
+	Decoders int // goroutines decoding and validating the records of a job
+	Writers  int // goroutines writing the records of a job to the store
+
+	// Events publishes the progress of running jobs to their watchers
+	Events *JobEvents
+
+	// ID names this runner in the leases of the jobs it claims; empty uses
+	// the host name and process ID
+	ID string
+
+	// Lease is how long a claimed job stays with this runner without being
+	// renewed, which happens every Lease/3 while it runs. Jobs whose lease
+	// expires are requeued for any runner. 0 uses defaultJobLease.
+	Lease time.Duration
+}
+
+// defaultJobLease is the lease of a JobRunner without one
+const defaultJobLease = time.Minute
+
+// errLeaseLost cancels a job whose lease was taken over by another runner
+var errLeaseLost = errors.New("job lease lost")
+
+// Run processes the queue until the context is cancelled, requeueing the jobs
+// of runners that stopped renewing their leases every Lease
+func (jr JobRunner) Run(ctx context.Context) error {
+	if jr.ID == "" {
+		jr.ID = newRunnerID()
+	}
+	if jr.Lease <= 0 {
+		jr.Lease = defaultJobLease
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		jr.requeueExpired(ctx)
+	}()
+	for i := 1; i <= jr.Workers; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			jr.worker(ctx, workerID)
+		}(i)
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// requeueExpired requeues jobs with an expired lease every Lease until the
+// context is cancelled
+func (jr JobRunner) requeueExpired(ctx context.Context) {
+	for {
+		n, err := jr.Store.RequeueExpiredJobs(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Printf("Requeueing expired ingest jobs failed: %v", err)
+		case n > 0:
+			log.Printf("Requeued %d ingest jobs whose runner stopped renewing its lease", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jr.Lease):
+		}
+	}
+}
+
+// newRunnerID names a job runner after its host and process, with a random
+// suffix as containers often share both
+func newRunnerID() string {
+	host, _ := os.Hostname()
+	suffix, _ := newIngestID()
+	return fmt.Sprintf("%s-%d-%.8s", host, os.Getpid(), suffix)
+}
+
+// worker claims and runs jobs until the context is cancelled
+func (jr JobRunner) worker(ctx context.Context, workerID int) {
+	for {
+		job, err := jr.Store.ClaimJob(ctx, jr.ID, jr.Lease)
+		if err == nil {
+			log.Printf("Job worker %d running ingest job %s", workerID, job.ID)
+			jr.runJob(ctx, job)
+			continue
+		}
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("Job worker %d: claim failed: %v", workerID, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jr.Poll):
+		}
+	}
+}
+
+// jobProgressInterval throttles how often running totals are written back;
+// jobEventInterval how often they are published to watchers
+const (
+	jobProgressInterval = time.Second
+	jobEventInterval    = 250 * time.Millisecond
+)
+
+// runJob ingests a claimed job's upload and records the outcome. The job is
+// cancelled if its lease is lost, as another runner may then have claimed it.
+func (jr JobRunner) runJob(ctx context.Context, job IngestJob) {
+	var result IngestResponse
+
+	jr.Events.Start(job.ID)
+
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go jr.heartbeat(jobCtx, job.ID, cancel)
+
+	upload, err := jr.Store.OpenJobUpload(jobCtx, job.ID)
+	if err == nil {
+		started := time.Now()
+		lastUpdate, lastEvent := started, started
+		ing := Ingester{
+			Store:                 jr.Store,
+			Options:               job.Options,
+			ContentEncoding:       job.ContentEncoding,
+			MaxDecompressionRatio: jr.MaxDecompressionRatio,
+			BulkThreshold:         jr.BulkThreshold,
+			FileName:              job.FileName,
+			Source:                SourceMultipart,
+			Timestamps:            jr.Timestamps,
+			Schema:                jr.Schema,
+			Decoders:              jr.Decoders,
+			Writers:               jr.Writers,
+			Progress: func(progress IngestProgress) {
+				now := time.Now()
+				if now.Sub(lastEvent) >= jobEventInterval {
+					lastEvent = now
+					jr.Events.Progress(job.ID, newJobProgress(progress, job.UploadBytes, started, now))
+				}
+				if now.Sub(lastUpdate) < jobProgressInterval {
+					return
+				}
+				lastUpdate = now
+				if err := jr.Store.UpdateJobProgress(jobCtx, job.ID, progress.IngestResponse); err != nil {
+					log.Printf("ingest job %s: progress update failed: %v", job.ID, err)
+				}
+			},
+		}
+		result, err = ing.Run(jobCtx, job.ID, upload)
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		// Shutting down: the job is requeued once its lease expires
+		jr.Events.Abandon(job.ID)
+		return
+	case errors.Is(context.Cause(jobCtx), errLeaseLost):
+		log.Printf("ingest job %s: lease lost to another runner, abandoning it", job.ID)
+		jr.Events.Abandon(job.ID)
+		return
+	}
+
+	if err != nil {
+		log.Printf("ingest job %s failed: %v", job.ID, err)
+	}
+	if result.DuplicateOf != nil {
+		log.Printf("ingest job %s: file was already ingested by %s", job.ID, result.DuplicateOf.IngestID)
+	}
+	if ferr := jr.Store.FinishJob(ctx, job.ID, jr.ID, result, err); ferr != nil {
+		log.Printf("ingest job %s: recording result failed: %v", job.ID, ferr)
+		jr.Events.Abandon(job.ID)
+		return
+	}
+
+	summary := JobSummary{State: JobSucceeded, IngestResponse: result}
+	if err != nil {
+		summary.State, summary.Error = JobFailed, err.Error()
+	}
+	jr.Events.Finish(job.ID, summary)
+}
+
+// heartbeat renews the lease of a running job every Lease/3 until ctx is
+// done, and cancels the job with errLeaseLost once the lease is gone
+func (jr JobRunner) heartbeat(ctx context.Context, id string, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(jr.Lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := jr.Store.RenewJobLease(ctx, id, jr.ID, jr.Lease)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			cancel(errLeaseLost)
+			return
+		case err != nil && ctx.Err() == nil:
+			log.Printf("ingest job %s: renewing lease failed: %v", id, err)
+		}
+	}
+}
+
+// jobUploadChunk is the size of the rows an upload is stored in
+const jobUploadChunk = 1 << 20
+
+const jobColumns = `
+	id, state, file_name, COALESCE(upload_bytes, 0), content_encoding, options, lines_processed,
+	created_count, updated_count, rejected_count, COALESCE(error, ''), result,
+	created_at, started_at, finished_at, COALESCE(claimed_by, ''), lease_expires_at`
+
+// scanJob reads a row selected with jobColumns
+func scanJob(row interface{ Scan(...any) error }) (IngestJob, error) {
+	var (
+		job        IngestJob
+		options    []byte
+		result     []byte
+		startedAt  sql.NullTime
+		finishedAt sql.NullTime
+		leaseEnd   sql.NullTime
+	)
+	err := row.Scan(&job.ID, &job.State, &job.FileName, &job.UploadBytes, &job.ContentEncoding, &options, &job.LinesProcessed,
+		&job.Created, &job.Updated, &job.Rejected, &job.Error, &result,
+		&job.CreatedAt, &startedAt, &finishedAt, &job.ClaimedBy, &leaseEnd)
+	if err != nil {
+		return IngestJob{}, err
+	}
+	if leaseEnd.Valid {
+		job.LeaseExpiresAt = &leaseEnd.Time
+	}
+	if err := json.Unmarshal(options, &job.Options); err != nil {
+		return IngestJob{}, fmt.Errorf("decode job options: %w", err)
+	}
+	if result != nil {
+		job.Result = new(IngestResponse)
+		if err := json.Unmarshal(result, job.Result); err != nil {
+			return IngestJob{}, fmt.Errorf("decode job result: %w", err)
+		}
+	}
+
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+		end := time.Now()
+		if finishedAt.Valid {
+			job.FinishedAt = &finishedAt.Time
+			end = finishedAt.Time
+		}
+		job.ElapsedSeconds = end.Sub(startedAt.Time).Seconds()
+	}
+	return job, nil
+}
+
+// CreateJob implements JobStore.CreateJob. The upload is stored in chunks
+// of jobUploadChunk bytes, each written with a timeout of its own.
+func (s *pgStore) CreateJob(ctx context.Context, job IngestJob, upload io.Reader) (IngestJob, error) {
+	options, err := json.Marshal(job.Options)
+	if err != nil {
+		return IngestJob{}, fmt.Errorf("encode job options: %w", err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return IngestJob{}, fmt.Errorf("begin create job: %w", err)
+	}
+	defer tx.Rollback()
+
+	exec := func(query string, args ...any) error {
+		ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+		defer cancel()
+		_, err := tx.ExecContext(ctx, query, args...)
+		return err
+	}
+
+	err = exec(`INSERT INTO ingest_jobs (id, file_name, content_encoding, options) VALUES ($1, $2, $3, $4)`,
+		job.ID, job.FileName, job.ContentEncoding, options)
+	if err != nil {
+		return IngestJob{}, fmt.Errorf("create job: %w", err)
+	}
+
+	var size int64
+	chunk := make([]byte, jobUploadChunk)
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(upload, chunk)
+		if n > 0 {
+			if err := exec(`INSERT INTO ingest_job_uploads (job_id, seq, data) VALUES ($1, $2, $3)`,
+				job.ID, seq, chunk[:n]); err != nil {
+				return IngestJob{}, fmt.Errorf("store upload of job %s: %w", job.ID, err)
+			}
+			size += int64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return IngestJob{}, fmt.Errorf("read upload of job %s: %w", job.ID, err)
+		}
+	}
+
+	queryCtx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	created, err := scanJob(tx.QueryRowContext(queryCtx, `
+		UPDATE ingest_jobs SET upload_bytes = $2 WHERE id = $1
+		RETURNING`+jobColumns, job.ID, size))
+	if err != nil {
+		return IngestJob{}, fmt.Errorf("create job: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return IngestJob{}, fmt.Errorf("commit create job: %w", err)
+	}
+	return created, nil
+}
+
+// GetJob implements JobStore.GetJob
+func (s *pgStore) GetJob(ctx context.Context, id string) (IngestJob, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	job, err := scanJob(s.db.QueryRowContext(ctx, `SELECT`+jobColumns+` FROM ingest_jobs WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return IngestJob{}, ErrNotFound
+	}
+	if err != nil {
+		return IngestJob{}, fmt.Errorf("get job %s: %w", id, err)
+	}
+	return job, nil
+}
+
+// OpenJobUpload implements JobStore.OpenJobUpload. The chunks of the upload
+// are read one at a time as the reader is consumed.
+func (s *pgStore) OpenJobUpload(ctx context.Context, id string) (io.Reader, error) {
+	queryCtx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var exists bool
+	err := s.db.QueryRowContext(queryCtx, `SELECT TRUE FROM ingest_jobs WHERE id = $1`, id).Scan(&exists)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, fmt.Errorf("open upload of job %s: %w", id, err)
+	}
+	return &jobUploadReader{ctx: ctx, db: s.db, id: id}, nil
+}
+
+// jobUploadReader reads the chunks of a stored upload in order
+type jobUploadReader struct {
+	ctx   context.Context
+	db    *sql.DB
+	id    string
+	seq   int
+	chunk []byte
+}
+
+func (r *jobUploadReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		ctx, cancel := context.WithTimeout(r.ctx, dbTimeout)
+		err := r.db.QueryRowContext(ctx, `
+			SELECT data FROM ingest_job_uploads WHERE job_id = $1 AND seq = $2`, r.id, r.seq).Scan(&r.chunk)
+		cancel()
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, fmt.Errorf("read upload of job %s: %w", r.id, err)
+		}
+		r.seq++
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// ClaimJob implements JobStore.ClaimJob
+func (s *pgStore) ClaimJob(ctx context.Context, runner string, lease time.Duration) (IngestJob, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	job, err := scanJob(s.db.QueryRowContext(ctx, `
+		UPDATE ingest_jobs
+		SET state = 'running', started_at = NOW(),
+			claimed_by = $1, lease_expires_at = NOW() + make_interval(secs => $2)
+		WHERE id = (
+			SELECT id FROM ingest_jobs
+			WHERE state = 'queued'
+			ORDER BY created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING`+jobColumns, runner, lease.Seconds()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return IngestJob{}, ErrNotFound
+	}
+	if err != nil {
+		return IngestJob{}, fmt.Errorf("claim job: %w", err)
+	}
+	return job, nil
+}
+
+// RenewJobLease implements JobStore.RenewJobLease
+func (s *pgStore) RenewJobLease(ctx context.Context, id, runner string, lease time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE ingest_jobs SET lease_expires_at = NOW() + make_interval(secs => $3)
+		WHERE id = $1 AND claimed_by = $2 AND state = 'running'`,
+		id, runner, lease.Seconds())
+	if err != nil {
+		return fmt.Errorf("renew lease of job %s: %w", id, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("renew lease of job %s: %w", id, err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateJobProgress implements JobStore.UpdateJobProgress
+func (s *pgStore) UpdateJobProgress(ctx context.Context, id string, progress IngestResponse) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE ingest_jobs
+		SET lines_processed = $2, created_count = $3, updated_count = $4, rejected_count = $5
+		WHERE id = $1`,
+		id, progress.Total, progress.Created, progress.Updated, progress.Rejected)
+	if err != nil {
+		return fmt.Errorf("update job %s progress: %w", id, err)
+	}
+	return nil
+}
+
+// FinishJob implements JobStore.FinishJob
+func (s *pgStore) FinishJob(ctx context.Context, id, runner string, result IngestResponse, jobErr error) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	state, errText := JobSucceeded, sql.NullString{}
+	if jobErr != nil {
+		state, errText = JobFailed, sql.NullString{String: jobErr.Error(), Valid: true}
+	}
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("encode job %s result: %w", id, err)
+	}
+
+	var finished int
+	err = s.db.QueryRowContext(ctx, `
+		WITH finished AS (
+			UPDATE ingest_jobs
+			SET state = $3, lines_processed = $4, created_count = $5, updated_count = $6,
+				rejected_count = $7, error = $8, result = $9, finished_at = NOW(), lease_expires_at = NULL
+			WHERE id = $1 AND claimed_by = $2 AND state = 'running'
+			RETURNING id
+		), upload AS (
+			DELETE FROM ingest_job_uploads WHERE job_id IN (SELECT id FROM finished)
+		)
+		SELECT COUNT(*) FROM finished`,
+		id, runner, state, result.Total, result.Created, result.Updated, result.Rejected, errText, resultJSON).Scan(&finished)
+	if err != nil {
+		return fmt.Errorf("finish job %s: %w", id, err)
+	}
+	if finished == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RequeueExpiredJobs implements JobStore.RequeueExpiredJobs. The rejected
+// lines saved by the lost run are deleted, since the job runs again under
+// the same ingest ID.
+func (s *pgStore) RequeueExpiredJobs(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+		WITH requeued AS (
+			UPDATE ingest_jobs
+			SET state = 'queued', started_at = NULL, claimed_by = NULL, lease_expires_at = NULL,
+				lines_processed = 0, created_count = 0, updated_count = 0, rejected_count = 0
+			WHERE state = 'running' AND lease_expires_at < NOW()
+			RETURNING id
+		), rejects AS (
+			DELETE FROM ingest_rejects WHERE ingest_id IN (SELECT id FROM requeued)
+		)
+		SELECT COUNT(*) FROM requeued`).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("requeue expired jobs: %w", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"os"
+)
+
+// defaultMultipartMemory is the multipart memory used without a limit, as
+// by http.Request.FormFile
+const defaultMultipartMemory = 32 << 20
+
+// IngestLimits bound the resources of one /ingest request; 0 means no limit.
+// The JSON names are those reported in a LimitError.
+type IngestLimits struct {
+	// MaxLineBytes bounds a single NDJSON line, CSV or TSV row or JSON array
+	// element, so that a file without record boundaries cannot be buffered whole
+	MaxLineBytes int `json:"max_line_bytes,omitempty"`
+
+	// MaxRecords bounds the records read from one upload, rejected ones
+	// included
+	MaxRecords int `json:"max_records,omitempty"`
+
+	// MaxUploadBytes bounds the request body, before decompression
+	MaxUploadBytes int64 `json:"max_upload_bytes,omitempty"`
+
+	// MaxMultipartMemory bounds the multipart form held in memory; larger
+	// files are spooled to disk, larger form values are refused. 0 means
+	// defaultMultipartMemory.
+	MaxMultipartMemory int64 `json:"max_multipart_memory,omitempty"`
+}
+
+// override returns l with the limits set in o replacing its own
+func (l IngestLimits) override(o IngestLimits) IngestLimits {
+	if o.MaxLineBytes != 0 {
+		l.MaxLineBytes = o.MaxLineBytes
+	}
+	if o.MaxRecords != 0 {
+		l.MaxRecords = o.MaxRecords
+	}
+	if o.MaxUploadBytes != 0 {
+		l.MaxUploadBytes = o.MaxUploadBytes
+	}
+	if o.MaxMultipartMemory != 0 {
+		l.MaxMultipartMemory = o.MaxMultipartMemory
+	}
+	return l
+}
+
+// LoadClientLimits reads per-client IngestLimits from a JSON file mapping
+// the address of each client to the limits that replace the server's for
+// it, e.g.
+//
+//	{"203.0.113.7": {"max_records": 5000000, "max_upload_bytes": 5368709120}}
+func LoadClientLimits(path string) (map[string]IngestLimits, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("client limits: %w", err)
+	}
+	defer f.Close()
+
+	var limits map[string]IngestLimits
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&limits); err != nil {
+		return nil, fmt.Errorf("client limits %s: %w", path, err)
+	}
+	for client, l := range limits {
+		if l.MaxLineBytes < 0 || l.MaxRecords < 0 || l.MaxUploadBytes < 0 || l.MaxMultipartMemory < 0 {
+			return nil, fmt.Errorf("client limits %s: negative limit for %q", path, client)
+		}
+	}
+	return limits, nil
+}
+
+// LimitError reports an upload that exceeded one of its IngestLimits
+type LimitError struct {
+	Limit  string `json:"limit"` // the JSON name of the limit in IngestLimits
+	Max    int64  `json:"max"`
+	Line   int    `json:"line,omitempty"`   // the line exceeding it, when known
+	Offset int64  `json:"offset,omitempty"` // the byte offset of that line, or where the body was cut off
+}
+
+func (e *LimitError) Error() string {
+	switch {
+	case e.Line > 0:
+		return fmt.Sprintf("line %d (offset %d): %s of %d exceeded", e.Line, e.Offset, e.Limit, e.Max)
+	case e.Offset > 0:
+		return fmt.Sprintf("offset %d: %s of %d exceeded", e.Offset, e.Limit, e.Max)
+	default:
+		return fmt.Sprintf("%s of %d exceeded", e.Limit, e.Max)
+	}
+}
+
+// limitsFor returns the limits of the client sending r, found by its
+// address rather than the X-Uploader header, which any client may set
+func (s *Server) limitsFor(r *http.Request) IngestLimits {
+	return s.cfg.Limits.override(s.cfg.ClientLimits[clientAddr(r)])
+}
+
+// parseMultipart reads the multipart form of r within the limits. It
+// returns a *LimitError when one is exceeded.
+func (l IngestLimits) parseMultipart(w http.ResponseWriter, r *http.Request) error {
+	if l.MaxUploadBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, l.MaxUploadBytes)
+	}
+	memory := l.MaxMultipartMemory
+	if memory == 0 {
+		memory = defaultMultipartMemory
+	}
+
+	err := r.ParseMultipartForm(memory)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return &LimitError{Limit: "max_upload_bytes", Max: tooLarge.Limit, Offset: tooLarge.Limit}
+	case errors.Is(err, multipart.ErrMessageTooLarge):
+		return &LimitError{Limit: "max_multipart_memory", Max: memory}
+	}
+	return err
+}
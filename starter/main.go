@@ -4,10 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,11 +18,44 @@ import (
 )
 
 func main() {
+	// `ingest file...` backfills files without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "ingest" {
+		os.Exit(runIngestCommand(os.Args[2:]))
+	}
+
 	// TODO: Parse flags for different modes
 	var (
 		addr   = flag.String("addr", ":8080", "HTTP server address")
 		dbURL  = flag.String("db", getEnvOrDefault("DATABASE_URL", ""), "Database connection string")
 		enrich = flag.Bool("enrich", false, "Run enrichment worker instead of server")
+
+		spoolDir     = flag.String("spool-dir", "", "Ingest *.ndjson and *.ndjson.gz files dropped into this directory instead of running the server")
+		spoolPoll    = flag.Duration("spool-poll", 5*time.Second, "How often -spool-dir is scanned for new files")
+		spoolSettle  = flag.Duration("spool-settle", 30*time.Second, "How long a file in -spool-dir must be unmodified before it is ingested")
+		spoolReclaim = flag.Duration("spool-reclaim", 10*time.Minute, "How long a file may sit untouched in -spool-dir/processing, after its runner died, before it is ingested again (0 never)")
+		spoolLenient = flag.Bool("spool-lenient", true, "Skip invalid lines of spooled files, listing them in the summary, instead of failing the file")
+
+		jobWorkers = flag.Int("job-workers", 2, "Number of async ingest jobs processed concurrently")
+		jobLease   = flag.Duration("job-lease", time.Minute, "How long an async ingest job stays with this instance without a heartbeat before another may take it over")
+		streamIdle = flag.Duration("stream-idle-timeout", 2*time.Minute, "How long /ingest and /ingest/stream wait for more of a request body before closing")
+		bulkAbove  = flag.Int("bulk-threshold", 5000, "Use COPY-based bulk loading for uploads with more records than this (0 disables)")
+		gzipRatio  = flag.Float64("max-gzip-ratio", 100, "Maximum decompressed/compressed size ratio for gzip uploads (0 disables the check)")
+		dupFiles   = flag.String("duplicate-files", "warn", "What to do with uploads of an already ingested file: warn or refuse")
+		keyTTL     = flag.Duration("idempotency-retention", 24*time.Hour, "How long Idempotency-Key responses of /ingest are kept")
+		keyLease   = flag.Duration("idempotency-lease", time.Minute, "How long an /ingest request holds its Idempotency-Key without a heartbeat before a retry may take it over")
+
+		strictSchema    = flag.Bool("strict-schema", false, "Reject ingested records with unknown fields or without a required field")
+		schemaPlatforms = flag.String("schema-platforms", "", "Per-platform schema modes overriding -strict-schema, e.g. steam=strict,mobile=lenient")
+
+		decoders = flag.Int("ingest-decoders", runtime.GOMAXPROCS(0), "Goroutines decoding and validating the records of each ingest")
+		writers  = flag.Int("ingest-writers", 4, "Goroutines writing the records of each ingest, each holding a database connection")
+
+		maxUpload    = flag.Int64("max-upload-bytes", 4<<30, "Largest /ingest request body accepted, in bytes (0 disables)")
+		maxMultipart = flag.Int64("max-multipart-memory", defaultMultipartMemory, "Bytes of an /ingest multipart form held in memory; larger files are spooled to disk")
+		clientLimits = flag.String("client-limits", "", "JSON file of per-client limits overriding the max-* flags, keyed by client address")
+
+		tsFlags    = addTimestampFlags(flag.CommandLine)
+		limitFlags = addLimitFlags(flag.CommandLine)
 	)
 	flag.Parse()
 
@@ -27,10 +63,35 @@ func main() {
 		log.Fatal("DATABASE_URL environment variable or -db flag is required")
 	}
 
+	dupPolicy, err := ParseDuplicateFilePolicy(*dupFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	timestamps, err := tsFlags.parser()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	schema := SchemaPolicy{Strict: *strictSchema}
+	if schema.Platforms, err = ParseSchemaPlatforms(*schemaPlatforms); err != nil {
+		log.Fatal(err)
+	}
+
+	limits := limitFlags.limits()
+	limits.MaxUploadBytes = *maxUpload
+	limits.MaxMultipartMemory = *maxMultipart
+	var perClient map[string]IngestLimits
+	if *clientLimits != "" {
+		if perClient, err = LoadClientLimits(*clientLimits); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// TODO: Connect to database with proper settings
-	db, err := sql.Open("postgres", *dbURL)
+	db, err := connectDB(context.Background(), *dbURL)
 	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
+		log.Fatal(err)
 	}
 	defer db.Close()
 
@@ -39,33 +100,101 @@ func main() {
 	// db.SetMaxIdleConns(5)
 	// db.SetConnMaxLifetime(time.Hour)
 
-	// TODO: Ping database to verify connection
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	
-	if err := db.PingContext(ctx); err != nil {
-		log.Fatal("Failed to ping database:", err)
-	}
-
 	// TODO: Initialize store
 	store := &pgStore{db: db}
 
 	if *enrich {
-		// TODO: Run enrichment worker pool
 		log.Println("Starting enrichment worker...")
-		// wp := WorkerPool{Workers: 3, Batch: 10, Store: store}
-		// return wp.Run(context.Background())
+		enrichCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		wp := WorkerPool{Workers: 3, Batch: 10, Store: store, Poll: time.Second}
+		if err := wp.Run(enrichCtx); err != nil && err != context.Canceled {
+			log.Printf("Enrichment worker stopped: %v", err)
+		}
 		return
 	}
 
+	if *spoolDir != "" {
+		log.Printf("Ingesting files dropped into %s...", *spoolDir)
+		spoolCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		sr := SpoolRunner{
+			Dir:     *spoolDir,
+			Poll:    *spoolPoll,
+			Settle:  *spoolSettle,
+			Reclaim: *spoolReclaim,
+			Store:   store,
+			Options: IngestOptions{
+				Lenient:      *spoolLenient,
+				MaxLineBytes: limits.MaxLineBytes,
+				MaxRecords:   limits.MaxRecords,
+			},
+			DuplicateFiles:        dupPolicy,
+			MaxDecompressionRatio: *gzipRatio,
+			BulkThreshold:         *bulkAbove,
+			Timestamps:            timestamps,
+			Schema:                schema,
+			Decoders:              *decoders,
+			Writers:               *writers,
+		}
+		if err := sr.Run(spoolCtx); err != nil && err != context.Canceled {
+			log.Printf("Spool runner stopped: %v", err)
+		}
+		return
+	}
+
+	// Process async ingest jobs in the background until shutdown
+	jobEvents := NewJobEvents()
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	jobsDone := make(chan struct{})
+	go func() {
+		defer close(jobsDone)
+		runner := JobRunner{
+			Workers:               *jobWorkers,
+			Poll:                  time.Second,
+			Store:                 store,
+			MaxDecompressionRatio: *gzipRatio,
+			BulkThreshold:         *bulkAbove,
+			Timestamps:            timestamps,
+			Schema:                schema,
+			Events:                jobEvents,
+			Decoders:              *decoders,
+			Writers:               *writers,
+			Lease:                 *jobLease,
+		}
+		if err := runner.Run(jobsCtx); err != nil && err != context.Canceled {
+			log.Printf("Job runner stopped: %v", err)
+		}
+	}()
+	go purgeIdempotencyKeys(jobsCtx, store, time.Hour)
+
 	// TODO: Create HTTP server
+	handler := NewServer(store, ServerConfig{
+		MaxDecompressionRatio: *gzipRatio,
+		StreamIdleTimeout:     *streamIdle,
+		BulkThreshold:         *bulkAbove,
+		WebhookSecrets:        webhookSecretsFromEnv(),
+		IdempotencyRetention:  *keyTTL,
+		IdempotencyLease:      *keyLease,
+		DuplicateFiles:        dupPolicy,
+		Timestamps:            timestamps,
+		Schema:                schema,
+		JobEvents:             jobEvents,
+		Decoders:              *decoders,
+		Writers:               *writers,
+		Limits:                limits,
+		ClientLimits:          perClient,
+	})
 	server := &http.Server{
 		Addr:         *addr,
-		Handler:      NewServer(store),
+		Handler:      handler,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
+	server.RegisterOnShutdown(jobEvents.Close)
 
 	// TODO: Implement graceful shutdown
 	go func() {
@@ -89,10 +218,125 @@ func main() {
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
+
+	stopJobs()
+	<-jobsDone
 	
 	log.Println("Server stopped")
 }
 
+// purgeIdempotencyKeys deletes expired Idempotency-Keys every interval until ctx is done
+func purgeIdempotencyKeys(ctx context.Context, store IdempotencyStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := store.PurgeIdempotencyKeys(ctx); err != nil {
+				log.Printf("Purging idempotency keys failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Purged %d expired idempotency keys", n)
+			}
+		}
+	}
+}
+
+// webhookSecretsFromEnv reads the secret of each webhook platform from
+// WEBHOOK_SECRET_<PLATFORM>, e.g. WEBHOOK_SECRET_STEAM
+func webhookSecretsFromEnv() map[string]string {
+	secrets := make(map[string]string)
+	for _, platform := range WebhookPlatforms() {
+		if secret := os.Getenv("WEBHOOK_SECRET_" + strings.ToUpper(platform)); secret != "" {
+			secrets[platform] = secret
+		}
+	}
+	return secrets
+}
+
+// timestampFlags are the flags configuring how created_at values are parsed,
+// shared by the server and the ingest subcommand
+type timestampFlags struct {
+	layouts, timezone, platformTZs, earliest *string
+	maxFuture                                *time.Duration
+}
+
+// addTimestampFlags defines the created_at flags on fs
+func addTimestampFlags(fs *flag.FlagSet) timestampFlags {
+	return timestampFlags{
+		layouts:     fs.String("timestamp-layouts", strings.Join(DefaultTimestampLayouts, "|"), "Accepted created_at layouts in Go time format, separated by |"),
+		timezone:    fs.String("timezone", "UTC", "Timezone of created_at values without a zone"),
+		platformTZs: fs.String("platform-timezones", "", "Per-platform timezones overriding -timezone, e.g. steam=America/Los_Angeles,mobile=Asia/Tokyo"),
+		earliest:    fs.String("earliest-timestamp", "2000-01-01T00:00:00Z", "Reject created_at values before this RFC3339 time (empty disables)"),
+		maxFuture:   fs.Duration("max-future", 24*time.Hour, "Reject created_at values further than this in the future (0 disables)"),
+	}
+}
+
+// parser returns the TimestampParser the parsed flags describe
+func (f timestampFlags) parser() (*TimestampParser, error) {
+	return timestampParserFromFlags(*f.layouts, *f.timezone, *f.platformTZs, *f.earliest, *f.maxFuture)
+}
+
+// limitFlags are the flags bounding the records of each ingest, shared by
+// the server and the ingest subcommand
+type limitFlags struct {
+	maxLine, maxRecords *int
+}
+
+// addLimitFlags defines the record limit flags on fs
+func addLimitFlags(fs *flag.FlagSet) limitFlags {
+	return limitFlags{
+		maxLine:    fs.Int("max-line-bytes", 1<<20, "Longest NDJSON line accepted, in bytes (0 disables)"),
+		maxRecords: fs.Int("max-records", 0, "Most records accepted in one upload or file (0 disables)"),
+	}
+}
+
+// limits returns the IngestLimits the parsed flags describe
+func (f limitFlags) limits() IngestLimits {
+	return IngestLimits{MaxLineBytes: *f.maxLine, MaxRecords: *f.maxRecords}
+}
+
+// connectDB opens a PostgreSQL connection pool and checks that it works
+func connectDB(ctx context.Context, dbURL string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("connect to database: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping database: %w", err)
+	}
+	return db, nil
+}
+
+// timestampParserFromFlags builds the created_at parser from its flags
+func timestampParserFromFlags(layouts, timezone, platformTZs, earliest string, maxFuture time.Duration) (*TimestampParser, error) {
+	tp := &TimestampParser{MaxFuture: maxFuture}
+	for _, layout := range strings.Split(layouts, "|") {
+		if layout = strings.TrimSpace(layout); layout != "" {
+			tp.Layouts = append(tp.Layouts, layout)
+		}
+	}
+
+	var err error
+	if tp.Location, err = time.LoadLocation(timezone); err != nil {
+		return nil, fmt.Errorf("timezone: %w", err)
+	}
+	if tp.PlatformLocations, err = ParsePlatformTimezones(platformTZs); err != nil {
+		return nil, err
+	}
+	if earliest != "" {
+		if tp.Earliest, err = time.Parse(time.RFC3339, earliest); err != nil {
+			return nil, fmt.Errorf("earliest timestamp: %w", err)
+		}
+	}
+	return tp, nil
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
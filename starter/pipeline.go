@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"sync"
+)
+
+// pipelineDepth is the number of records per worker that may be in flight
+// between the stages of a pipeline; a full stage blocks the one before it
+const pipelineDepth = 64
+
+// decodeBatchSize is the most records handed to a decoder at once
+const decodeBatchSize = 64
+
+// rawJSONReader is implemented by JSON decoders whose records can be decoded
+// independently of each other once read, so StreamRecords can decode them
+// on several goroutines
+type rawJSONReader interface {
+	// next returns the next record with only Line, Offset and Raw set; Raw
+	// is valid until the following call
+	next() (RawRecord, error)
+
+	// buffered reports whether input is buffered, so that next is unlikely
+	// to block
+	buffered() bool
+}
+
+// decodeBatch is a run of consecutive records on their way through a
+// decoding pipeline
+type decodeBatch struct {
+	raws []RawRecord
+	recs []Record
+	errs []error
+	done chan struct{} // closed once recs and errs are set
+}
+
+// readBatch reads up to decodeBatchSize records into one buffer. A batch
+// ends early rather than wait for input, so that records of a slow stream
+// are not held back. The error, if any, follows the records returned.
+func readBatch(rr rawJSONReader) (*decodeBatch, error) {
+	var (
+		b    = &decodeBatch{raws: make([]RawRecord, 0, decodeBatchSize), done: make(chan struct{})}
+		buf  = make([]byte, 0, decodeBatchSize*512)
+		ends = make([]int, 0, decodeBatchSize)
+		err  error
+	)
+	for len(b.raws) < decodeBatchSize {
+		if len(b.raws) > 0 && !rr.buffered() {
+			break
+		}
+		var raw RawRecord
+		if raw, err = rr.next(); err != nil {
+			break
+		}
+		buf = append(buf, raw.Raw...)
+		ends = append(ends, len(buf))
+		b.raws = append(b.raws, raw)
+	}
+
+	start := 0
+	for i, end := range ends {
+		b.raws[i].Raw = buf[start:end:end]
+		start = end
+	}
+	return b, err
+}
+
+// decode decodes and validates every record of the batch
+func (b *decodeBatch) decode(opts StreamOptions, pd *PurchaseDecoder) {
+	b.recs = make([]Record, len(b.raws))
+	b.errs = make([]error, len(b.raws))
+	for i := range b.raws {
+		raw := &b.raws[i]
+		current := decodeJSONRecord(raw, pd)
+		b.recs[i], b.errs[i] = validateRecord(*raw, opts, func() error {
+			return checkStrictJSON(current, raw.Input.EventType)
+		})
+	}
+	close(b.done)
+}
+
+// streamParallel is StreamRecords with a reader goroutine, opts.Decoders
+// decoding and validating goroutines, and fn and opts.Reject called on the
+// calling goroutine in file order. When it returns early, a reader blocked
+// in r exits once its read returns.
+func streamParallel(ctx context.Context, rr rawJSONReader, opts StreamOptions, fn func(Record) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		work    = make(chan *decodeBatch, opts.Decoders)
+		ordered = make(chan *decodeBatch, opts.Decoders*pipelineDepth/decodeBatchSize+1)
+		readErr = make(chan error, 1)
+	)
+
+	// The reader hands every batch to the decoders and, in file order, to
+	// the consumer below
+	go func() {
+		defer close(ordered)
+		defer close(work)
+		for {
+			b, err := readBatch(rr)
+			if len(b.raws) > 0 {
+				select {
+				case work <- b:
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case ordered <- b:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr <- err
+				}
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < opts.Decoders; i++ {
+		go func() {
+			pd := NewPurchaseDecoder()
+			for b := range work {
+				b.decode(opts, pd)
+			}
+		}()
+	}
+
+	records := 0
+	for {
+		var b *decodeBatch
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case next, ok := <-ordered:
+			if !ok {
+				select {
+				case err := <-readErr:
+					return err
+				default:
+					return ctx.Err()
+				}
+			}
+			b = next
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-b.done:
+		}
+		for i, raw := range b.raws {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := countRecord(&records, raw, opts); err != nil {
+				return err
+			}
+			if err := deliver(raw, b.recs[i], b.errs[i], opts, fn); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeItem is a record, or a rejected line, waiting to be settled in file order
+type writeItem struct {
+	rec    Record
+	reject *LineError // set for a line rejected before it reached a writer
+	res    UpsertResult
+	err    error
+	done   chan struct{} // closed once res and err are set
+}
+
+// writerPool writes records on several goroutines, each using its own
+// connection from the store's pool. Records with the same transaction_id
+// go to the same writer, so they are applied in file order; their outcomes
+// are settled in file order on the goroutine calling submit and drain.
+type writerPool struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	queues []chan *writeItem
+	wg     sync.WaitGroup
+
+	inflight []*writeItem // in file order
+	window   int          // bound on inflight
+	settle   func(*writeItem) error
+	closed   bool
+}
+
+// newWriterPool starts writers goroutines calling write; close must be
+// called to stop them
+func newWriterPool(ctx context.Context, writers int, write func(context.Context, Record) (UpsertResult, error), settle func(*writeItem) error) *writerPool {
+	ctx, cancel := context.WithCancel(ctx)
+	wp := &writerPool{
+		ctx:    ctx,
+		cancel: cancel,
+		queues: make([]chan *writeItem, writers),
+		window: writers * pipelineDepth,
+		settle: settle,
+	}
+	for i := range wp.queues {
+		q := make(chan *writeItem, pipelineDepth)
+		wp.queues[i] = q
+		wp.wg.Add(1)
+		go func() {
+			defer wp.wg.Done()
+			for it := range q {
+				if it.err = ctx.Err(); it.err == nil {
+					it.res, it.err = write(ctx, it.rec)
+				}
+				close(it.done)
+			}
+		}()
+	}
+	return wp
+}
+
+// submit queues a record for writing, first settling the oldest records
+// while too many are in flight
+func (wp *writerPool) submit(rec Record) error {
+	if err := wp.reserve(); err != nil {
+		return err
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(recordTransactionID(rec)))
+	q := wp.queues[h.Sum32()%uint32(len(wp.queues))]
+
+	it := &writeItem{rec: rec, done: make(chan struct{})}
+	select {
+	case q <- it:
+	case <-wp.ctx.Done():
+		return wp.ctx.Err()
+	}
+	wp.inflight = append(wp.inflight, it)
+	return nil
+}
+
+// submitReject settles a rejected line after the records read before it
+func (wp *writerPool) submitReject(rej LineError) error {
+	it := &writeItem{reject: &rej}
+	if len(wp.inflight) == 0 {
+		return wp.settle(it)
+	}
+	if err := wp.reserve(); err != nil {
+		return err
+	}
+	it.done = make(chan struct{})
+	close(it.done)
+	wp.inflight = append(wp.inflight, it)
+	return nil
+}
+
+// reserve settles records until there is room for one more in flight
+func (wp *writerPool) reserve() error {
+	for len(wp.inflight) >= wp.window {
+		if err := wp.settleOldest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settleOldest waits for the oldest record in flight and settles it
+func (wp *writerPool) settleOldest() error {
+	it := wp.inflight[0]
+	select {
+	case <-it.done:
+	case <-wp.ctx.Done():
+		return wp.ctx.Err()
+	}
+	wp.inflight[0] = nil
+	wp.inflight = wp.inflight[1:]
+	return wp.settle(it)
+}
+
+// drain settles every record in flight
+func (wp *writerPool) drain() error {
+	for len(wp.inflight) > 0 {
+		if err := wp.settleOldest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// committed returns the records left unsettled whose writes committed
+// anyway, once close has stopped the writers
+func (wp *writerPool) committed() []*writeItem {
+	var items []*writeItem
+	for _, it := range wp.inflight {
+		if it.reject == nil && it.err == nil {
+			items = append(items, it)
+		}
+	}
+	return items
+}
+
+// close cancels the writes still in flight and stops the writers. It may
+// be called more than once.
+func (wp *writerPool) close() {
+	if wp.closed {
+		return
+	}
+	wp.closed = true
+	wp.cancel()
+	for _, q := range wp.queues {
+		close(q)
+	}
+	wp.wg.Wait()
+}
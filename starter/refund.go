@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EventType distinguishes purchases from the events that reverse them
+type EventType string
+
+const (
+	EventPurchase   EventType = "purchase"
+	EventRefund     EventType = "refund"
+	EventChargeback EventType = "chargeback"
+)
+
+// Refund is a refund or chargeback of an earlier purchase; a purchase has
+// at most one of each. Once processed, as it is written if the purchase was
+// already enriched or else by the enrichment pipeline, the loyalty points
+// its amount earned have been taken back from the player, so
+// a partial refund takes back part of the purchase's points and a chargeback
+// after it at most the rest.
+type Refund struct {
+	TransactionID string    `json:"transaction_id"` // the purchase being reversed
+	EventType     EventType `json:"event_type"`
+	AmountCents   int       `json:"amount_cents"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	Processed      bool `json:"processed"`
+	PointsEarned   int  `json:"points_earned"`   // points the purchase was credited
+	PointsDue      int  `json:"points_due"`      // points of the amount, at most those not yet taken back
+	PointsDeducted int  `json:"points_deducted"` // points actually taken back
+
+	// DeductionCapped is set when the player's balance was lower than the
+	// points due, so only the available balance was deducted
+	DeductionCapped bool       `json:"deduction_capped"`
+	ProcessedAt     *time.Time `json:"processed_at,omitempty"`
+}
+
+// RefundStore persists refund and chargeback events
+type RefundStore interface {
+	// AddRefund records a refund or chargeback of the purchase it references.
+	// Repeating an unprocessed event of the same type updates it; once
+	// processed it is kept as is and neither Created nor Updated is set.
+	// An event written for a purchase that has already been enriched is
+	// reversed at once, as by ReverseLoyalty, and returned in Reversal;
+	// otherwise the enrichment pipeline reverses it once the purchase has
+	// earned its points. Returns an ErrBadInput error if the referenced
+	// purchase does not exist. The upload checkpoint in ref is advanced as by
+	// AddPurchase.
+	AddRefund(ctx context.Context, r Refund, ref LineRef) (UpsertResult, error)
+
+	// GetRefunds returns the refund and chargeback of a purchase, in the
+	// order they were recorded, or ErrNotFound if it has neither
+	GetRefunds(ctx context.Context, transactionID string) ([]Refund, error)
+}
+
+// refundPoints is the number of points a refund or chargeback takes back:
+// those its amount would have earned as a purchase
+func refundPoints(r Refund) int {
+	return loyaltyPoints(Purchase{AmountCents: r.AmountCents})
+}
+
+// toRefund validates a refund or chargeback event and converts it into a
+// Refund, reading created_at with tp
+func (in PurchaseInput) toRefund(tp *TimestampParser) (Refund, error) {
+	switch {
+	case strings.TrimSpace(in.TransactionID) == "":
+		return Refund{}, fmt.Errorf("%w: transaction_id is required", ErrBadInput)
+	case in.AmountCents < 0:
+		return Refund{}, fmt.Errorf("%w: amount_cents must be >= 0, got %d", ErrBadInput, in.AmountCents)
+	}
+
+	createdAt, err := tp.Parse(in.CreatedAt, "")
+	if err != nil {
+		return Refund{}, err
+	}
+
+	return Refund{
+		TransactionID: in.TransactionID,
+		EventType:     EventType(in.EventType),
+		AmountCents:   in.AmountCents,
+		CreatedAt:     createdAt,
+	}, nil
+}
+
+const refundColumns = `
+	transaction_id, event_type, amount_cents, created_at,
+	processed, points_earned, points_due, points_deducted, deduction_capped, processed_at`
+
+// scanRefund reads a row selected with refundColumns
+func scanRefund(row interface{ Scan(...any) error }) (Refund, error) {
+	var r Refund
+	err := row.Scan(&r.TransactionID, &r.EventType, &r.AmountCents, &r.CreatedAt,
+		&r.Processed, &r.PointsEarned, &r.PointsDue, &r.PointsDeducted, &r.DeductionCapped, &r.ProcessedAt)
+	return r, err
+}
+
+// addRefundSQL records a refund of an existing purchase, defaulting the
+// amount to the full purchase amount, and advances the upload checkpoint.
+// It returns whether the purchase exists and whether it has been enriched
+// and, when the refund was written, whether it was newly inserted and its
+// amount.
+const addRefundSQL = `
+	WITH target AS (
+		SELECT transaction_id, amount_cents, enriched FROM purchases WHERE transaction_id = $1
+	), upserted AS (
+		INSERT INTO refunds (transaction_id, event_type, amount_cents, created_at, ingest_id)
+		SELECT transaction_id, $2, COALESCE(NULLIF($3::int, 0), amount_cents), $4, NULLIF($7::text, '')
+		FROM target
+		ON CONFLICT (transaction_id, event_type) DO UPDATE SET
+			amount_cents = EXCLUDED.amount_cents,
+			created_at   = EXCLUDED.created_at,
+			ingest_id    = EXCLUDED.ingest_id
+		WHERE NOT refunds.processed
+		RETURNING (xmax = 0) AS created, amount_cents
+	), checkpoint AS (
+		INSERT INTO ingest_checkpoints (upload_id, last_line, ingest_id)
+		SELECT $5::text, $6::int, NULLIF($7::text, '')
+		WHERE $5::text <> ''
+		ON CONFLICT (upload_id) DO UPDATE SET
+			last_line  = GREATEST(ingest_checkpoints.last_line, EXCLUDED.last_line),
+			ingest_id  = EXCLUDED.ingest_id,
+			updated_at = NOW()
+	)
+	SELECT EXISTS (SELECT 1 FROM target), COALESCE((SELECT enriched FROM target), FALSE),
+		(SELECT created FROM upserted), (SELECT amount_cents FROM upserted)`
+
+// AddRefund implements RefundStore.AddRefund. The refund stays locked by its
+// write until the reversal commits, so the enrichment pipeline cannot
+// reverse it as well.
+func (s *pgStore) AddRefund(ctx context.Context, r Refund, ref LineRef) (UpsertResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return UpsertResult{}, fmt.Errorf("begin %s for %s: %w", r.EventType, r.TransactionID, err)
+	}
+	defer tx.Rollback()
+
+	var (
+		exists, enriched bool
+		created          sql.NullBool
+		amount           sql.NullInt64
+	)
+	err = tx.QueryRowContext(ctx, addRefundSQL,
+		r.TransactionID, r.EventType, r.AmountCents, r.CreatedAt,
+		ref.UploadID, ref.Line, ref.IngestID,
+	).Scan(&exists, &enriched, &created, &amount)
+	switch {
+	case err != nil:
+		return UpsertResult{}, fmt.Errorf("add %s for %s: %w", r.EventType, r.TransactionID, err)
+	case !exists:
+		return UpsertResult{}, fmt.Errorf("%w: %s references unknown transaction_id %q", ErrBadInput, r.EventType, r.TransactionID)
+	}
+
+	var res UpsertResult
+	switch {
+	case !created.Valid:
+		// Already processed; the reversal cannot be changed any more
+	case enriched:
+		r.AmountCents = int(amount.Int64)
+		reversed, err := reverseRefund(ctx, tx, r)
+		if err != nil {
+			return UpsertResult{}, err
+		}
+		res = UpsertResult{Created: created.Bool, Updated: !created.Bool, Reversal: &reversed}
+	default:
+		res = UpsertResult{Created: created.Bool, Updated: !created.Bool}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return UpsertResult{}, fmt.Errorf("commit %s for %s: %w", r.EventType, r.TransactionID, err)
+	}
+	return res, nil
+}
+
+// GetRefunds implements RefundStore.GetRefunds
+func (s *pgStore) GetRefunds(ctx context.Context, transactionID string) ([]Refund, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT`+refundColumns+` FROM refunds WHERE transaction_id = $1 ORDER BY id`, transactionID)
+	if err != nil {
+		return nil, fmt.Errorf("get refunds of %s: %w", transactionID, err)
+	}
+	defer rows.Close()
+
+	var refunds []Refund
+	for rows.Next() {
+		r, err := scanRefund(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan refund: %w", err)
+		}
+		refunds = append(refunds, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate refunds: %w", err)
+	}
+	if len(refunds) == 0 {
+		return nil, ErrNotFound
+	}
+	return refunds, nil
+}
+
+// ClaimRefundsForReversal implements EnrichmentStore.ClaimRefundsForReversal
+func (s *pgStore) ClaimRefundsForReversal(ctx context.Context, batch int) ([]Refund, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE refunds SET claimed_at = NOW()
+		WHERE id IN (
+			SELECT r.id FROM refunds r
+			JOIN purchases p ON p.transaction_id = r.transaction_id
+			WHERE NOT r.processed AND p.enriched
+				AND (r.claimed_at IS NULL OR r.claimed_at < NOW() - $2 * INTERVAL '1 second')
+			ORDER BY r.id
+			LIMIT $1
+			FOR UPDATE OF r SKIP LOCKED
+		)
+		RETURNING`+refundColumns, batch, enrichClaimLease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("claim refunds: %w", err)
+	}
+	defer rows.Close()
+
+	var refunds []Refund
+	for rows.Next() {
+		r, err := scanRefund(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan refund: %w", err)
+		}
+		refunds = append(refunds, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate refunds: %w", err)
+	}
+	return refunds, nil
+}
+
+// ReverseLoyalty implements EnrichmentStore.ReverseLoyalty
+func (s *pgStore) ReverseLoyalty(ctx context.Context, r Refund) (Refund, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Refund{}, fmt.Errorf("begin reversal of %s: %w", r.TransactionID, err)
+	}
+	defer tx.Rollback()
+
+	var processed bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT processed FROM refunds WHERE transaction_id = $1 AND event_type = $2 FOR UPDATE`,
+		r.TransactionID, r.EventType).Scan(&processed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Refund{}, ErrNotFound
+	}
+	if err != nil {
+		return Refund{}, fmt.Errorf("lock %s of %s: %w", r.EventType, r.TransactionID, err)
+	}
+	if processed {
+		return scanRefund(tx.QueryRowContext(ctx,
+			`SELECT`+refundColumns+` FROM refunds WHERE transaction_id = $1 AND event_type = $2`,
+			r.TransactionID, r.EventType))
+	}
+
+	reversed, err := reverseRefund(ctx, tx, r)
+	if err != nil {
+		return Refund{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Refund{}, fmt.Errorf("commit reversal of %s: %w", r.TransactionID, err)
+	}
+	return reversed, nil
+}
+
+// reverseRefund takes back the points of an unprocessed refund or
+// chargeback whose row tx has locked, and marks it processed
+func reverseRefund(ctx context.Context, tx *sql.Tx, r Refund) (Refund, error) {
+	earned, due, deducted, err := reverseCredit(ctx, tx, r.TransactionID, string(r.EventType), "", refundPoints(r), false)
+	if err != nil {
+		return Refund{}, err
+	}
+
+	reversed, err := scanRefund(tx.QueryRowContext(ctx, `
+		UPDATE refunds SET
+			processed        = TRUE,
+			points_earned    = $3,
+			points_due       = $4,
+			points_deducted  = $5,
+			deduction_capped = $5 < $4,
+			processed_at     = NOW(),
+			claimed_at       = NULL
+		WHERE transaction_id = $1 AND event_type = $2
+		RETURNING`+refundColumns, r.TransactionID, r.EventType, earned, due, deducted))
+	if err != nil {
+		return Refund{}, fmt.Errorf("mark refund %s processed: %w", r.TransactionID, err)
+	}
+	return reversed, nil
+}
+
+// reverseCredit takes up to limit points of the outstanding loyalty credit
+// of a purchase back from its player, or all of it when limit is negative,
+// and records the deduction in the ledger as kind. The credit outstanding is
+// what the purchase earned less what its refunds and chargebacks already
+// deducted. The deduction is capped at the player's balance, since
+// loyalty_points may not go negative. With release, the credit is marked
+// reversed so the purchase can earn points again. A purchase that was never
+// credited has nothing to reverse.
+func reverseCredit(ctx context.Context, tx *sql.Tx, transactionID, kind, ingestID string, limit int, release bool) (earned, due, deducted int, err error) {
+	var (
+		creditID int64
+		playerID string
+		taken    int
+	)
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, player_id, points FROM loyalty_ledger
+		WHERE transaction_id = $1 AND kind = 'purchase' AND NOT reversed
+		FOR UPDATE`, transactionID).Scan(&creditID, &playerID, &earned)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("get loyalty credit of %s: %w", transactionID, err)
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(-SUM(points), 0) FROM loyalty_ledger
+		WHERE transaction_id = $1 AND kind IN ('refund', 'chargeback') AND id > $2`,
+		transactionID, creditID).Scan(&taken)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("get reversals of %s: %w", transactionID, err)
+	}
+	due = max(earned-taken, 0)
+	if limit >= 0 {
+		due = min(due, limit)
+	}
+
+	var balance int
+	err = tx.QueryRowContext(ctx,
+		`SELECT loyalty_points FROM player_loyalty WHERE player_id = $1 FOR UPDATE`, playerID).Scan(&balance)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, 0, fmt.Errorf("lock loyalty of %s: %w", playerID, err)
+	}
+	deducted = min(due, balance)
+
+	if deducted > 0 {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE player_loyalty
+			SET loyalty_points = loyalty_points - $2, updated_at = NOW()
+			WHERE player_id = $1`, playerID, deducted)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("deduct loyalty of %s: %w", playerID, err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO loyalty_ledger (player_id, transaction_id, kind, points, ingest_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''))`, playerID, transactionID, kind, -deducted, ingestID)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("record %s of %s: %w", kind, transactionID, err)
+	}
+
+	if release {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE loyalty_ledger SET reversed = TRUE WHERE id = $1`, creditID); err != nil {
+			return 0, 0, 0, fmt.Errorf("release loyalty credit of %s: %w", transactionID, err)
+		}
+	}
+	return earned, due, deducted, nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// RollbackConflict is a row the batch wrote that has changed since, so
+// rolling it back would discard later work
+type RollbackConflict struct {
+	TransactionID string `json:"transaction_id"`
+	Reason        string `json:"reason"`
+	IngestID      string `json:"ingest_id,omitempty"` // the later ingest that touched the row, if any
+}
+
+// RollbackResult is the outcome of rolling back an ingest batch
+type RollbackResult struct {
+	IngestID string `json:"ingest_id"`
+	Deleted  int    `json:"deleted"`  // purchases the batch created
+	Restored int    `json:"restored"` // purchases the batch updated, back to their prior image
+	Refunds  int    `json:"refunds"`  // unprocessed refunds the batch recorded
+
+	// Loyalty credits taken back from purchases the enrichment worker had
+	// already credited; capped deductions are those limited by the balance
+	PointsDeducted   int `json:"points_deducted"`
+	DeductionsCapped int `json:"deductions_capped,omitempty"`
+
+	// Conflicts lists rows touched since the batch. Unless they are skipped,
+	// any conflict aborts the rollback without changing anything.
+	Conflicts  []RollbackConflict `json:"conflicts,omitempty"`
+	RolledBack bool               `json:"rolled_back"`
+}
+
+// RollbackStore undoes ingest batches
+type RollbackStore interface {
+	// RollbackIngest deletes the purchases an ingest created, restores the
+	// ones it updated to their prior image, drops its unprocessed refunds and
+	// takes back loyalty points those purchases earned, in one transaction.
+	// Rows changed since by other ingests or refunds are reported as
+	// conflicts: with skipConflicts they are left alone, otherwise nothing is
+	// changed. Returns ErrNotFound if the ingest wrote nothing that remains.
+	RollbackIngest(ctx context.Context, ingestID string, skipConflicts bool) (RollbackResult, error)
+}
+
+// handleRollbackBatch rolls back everything an ingest batch wrote. Conflicts
+// abort the rollback with 409 unless ?skip_conflicts=true.
+func (s *Server) handleRollbackBatch(w http.ResponseWriter, r *http.Request) {
+	ingestID := r.PathValue("id")
+
+	skipConflicts, err := parseBoolParam(r, "skip_conflicts")
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.store.RollbackIngest(r.Context(), ingestID, skipConflicts)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("rollback of ingest %s failed: %v", ingestID, err)
+		}
+		writeJSONError(w, "Failed to roll back ingest", statusForError(err))
+		return
+	}
+
+	if !result.RolledBack {
+		writeJSON(w, http.StatusConflict, result)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// batchRowsSQL locks every purchase ingest $1 wrote, together with the image
+// before its first update by the ingest (NULL if the ingest inserted it) and
+// the state of the refund or chargeback of it that most stands in the way:
+// one recorded by another ingest, else a processed one
+const batchRowsSQL = `
+	WITH first_revision AS (
+		SELECT DISTINCT ON (purchase_id) purchase_id, previous
+		FROM purchase_revisions
+		WHERE ingest_id = $1
+		ORDER BY purchase_id, id
+	)
+	SELECT p.id, p.transaction_id, COALESCE(p.ingest_id, ''), p.enriched, fr.previous,
+		r.transaction_id IS NOT NULL, COALESCE(r.ingest_id, ''), COALESCE(r.processed, FALSE)
+	FROM purchases p
+	LEFT JOIN first_revision fr ON fr.purchase_id = p.id
+	LEFT JOIN LATERAL (
+		SELECT transaction_id, ingest_id, processed FROM refunds
+		WHERE transaction_id = p.transaction_id
+		ORDER BY ingest_id IS NOT DISTINCT FROM $1, NOT processed
+		LIMIT 1
+	) r ON TRUE
+	WHERE p.ingest_id = $1 OR fr.purchase_id IS NOT NULL
+	ORDER BY p.id
+	FOR UPDATE OF p`
+
+// restorePurchaseSQL puts the ingested columns and provenance of a purchase
+// back to a revision image
+const restorePurchaseSQL = `
+	UPDATE purchases p SET
+		player_id         = prev.player_id,
+		player_username   = prev.player_username,
+		game_title        = prev.game_title,
+		item_type         = prev.item_type,
+		genre             = prev.genre,
+		platform          = prev.platform,
+		amount_cents      = prev.amount_cents,
+		currency          = prev.currency,
+		player_level      = prev.player_level,
+		created_at        = prev.created_at,
+		enriched          = prev.enriched,
+		enrich_claimed_at = NULL,
+		ingest_id         = prev.ingest_id,
+		ingest_source     = prev.ingest_source,
+		source_file       = prev.source_file,
+		source_line       = prev.source_line
+	FROM jsonb_populate_record(NULL::purchases, $2::jsonb) prev
+	WHERE p.id = $1`
+
+// batchRow is a purchase written by the ingest being rolled back
+type batchRow struct {
+	id            int64
+	transactionID string
+	ingestID      string // ingest that last wrote the row
+	enriched      bool
+	previous      []byte // image before the batch; nil if the batch created the row
+	prevImage     Purchase
+
+	refunded        bool
+	refundIngestID  string
+	refundProcessed bool
+}
+
+// RollbackIngest implements RollbackStore.RollbackIngest
+func (s *pgStore) RollbackIngest(ctx context.Context, ingestID string, skipConflicts bool) (RollbackResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, bulkMergeTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return RollbackResult{}, fmt.Errorf("begin rollback of %s: %w", ingestID, err)
+	}
+	defer tx.Rollback()
+
+	rows, err := s.batchRows(ctx, tx, ingestID)
+	if err != nil {
+		return RollbackResult{}, err
+	}
+
+	var refunds int
+	err = tx.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM refunds WHERE ingest_id = $1 AND NOT processed`, ingestID).Scan(&refunds)
+	if err != nil {
+		return RollbackResult{}, fmt.Errorf("count refunds of %s: %w", ingestID, err)
+	}
+	if len(rows) == 0 && refunds == 0 {
+		return RollbackResult{}, ErrNotFound
+	}
+
+	result := RollbackResult{IngestID: ingestID}
+	var clean []batchRow
+	seen := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		seen[row.transactionID] = true
+		if c, ok := rollbackConflict(ingestID, row); ok {
+			result.Conflicts = append(result.Conflicts, c)
+			continue
+		}
+		clean = append(clean, row)
+	}
+
+	// Processed refunds the batch recorded against purchases of other
+	// ingests already took points back
+	conflicts, err := tx.QueryContext(ctx,
+		`SELECT transaction_id FROM refunds WHERE ingest_id = $1 AND processed ORDER BY id`, ingestID)
+	if err != nil {
+		return RollbackResult{}, fmt.Errorf("query processed refunds of %s: %w", ingestID, err)
+	}
+	for conflicts.Next() {
+		c := RollbackConflict{Reason: "refund was already processed"}
+		if err := conflicts.Scan(&c.TransactionID); err != nil {
+			conflicts.Close()
+			return RollbackResult{}, fmt.Errorf("scan processed refund: %w", err)
+		}
+		if seen[c.TransactionID] {
+			continue
+		}
+		result.Conflicts = append(result.Conflicts, c)
+	}
+	conflicts.Close()
+	if err := conflicts.Err(); err != nil {
+		return RollbackResult{}, fmt.Errorf("iterate processed refunds: %w", err)
+	}
+
+	if len(result.Conflicts) > 0 && !skipConflicts {
+		return result, nil
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM refunds WHERE ingest_id = $1 AND NOT processed`, ingestID)
+	if err != nil {
+		return RollbackResult{}, fmt.Errorf("delete refunds of %s: %w", ingestID, err)
+	}
+	if n, err := res.RowsAffected(); err == nil {
+		result.Refunds = int(n)
+	}
+
+	for _, row := range clean {
+		if err := s.rollbackRow(ctx, tx, ingestID, row, &result); err != nil {
+			return RollbackResult{}, err
+		}
+	}
+
+	// The file can be ingested again without being flagged as a duplicate
+	if _, err := tx.ExecContext(ctx, `DELETE FROM ingest_files WHERE ingest_id = $1`, ingestID); err != nil {
+		return RollbackResult{}, fmt.Errorf("delete ingest file of %s: %w", ingestID, err)
+	}
+
+	// A resumable upload the ingest failed part-way through starts over when
+	// it is sent again, rather than skipping the lines rolled back
+	if _, err := tx.ExecContext(ctx, `DELETE FROM ingest_checkpoints WHERE ingest_id = $1`, ingestID); err != nil {
+		return RollbackResult{}, fmt.Errorf("delete checkpoint of %s: %w", ingestID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return RollbackResult{}, fmt.Errorf("commit rollback of %s: %w", ingestID, err)
+	}
+	result.RolledBack = true
+	return result, nil
+}
+
+// batchRows loads and locks the purchases an ingest wrote
+func (s *pgStore) batchRows(ctx context.Context, tx *sql.Tx, ingestID string) ([]batchRow, error) {
+	rows, err := tx.QueryContext(ctx, batchRowsSQL, ingestID)
+	if err != nil {
+		return nil, fmt.Errorf("query purchases of %s: %w", ingestID, err)
+	}
+	defer rows.Close()
+
+	var batch []batchRow
+	for rows.Next() {
+		var row batchRow
+		err := rows.Scan(&row.id, &row.transactionID, &row.ingestID, &row.enriched, &row.previous,
+			&row.refunded, &row.refundIngestID, &row.refundProcessed)
+		if err != nil {
+			return nil, fmt.Errorf("scan purchase of %s: %w", ingestID, err)
+		}
+		if row.previous != nil {
+			if err := json.Unmarshal(row.previous, &row.prevImage); err != nil {
+				return nil, fmt.Errorf("decode revision of %s: %w", row.transactionID, err)
+			}
+			// A revision of a row the batch itself inserted, e.g. by a
+			// repeated transaction_id, means the batch created it
+			if row.prevImage.IngestID == ingestID {
+				row.previous = nil
+			}
+		}
+		batch = append(batch, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate purchases of %s: %w", ingestID, err)
+	}
+	return batch, nil
+}
+
+// rollbackConflict reports whether a row the batch wrote was changed since
+func rollbackConflict(ingestID string, row batchRow) (RollbackConflict, bool) {
+	c := RollbackConflict{TransactionID: row.transactionID}
+	switch {
+	case row.ingestID != ingestID:
+		c.Reason = "updated by a later ingest"
+		c.IngestID = row.ingestID
+	case row.refunded && row.refundIngestID != ingestID:
+		c.Reason = "refunded by a later ingest"
+		c.IngestID = row.refundIngestID
+	case row.refunded && row.refundProcessed:
+		c.Reason = "refund was already processed"
+	default:
+		return RollbackConflict{}, false
+	}
+	return c, true
+}
+
+// rollbackRow deletes or restores one purchase and takes back loyalty points
+// that no longer apply
+func (s *pgStore) rollbackRow(ctx context.Context, tx *sql.Tx, ingestID string, row batchRow, result *RollbackResult) error {
+	created := row.previous == nil
+
+	// An updated row keeps a credit earned before the batch; one earned
+	// since is reversed and the row is enriched again from its prior image
+	if row.enriched && (created || !row.prevImage.Enriched) {
+		_, due, deducted, err := reverseCredit(ctx, tx, row.transactionID, "rollback", ingestID, -1, true)
+		if err != nil {
+			return err
+		}
+		result.PointsDeducted += deducted
+		if deducted < due {
+			result.DeductionsCapped++
+		}
+	}
+
+	if created {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM purchases WHERE id = $1`, row.id); err != nil {
+			return fmt.Errorf("delete purchase %s: %w", row.transactionID, err)
+		}
+		result.Deleted++
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, restorePurchaseSQL, row.id, row.previous); err != nil {
+		return fmt.Errorf("restore purchase %s: %w", row.transactionID, err)
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM purchase_revisions WHERE purchase_id = $1 AND ingest_id = $2`, row.id, ingestID); err != nil {
+		return fmt.Errorf("delete revisions of %s: %w", row.transactionID, err)
+	}
+	result.Restored++
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SchemaPolicy decides which records are checked in strict schema mode,
+// where unknown fields and absent required fields are rejected instead of
+// being ignored or read as zero values
+type SchemaPolicy struct {
+	// Strict checks every record, unless its platform says otherwise
+	Strict bool
+
+	// Platforms overrides Strict for the records of a platform, e.g. to
+	// tolerate a feed that adds fields of its own. Refunds have no platform.
+	Platforms map[string]bool
+}
+
+// strict reports whether records of a platform are checked strictly
+func (sp SchemaPolicy) strict(platform string) bool {
+	if strict, ok := sp.Platforms[platform]; ok {
+		return strict
+	}
+	return sp.Strict
+}
+
+// ParseSchemaPlatforms parses a comma-separated list of platform=mode pairs,
+// where mode is strict or lenient, e.g. "steam=strict,mobile=lenient"
+func ParseSchemaPlatforms(spec string) (map[string]bool, error) {
+	platforms := make(map[string]bool)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		platform, mode, ok := strings.Cut(pair, "=")
+		platform = strings.TrimSpace(platform)
+		if !ok {
+			return nil, fmt.Errorf("%w: schema mode %q is not platform=mode", ErrBadInput, pair)
+		}
+		if !validPlatforms[platform] {
+			return nil, fmt.Errorf("%w: invalid platform %q in schema modes", ErrBadInput, platform)
+		}
+		switch strings.TrimSpace(mode) {
+		case "strict":
+			platforms[platform] = true
+		case "lenient":
+			platforms[platform] = false
+		default:
+			return nil, fmt.Errorf("%w: schema mode of %s must be strict or lenient, got %q", ErrBadInput, platform, mode)
+		}
+	}
+	return platforms, nil
+}
+
+// FieldError is a record rejected because of one of its fields
+type FieldError struct {
+	Field  string
+	Reason string
+	Err    error // ErrBadInput or ErrInvalidFormat
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%v: field %q %s", e.Err, e.Field, e.Reason)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Fields every record must have in strict mode, by event type; the others
+// (player_username, genre, currency, event_type and a refund's amount_cents)
+// are optional
+var (
+	requiredPurchaseFields = []string{
+		"transaction_id", "player_id", "game_title", "item_type", "platform",
+		"amount_cents", "player_level", "created_at",
+	}
+	requiredRefundFields = []string{"transaction_id", "created_at"}
+)
+
+// requiredFields returns the fields a record of an event type must have
+func requiredFields(eventType string) []string {
+	switch EventType(eventType) {
+	case EventRefund, EventChargeback:
+		return requiredRefundFields
+	default:
+		return requiredPurchaseFields
+	}
+}
+
+// strictChecker is implemented by decoders that can check the record last
+// returned by Next against the schema in strict mode
+type strictChecker interface {
+	checkStrict(rec RawRecord) error
+}
+
+// strictPurchaseInput mirrors PurchaseInput with pointer fields, so that an
+// absent field stays nil instead of decoding to its zero value
+type strictPurchaseInput struct {
+	TransactionID  *string    `json:"transaction_id"`
+	PlayerID       *string    `json:"player_id"`
+	PlayerUsername *string    `json:"player_username"`
+	GameTitle      *string    `json:"game_title"`
+	ItemType       *string    `json:"item_type"`
+	Genre          *string    `json:"genre"`
+	Platform       *string    `json:"platform"`
+	AmountCents    *int       `json:"amount_cents"`
+	Currency       *string    `json:"currency"`
+	PlayerLevel    *int       `json:"player_level"`
+	CreatedAt      *Timestamp `json:"created_at"`
+	EventType      *string    `json:"event_type"`
+	SchemaVersion  *int       `json:"schema_version"`
+}
+
+// present reports whether a field was given with a non-null value
+func (in strictPurchaseInput) present(field string) bool {
+	switch field {
+	case "transaction_id":
+		return in.TransactionID != nil
+	case "player_id":
+		return in.PlayerID != nil
+	case "game_title":
+		return in.GameTitle != nil
+	case "item_type":
+		return in.ItemType != nil
+	case "platform":
+		return in.Platform != nil
+	case "amount_cents":
+		return in.AmountCents != nil
+	case "player_level":
+		return in.PlayerLevel != nil
+	case "created_at":
+		return in.CreatedAt != nil
+	}
+	return true
+}
+
+// checkStrictJSON decodes a JSON record again, rejecting fields that
+// PurchaseInput does not have and required fields that are absent or null
+func checkStrictJSON(raw []byte, eventType string) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+
+	var in strictPurchaseInput
+	if err := dec.Decode(&in); err != nil {
+		// The lenient decode already succeeded, so this is the unknown field
+		if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return &FieldError{Field: strings.Trim(name, `"`), Reason: "is not part of the schema", Err: ErrBadInput}
+		}
+		return fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+	}
+
+	for _, field := range requiredFields(eventType) {
+		if !in.present(field) {
+			return &FieldError{Field: field, Reason: "is required", Err: ErrBadInput}
+		}
+	}
+	return nil
+}
+
+func (d *ndjsonDecoder) checkStrict(rec RawRecord) error {
+	return checkStrictJSON(d.current, rec.Input.EventType)
+}
+
+func (d *jsonArrayDecoder) checkStrict(rec RawRecord) error {
+	return checkStrictJSON(d.current, rec.Input.EventType)
+}
+
+// checkStrict rejects header columns that are not part of the schema, and
+// required fields whose column is missing or whose cell is empty
+func (d *csvDecoder) checkStrict(rec RawRecord) error {
+	if d.unknown != "" {
+		return &FieldError{Field: d.unknown, Reason: "is not part of the schema", Err: ErrBadInput}
+	}
+	for _, field := range requiredFields(rec.Input.EventType) {
+		if !d.filled[field] {
+			return &FieldError{Field: field, Reason: "is required", Err: ErrBadInput}
+		}
+	}
+	return nil
+}
+
+// fieldOf returns the field a validation error is about, if it names one
+func fieldOf(err error) string {
+	var fe *FieldError
+	if errors.As(err, &fe) {
+		return fe.Field
+	}
+	return ""
+}
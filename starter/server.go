@@ -1,24 +1,94 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Server wraps the HTTP handlers with dependencies
 type Server struct {
-	store PurchaseStore
+	store Store
+	cfg   ServerConfig
+}
+
+// ServerConfig holds the tunable settings of the HTTP server
+type ServerConfig struct {
+	MaxDecompressionRatio float64 // cap on decompressed/compressed size of gzip uploads
+	BulkThreshold         int     // uploads with more records use the COPY bulk path (0 = never)
+
+	// StreamIdleTimeout is how long /ingest and /ingest/stream wait for more
+	// of a request body before giving up; it replaces the server read/write
+	// timeouts on those endpoints, as uploads may take longer than them
+	StreamIdleTimeout time.Duration
+
+	// WebhookSecrets holds the HMAC secret of each platform; webhooks of
+	// platforms without a secret are refused
+	WebhookSecrets map[string]string
+
+	// IdempotencyRetention is how long an Idempotency-Key and the response
+	// stored under it are kept
+	IdempotencyRetention time.Duration
+
+	// IdempotencyLease is how long a request holds its Idempotency-Key
+	// without renewing it; a retry takes over a key whose request crashed
+	// once the lease has run out (0 = defaultIdempotencyLease)
+	IdempotencyLease time.Duration
+
+	// DuplicateFiles decides whether re-uploads of an already ingested file
+	// to /ingest are ingested with a warning or refused
+	DuplicateFiles DuplicateFilePolicy
+
+	// Timestamps parses the created_at of ingested records; nil uses the defaults
+	Timestamps *TimestampParser
+
+	// Schema selects the records of uploads checked in strict schema mode;
+	// ?strict=true checks all records of an upload
+	Schema SchemaPolicy
+
+	// Decoders and Writers size the ingest pipeline: the goroutines decoding
+	// and validating records, and those writing them to the store
+	Decoders int
+	Writers  int
+
+	// JobEvents follows the async ingest jobs run by this process, for
+	// /ingest/jobs/{id}/events; nil follows every job through the store
+	JobEvents *JobEvents
+
+	// Limits bound each /ingest request; ClientLimits replaces them for the
+	// clients listed, keyed by client address.
+	// /ingest/stream is a feed, so only MaxLineBytes applies there.
+	Limits       IngestLimits
+	ClientLimits map[string]IngestLimits
 }
 
 // NewServer creates a new HTTP server with routes
-func NewServer(store PurchaseStore) http.Handler {
-	s := &Server{store: store}
+func NewServer(store Store, cfg ServerConfig) http.Handler {
+	s := &Server{store: store, cfg: cfg}
 	
 	mux := http.NewServeMux()
 	
 	// TODO: Add middleware (logging, request ID, etc.)
 	mux.HandleFunc("POST /ingest", s.handleIngest)
+	mux.HandleFunc("POST /ingest/stream", s.handleIngestStream)
+	mux.HandleFunc("GET /ingest/batches/{id}/rejects", s.handleGetRejects)
+	mux.HandleFunc("POST /ingest/batches/{id}/rollback", s.handleRollbackBatch)
+	mux.HandleFunc("GET /ingest/jobs/{id}", s.handleGetJob)
+	mux.HandleFunc("GET /ingest/jobs/{id}/events", s.handleJobEvents)
+	mux.HandleFunc("POST /webhooks/{platform}", s.handleWebhook)
 	mux.HandleFunc("GET /purchases", s.handleListPurchases)
+	mux.HandleFunc("GET /purchases/{transaction_id}", s.handleGetPurchase)
+	mux.HandleFunc("GET /purchases/{transaction_id}/history", s.handlePurchaseHistory)
+	mux.HandleFunc("GET /purchases/{transaction_id}/refund", s.handlePurchaseRefund)
 	
 	
 	return mux
@@ -26,9 +96,97 @@ func NewServer(store PurchaseStore) http.Handler {
 
 // IngestResponse represents the response from file ingestion
 type IngestResponse struct {
-	Created int `json:"created"`
-	Updated int `json:"updated"`
-	Total   int `json:"total"`
+	IngestID string `json:"ingest_id"`
+	Created  int    `json:"created"`
+	Updated  int    `json:"updated"`
+	Rejected int    `json:"rejected"`
+	Total    int    `json:"total"`             // records read, including rejected ones
+	Skipped  int    `json:"skipped,omitempty"` // lines committed by an earlier attempt of a resumable upload
+
+	// Outcomes of repeated transaction_ids under the conflict policy
+	Ignored    int        `json:"ignored,omitempty"`    // kept the stored version
+	Conflicted int        `json:"conflicted,omitempty"` // differed from the stored version under reject-on-diff
+	Conflicts  []Conflict `json:"conflicts,omitempty"`  // the first maxReportedConflicts of them
+
+	// Reversals counts the refund and chargeback events recorded, and
+	// ReversalsIgnored those left out because the same event of the purchase
+	// was already processed; they are counted as created, updated or ignored too
+	Reversals        int `json:"reversals,omitempty"`
+	ReversalsIgnored int `json:"reversals_ignored,omitempty"`
+
+	// Of the reversals recorded, ReversalsPending counts those left to the
+	// enrichment pipeline as their purchase has not earned its points yet;
+	// the others were applied during the ingest. DeductionsCapped counts those
+	// whose deduction was capped at the player's balance, and CappedTransactions
+	// lists the transaction_ids of the first maxReportedConflicts of them.
+	ReversalsPending   int      `json:"reversals_pending,omitempty"`
+	DeductionsCapped   int      `json:"deductions_capped,omitempty"`
+	CappedTransactions []string `json:"capped_transactions,omitempty"`
+
+	// SchemaVersions counts the ingested records by the schema_version they
+	// were sent with
+	SchemaVersions map[int]int `json:"schema_versions,omitempty"`
+
+	// DuplicateOf is the earlier ingest of the same file, if any
+	DuplicateOf *IngestFile `json:"duplicate_of,omitempty"`
+}
+
+// maxReportedConflicts bounds the conflict details carried in one response
+const maxReportedConflicts = 1000
+
+// tally recomputes Total from the individual counts
+func (r *IngestResponse) tally() {
+	r.Total = r.Created + r.Updated + r.Ignored + r.Conflicted + r.Rejected
+}
+
+// addConflict counts a conflict and keeps its details while there is room
+func (r *IngestResponse) addConflict(c Conflict) {
+	r.Conflicted++
+	if len(r.Conflicts) < maxReportedConflicts {
+		r.Conflicts = append(r.Conflicts, c)
+	}
+}
+
+// addReversal counts the outcome of a refund or chargeback record
+func (r *IngestResponse) addReversal(rec Record, res UpsertResult) {
+	switch {
+	case rec.Refund == nil:
+	case res.Created || res.Updated:
+		r.Reversals++
+		switch {
+		case res.Reversal == nil:
+			r.ReversalsPending++
+		case res.Reversal.DeductionCapped:
+			r.DeductionsCapped++
+			if len(r.CappedTransactions) < maxReportedConflicts {
+				r.CappedTransactions = append(r.CappedTransactions, rec.Refund.TransactionID)
+			}
+		}
+	default:
+		r.ReversalsIgnored++
+	}
+}
+
+// addVersions counts n ingested records of a schema_version
+func (r *IngestResponse) addVersions(version, n int) {
+	if r.SchemaVersions == nil {
+		r.SchemaVersions = make(map[int]int)
+	}
+	r.SchemaVersions[version] += n
+}
+
+// IngestErrorResponse is returned when an ingest fails part-way; the counts
+// cover the records committed before the failure
+type IngestErrorResponse struct {
+	Error string      `json:"error"`
+	Limit *LimitError `json:"limit,omitempty"` // the limit that stopped the ingest, if any
+	IngestResponse
+}
+
+// ErrorResponse is the body of an error response
+type ErrorResponse struct {
+	Error string      `json:"error"`
+	Limit *LimitError `json:"limit,omitempty"` // the limit the request exceeded, if any
 }
 
 // ListPurchasesResponse represents the response from listing purchases
@@ -37,78 +195,487 @@ type ListPurchasesResponse struct {
 	NextAfterID int64      `json:"next_after_id,omitempty"`
 }
 
-// handleIngest processes file uploads (NDJSON only)
+// handleIngest processes file uploads.
+// With ?lenient=true invalid lines are skipped and can be fetched afterwards
+// from /ingest/batches/{id}/rejects; otherwise the first invalid line aborts.
+// With ?async=true the upload is queued as a job and 202 is returned at once.
+// The format (NDJSON, a JSON array, CSV or TSV) is chosen by the part's
+// Content-Type or the file extension, defaulting to NDJSON.
+// Gzipped files are decompressed on the fly. ?conflict_policy= selects how
+// repeated transaction_ids are resolved (see ConflictPolicy). An Upload-ID
+// header, or ?resumable=true to key on the file's content hash, lets a failed
+// upload be resent and continue after its last committed line. Requests
+// with an Idempotency-Key header are ingested at most once per key.
+// Re-uploads of a file that was ingested before, gzipped or not, are reported
+// in duplicate_of or refused with 409 before anything is written, depending
+// on ServerConfig.DuplicateFiles; ?allow_duplicate=true ingests a refused
+// file anyway. With ?strict=true, records with unknown
+// fields or without a required field are rejected, as they are for the
+// platforms ServerConfig.Schema makes strict. With ?dry_run=true the file is only
+// validated and its outcome predicted, with the rejected lines included in
+// the response; nothing is written.
+// Requests exceeding the sender's IngestLimits get 413 with the limit.
 func (s *Server) handleIngest(w http.ResponseWriter, r *http.Request) {
-	// TODO: Parse multipart form file upload
-	// Stream parse the NDJSON file without loading it all into memory
-	// Use StreamNDJSON parser
-	// Track created vs updated counts
-	// Return IngestResponse as JSON
-	
-	file, _, err := r.FormFile("file")
+	dryRun, err := parseBoolParam(r, "dry_run")
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.extendDeadlines(w, r)
+	if err := s.limitsFor(r).parseMultipart(w, r); err != nil {
+		var limit *LimitError
+		if errors.As(err, &limit) {
+			writeLimitError(w, limit)
+			return
+		}
+		writeJSONError(w, "Missing or invalid file", http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		s.ingestDryRun(w, r)
+		return
+	}
+
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		s.withIdempotencyKey(w, r, key, s.ingestUpload)
+		return
+	}
+	s.ingestUpload(w, r)
+}
+
+// ingestUpload runs a multipart ingest request; see handleIngest
+func (s *Server) ingestUpload(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseIngestOptions(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	async, err := parseBoolParam(r, "async")
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resumable, err := parseBoolParam(r, "resumable")
 	if err != nil {
-		http.Error(w, "Missing or invalid file", http.StatusBadRequest)
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	allowDuplicate, err := parseBoolParam(r, "allow_duplicate")
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limits := s.limitsFor(r)
+	opts.MaxLineBytes, opts.MaxRecords = limits.MaxLineBytes, limits.MaxRecords
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeJSONError(w, "Missing or invalid file", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
-	
-	// TODO: Call StreamNDJSON parser
-	// TODO: Count operations and return response
-	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(IngestResponse{
-		Created: 0,
-		Updated: 0,
-		Total:   0,
+
+	if opts.UploadID == "" && resumable {
+		if opts.UploadID, err = hashUpload(file); err != nil {
+			writeJSONError(w, "Failed to read file", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	opts.RefuseDuplicate = s.cfg.DuplicateFiles == DuplicateFilesRefuse && !allowDuplicate
+	opts.Uploader = uploaderOf(r)
+	opts.Format = DetectFormat(header.Header.Get("Content-Type"), header.Filename).Name
+
+	ingestID, err := newIngestID()
+	if err != nil {
+		writeJSONError(w, "Failed to start ingest", http.StatusInternalServerError)
+		return
+	}
+
+	ing := Ingester{
+		Store:                 s.store,
+		Options:               opts,
+		ContentEncoding:       header.Header.Get("Content-Encoding"),
+		MaxDecompressionRatio: s.cfg.MaxDecompressionRatio,
+		BulkThreshold:         s.cfg.BulkThreshold,
+		FileName:              header.Filename,
+		Source:                SourceMultipart,
+		Timestamps:            s.cfg.Timestamps,
+		Schema:                s.cfg.Schema,
+		Decoders:              s.cfg.Decoders,
+		Writers:               s.cfg.Writers,
+	}
+
+	if async {
+		// The job reads its upload back from the store, which cannot seek
+		resp := IngestResponse{IngestID: ingestID}
+		if err := ing.refuseDuplicate(r.Context(), file, &resp); err != nil {
+			log.Printf("ingest %s refused: %v", ingestID, err)
+			writeIngestError(w, resp, err)
+			return
+		}
+		job, err := s.store.CreateJob(r.Context(), IngestJob{
+			ID:              ingestID,
+			FileName:        header.Filename,
+			ContentEncoding: header.Header.Get("Content-Encoding"),
+			Options:         opts,
+		}, file)
+		if err != nil {
+			log.Printf("ingest %s: queueing job failed: %v", ingestID, err)
+			writeJSONError(w, "Failed to queue ingest job", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", "/ingest/jobs/"+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
+		return
+	}
+
+	resp, err := ing.Run(r.Context(), ingestID, file)
+	if err != nil {
+		log.Printf("ingest %s failed: %v", ingestID, err)
+		writeIngestError(w, resp, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleIngestStream ingests a raw request body in any registered format,
+// selected by its Content-Type (usually application/x-ndjson), including
+// chunked uploads. Each record is committed as soon as it arrives, so a
+// producer can keep one request open as a continuous feed. A feed resent with
+// the same Upload-ID header resumes after its last committed line.
+//
+// The ingest ID is announced up front in the Ingest-ID header of an interim
+// 103 response, and rejected lines are saved at least every
+// streamRejectFlushInterval, so a feed's rejects can be followed at
+// /ingest/batches/{id}/rejects while it runs.
+func (s *Server) handleIngestStream(w http.ResponseWriter, r *http.Request) {
+	format, ok := formatForMediaType(r.Header.Get("Content-Type"))
+	if !ok {
+		writeJSONError(w, "Content-Type must be one of "+strings.Join(formatMediaTypes(), ", "), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	opts, err := parseIngestOptions(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.Format = format.Name
+	opts.MaxLineBytes = s.limitsFor(r).MaxLineBytes
+
+	ingestID, err := newIngestID()
+	if err != nil {
+		writeJSONError(w, "Failed to start ingest", http.StatusInternalServerError)
+		return
+	}
+
+	// A feed may legitimately outlive the server timeouts
+	s.extendDeadlines(w, r)
+
+	w.Header().Set("Ingest-ID", ingestID)
+	if r.ProtoAtLeast(1, 1) {
+		w.WriteHeader(http.StatusEarlyHints)
+	}
+
+	// No bulk path here: it would hold records back until the feed ends
+
+	ing := Ingester{
+		Store:                 s.store,
+		Options:               opts,
+		ContentEncoding:       r.Header.Get("Content-Encoding"),
+		MaxDecompressionRatio: s.cfg.MaxDecompressionRatio,
+		Source:                SourceStream,
+		Timestamps:            s.cfg.Timestamps,
+		Schema:                s.cfg.Schema,
+		Decoders:              s.cfg.Decoders,
+		Writers:               s.cfg.Writers,
+		RejectFlushInterval:   streamRejectFlushInterval,
+	}
+	resp, err := ing.Run(r.Context(), ingestID, r.Body)
+	if err != nil {
+		log.Printf("ingest %s failed after %d records: %v", ingestID, resp.Total, err)
+		writeIngestError(w, resp, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// extendDeadlines lifts the server read and write timeouts off an upload,
+// which may take longer than them; only a body idle for StreamIdleTimeout is
+// cut off
+func (s *Server) extendDeadlines(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("%s %s: clearing write deadline failed: %v", r.Method, r.URL.Path, err)
+	}
+	if s.cfg.StreamIdleTimeout <= 0 {
+		_ = rc.SetReadDeadline(time.Time{})
+	}
+	r.Body = &idleTimeoutReader{r: r.Body, rc: rc, idle: s.cfg.StreamIdleTimeout}
+}
+
+// streamRejectFlushInterval bounds how long a rejected line of a feed to
+// /ingest/stream waits to be saved
+const streamRejectFlushInterval = time.Second
+
+// idleTimeoutReader pushes the connection read deadline forward before every
+// read, so a request body can stream for as long as data keeps arriving
+type idleTimeoutReader struct {
+	r    io.ReadCloser
+	rc   *http.ResponseController
+	idle time.Duration
+}
+
+func (ir *idleTimeoutReader) Read(p []byte) (int, error) {
+	if ir.idle > 0 {
+		// Errors mean the connection does not support deadlines; read anyway
+		_ = ir.rc.SetReadDeadline(time.Now().Add(ir.idle))
+	}
+	return ir.r.Read(p)
+}
+
+func (ir *idleTimeoutReader) Close() error {
+	return ir.r.Close()
+}
+
+// handleGetJob reports the state and progress of an async ingest job
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, err := s.store.GetJob(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, "Ingest job not found", statusForError(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// handleGetRejects streams the rejected lines of an ingest as NDJSON
+func (s *Server) handleGetRejects(w http.ResponseWriter, r *http.Request) {
+	ingestID := r.PathValue("id")
+
+	var enc *json.Encoder
+	err := s.store.StreamRejects(r.Context(), ingestID, func(rej LineError) error {
+		if enc == nil {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			enc = json.NewEncoder(w)
+		}
+		return enc.Encode(rej)
 	})
+	if err != nil && enc == nil {
+		writeJSONError(w, "No rejected lines for ingest "+ingestID, statusForError(err))
+		return
+	}
+	if err != nil {
+		log.Printf("streaming rejects for ingest %s failed: %v", ingestID, err)
+	}
 }
 
-// handleListPurchases implements keyset pagination for purchases
+// handleListPurchases implements keyset pagination for purchases.
+// ?ingest_id= lists only the purchases last written by that ingest.
 func (s *Server) handleListPurchases(w http.ResponseWriter, r *http.Request) {
-	// TODO: Parse query parameters
-	// - after_id: int64 (default 0)
-	// - limit: int (default 20, max 100)
-	// Call store.ListAfterID with proper context timeout
-	// Return ListPurchasesResponse as JSON
-	
-	_ = int64(0) // TODO: Parse after_id parameter
-	// afterID := int64(0)
-	// if after := r.URL.Query().Get("after_id"); after != "" {
-	//	var err error
-	//	afterID, err = strconv.ParseInt(after, 10, 64)
-	//	if err != nil {
-	//		http.Error(w, "Invalid after_id parameter", http.StatusBadRequest)
-	//		return
-	//	}
-	// }
-	
-	_ = 20 // TODO: Parse limit parameter
-	// limit := 20
-	// if l := r.URL.Query().Get("limit"); l != "" {
-	//	var err error
-	//	limit, err = strconv.Atoi(l)
-	//	if err != nil || limit < 1 || limit > 100 {
-	//		http.Error(w, "Invalid limit parameter (1-100)", http.StatusBadRequest)
-	//		return
-	//	}
-	// }
-	
-	// TODO: Call store.ListAfterID with context timeout
-	// TODO: Return JSON response
-	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ListPurchasesResponse{
-		Purchases:   []Purchase{},
-		NextAfterID: 0,
-	})
+	afterID := int64(0)
+	if after := r.URL.Query().Get("after_id"); after != "" {
+		var err error
+		afterID, err = strconv.ParseInt(after, 10, 64)
+		if err != nil {
+			writeJSONError(w, "Invalid after_id parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > 100 {
+			writeJSONError(w, "Invalid limit parameter (1-100)", http.StatusBadRequest)
+			return
+		}
+	}
+
+	filter := PurchaseFilter{IngestID: r.URL.Query().Get("ingest_id")}
+	purchases, err := s.store.ListAfterID(r.Context(), afterID, limit, filter)
+	if err != nil {
+		log.Printf("list purchases failed: %v", err)
+		writeJSONError(w, "Failed to list purchases", http.StatusInternalServerError)
+		return
+	}
+
+	resp := ListPurchasesResponse{Purchases: purchases}
+	if len(purchases) == limit {
+		resp.NextAfterID = purchases[len(purchases)-1].ID
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleGetPurchase returns a single purchase with its provenance
+func (s *Server) handleGetPurchase(w http.ResponseWriter, r *http.Request) {
+	transactionID := r.PathValue("transaction_id")
+
+	purchase, err := s.store.GetPurchase(r.Context(), transactionID)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("get purchase %s failed: %v", transactionID, err)
+		}
+		writeJSONError(w, "Failed to load purchase", statusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, purchase)
+}
+
+
+// PurchaseHistoryResponse is the current version of a purchase and the prior
+// versions it replaced
+type PurchaseHistoryResponse struct {
+	Purchase  Purchase           `json:"purchase"`
+	Revisions []PurchaseRevision `json:"revisions"`
 }
 
+// handlePurchaseHistory lists the revisions of a purchase, oldest first
+func (s *Server) handlePurchaseHistory(w http.ResponseWriter, r *http.Request) {
+	transactionID := r.PathValue("transaction_id")
+
+	current, revisions, err := s.store.PurchaseHistory(r.Context(), transactionID)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("history of %s failed: %v", transactionID, err)
+		}
+		writeJSONError(w, "Failed to load purchase history", statusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, PurchaseHistoryResponse{Purchase: current, Revisions: revisions})
+}
+
+// PurchaseRefundsResponse lists the refund and chargeback of a purchase
+type PurchaseRefundsResponse struct {
+	TransactionID string   `json:"transaction_id"`
+	Refunds       []Refund `json:"refunds"`
+}
+
+// handlePurchaseRefund returns the refund and chargeback of a purchase,
+// including how many loyalty points each took back and whether that was capped
+func (s *Server) handlePurchaseRefund(w http.ResponseWriter, r *http.Request) {
+	transactionID := r.PathValue("transaction_id")
+
+	refunds, err := s.store.GetRefunds(r.Context(), transactionID)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("refunds of %s failed: %v", transactionID, err)
+		}
+		writeJSONError(w, "Failed to load refunds", statusForError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, PurchaseRefundsResponse{TransactionID: transactionID, Refunds: refunds})
+}
 
 // Helper function to write JSON error responses
 func writeJSONError(w http.ResponseWriter, message string, code int) {
+	writeJSON(w, code, ErrorResponse{Error: message})
+}
+
+// writeLimitError reports a request refused for exceeding one of its limits
+func writeLimitError(w http.ResponseWriter, limit *LimitError) {
+	writeJSON(w, http.StatusRequestEntityTooLarge, ErrorResponse{Error: limit.Error(), Limit: limit})
+}
+
+// writeIngestError reports a failed ingest together with the partial counts
+func writeIngestError(w http.ResponseWriter, resp IngestResponse, err error) {
+	body := IngestErrorResponse{Error: err.Error(), IngestResponse: resp}
+	errors.As(err, &body.Limit)
+	writeJSON(w, statusForError(err), body)
+}
+
+// Helper function to write JSON success responses
+func writeJSON(w http.ResponseWriter, code int, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]string{
-		"error": message,
-	})
-}
\ No newline at end of file
+	json.NewEncoder(w).Encode(v)
+}
+
+// statusForError maps domain errors to HTTP status codes
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, ErrBadInput), errors.Is(err, ErrInvalidFormat):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDuplicateFile):
+		return http.StatusConflict
+	case errors.As(err, new(*LimitError)):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// parseIngestOptions reads the per-request ingest settings from the query string
+func parseIngestOptions(r *http.Request) (IngestOptions, error) {
+	var opts IngestOptions
+	var err error
+
+	if opts.Lenient, err = parseBoolParam(r, "lenient"); err != nil {
+		return opts, err
+	}
+	if opts.Strict, err = parseBoolParam(r, "strict"); err != nil {
+		return opts, err
+	}
+	if opts.ConflictPolicy, err = ParseConflictPolicy(r.URL.Query().Get("conflict_policy")); err != nil {
+		return opts, err
+	}
+
+	opts.UploadID = r.Header.Get("Upload-ID")
+	if len(opts.UploadID) > maxUploadIDLength {
+		return opts, fmt.Errorf("Upload-ID must be at most %d characters", maxUploadIDLength)
+	}
+	return opts, nil
+}
+
+const maxUploadIDLength = 200
+
+// uploaderOf identifies the sender of a request for the ingest_files ledger:
+// the X-Uploader header if given, else the client address
+func uploaderOf(r *http.Request) string {
+	if u := r.Header.Get("X-Uploader"); u != "" {
+		return u
+	}
+	return clientAddr(r)
+}
+
+// clientAddr returns the address of the client sending r, without its port
+func clientAddr(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// hashUpload returns a content-hash upload ID for a seekable upload and
+// rewinds it for reading
+func hashUpload(f io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// parseBoolParam reads an optional boolean query parameter
+func parseBoolParam(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s parameter", name)
+	}
+	return b, nil
+}
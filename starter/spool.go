@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subdirectories of a spool directory
+const (
+	spoolProcessing = "processing" // files being ingested
+	spoolDone       = "done"       // files ingested, next to their summaries
+	spoolFailed     = "failed"     // files whose ingest failed, next to their summaries
+)
+
+// spoolExtensions are the file names picked up from a spool directory
+var spoolExtensions = []string{".ndjson", ".ndjson.gz"}
+
+// SpoolSummary is written next to each file ingested from a spool directory
+type SpoolSummary struct {
+	FileName string `json:"file_name"`
+	Error    string `json:"error,omitempty"`
+	IngestResponse
+	Rejects []LineError `json:"rejects,omitempty"`
+}
+
+// SpoolRunner ingests NDJSON files dropped into a directory, for partners
+// delivering over SFTP rather than HTTP. Each file is claimed by renaming it
+// into processing/, so several runners may share a directory, and is
+// ingested like an upload to /ingest. It then moves to done/ or failed/
+// together with a SpoolSummary named after it with .json appended.
+//
+// A runner keeps the files it is ingesting touched, so that the files a
+// runner left in processing/ when it died are found by their age and
+// returned to the spool directory to be ingested again.
+type SpoolRunner struct {
+	Dir   string
+	Poll  time.Duration // delay between scans of Dir
+	Store Store
+
+	// Settle leaves files modified more recently than this alone, as their
+	// upload may still be in progress
+	Settle time.Duration
+
+	// Reclaim returns files to the spool directory that have been left in
+	// processing/ unmodified for this long; 0 never does
+	Reclaim time.Duration
+
+	Options               IngestOptions // settings of every ingest, e.g. Lenient
+	DuplicateFiles        DuplicateFilePolicy
+	MaxDecompressionRatio float64 // cap on decompressed/compressed size of gzip files
+	BulkThreshold         int     // files with more records use the COPY bulk path (0 = never)
+
+	Timestamps *TimestampParser // parses created_at values; nil uses the defaults
+	Schema     SchemaPolicy     // records checked in strict schema mode
+
+	Decoders int // goroutines decoding and validating the records of a file
+	Writers  int // goroutines writing the records of a file to the store
+}
+
+// Run scans the spool directory every Poll until the context is cancelled
+func (sr SpoolRunner) Run(ctx context.Context) error {
+	for {
+		if _, err := sr.Scan(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Spool scan of %s failed: %v", sr.Dir, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sr.Poll):
+		}
+	}
+}
+
+// Scan ingests the files waiting in the spool directory one at a time, in
+// name order, and returns how many it claimed
+func (sr SpoolRunner) Scan(ctx context.Context) (int, error) {
+	for _, sub := range []string{spoolProcessing, spoolDone, spoolFailed} {
+		if err := os.MkdirAll(filepath.Join(sr.Dir, sub), 0o755); err != nil {
+			return 0, fmt.Errorf("create spool directory: %w", err)
+		}
+	}
+
+	sr.reclaim()
+
+	entries, err := os.ReadDir(sr.Dir)
+	if err != nil {
+		return 0, fmt.Errorf("read spool directory: %w", err)
+	}
+
+	claimed := 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return claimed, ctx.Err()
+		}
+		if !entry.Type().IsRegular() || !isSpoolFile(entry.Name()) {
+			continue
+		}
+		if info, err := entry.Info(); err != nil || time.Since(info.ModTime()) < sr.Settle {
+			continue
+		}
+
+		ok, err := sr.claim(entry.Name())
+		if err != nil {
+			log.Printf("Spool: claiming %s failed: %v", entry.Name(), err)
+			continue
+		}
+		if ok {
+			claimed++
+			sr.ingestFile(ctx, entry.Name())
+		}
+	}
+	return claimed, nil
+}
+
+// isSpoolFile reports whether a file in the spool directory is to be ingested
+func isSpoolFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false // hidden, e.g. a temporary file of an upload
+	}
+	for _, ext := range spoolExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// claim moves a file into processing/. It returns false if another runner
+// claimed it first, or while a file of the same name is still processing.
+func (sr SpoolRunner) claim(name string) (bool, error) {
+	src := filepath.Join(sr.Dir, name)
+	dst := filepath.Join(sr.Dir, spoolProcessing, name)
+	if _, err := os.Lstat(dst); err == nil {
+		return false, nil
+	}
+	// Touched first, so that it is not reclaimed as soon as it arrives
+	err := sr.touch(src)
+	if err == nil {
+		err = os.Rename(src, dst)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// touch sets the modification time of a file to now if files are reclaimed
+func (sr SpoolRunner) touch(path string) error {
+	if sr.Reclaim <= 0 {
+		return nil
+	}
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// holdClaim touches a claimed file every Reclaim/3 until stop is called,
+// so that other runners do not reclaim it while it is being ingested
+func (sr SpoolRunner) holdClaim(path string) (stop func()) {
+	if sr.Reclaim <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(sr.Reclaim / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := sr.touch(path); err != nil {
+					log.Printf("Spool: touching %s failed: %v", path, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// reclaim returns the files left in processing/ for longer than Reclaim, by
+// a runner that stopped before it was done with them, to the spool directory
+func (sr SpoolRunner) reclaim() {
+	if sr.Reclaim <= 0 {
+		return
+	}
+	dir := filepath.Join(sr.Dir, spoolProcessing)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Spool: reading %s failed: %v", dir, err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if info, err := entry.Info(); err != nil || time.Since(info.ModTime()) < sr.Reclaim {
+			continue
+		}
+		// A new delivery under the same name goes first
+		dst := filepath.Join(sr.Dir, entry.Name())
+		if _, err := os.Lstat(dst); err == nil {
+			continue
+		}
+		err := os.Rename(filepath.Join(dir, entry.Name()), dst)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			log.Printf("Spool: reclaiming %s failed: %v", entry.Name(), err)
+		default:
+			log.Printf("Spool: reclaimed %s, left in %s for over %s", entry.Name(), spoolProcessing, sr.Reclaim)
+		}
+	}
+}
+
+// ingestFile ingests a claimed file and files it under done/ or failed/. A
+// file interrupted by shutdown goes back to the spool directory.
+func (sr SpoolRunner) ingestFile(ctx context.Context, name string) {
+	path := filepath.Join(sr.Dir, spoolProcessing, name)
+
+	summary := SpoolSummary{FileName: name}
+	var err error
+	if summary.IngestID, err = newIngestID(); err == nil {
+		stop := sr.holdClaim(path)
+		summary.IngestResponse, err = sr.ingest(ctx, summary.IngestID, path, name)
+		stop()
+	}
+
+	if ctx.Err() != nil {
+		if rerr := os.Rename(path, filepath.Join(sr.Dir, name)); rerr != nil {
+			log.Printf("Spool: returning %s after shutdown failed, it stays in %s: %v", name, spoolProcessing, rerr)
+		}
+		return
+	}
+
+	dir := spoolDone
+	if err != nil {
+		dir = spoolFailed
+		summary.Error = err.Error()
+		log.Printf("Spool: ingest %s of %s failed: %v", summary.IngestID, name, err)
+	} else {
+		log.Printf("Spool: ingest %s of %s: %d created, %d updated, %d rejected",
+			summary.IngestID, name, summary.Created, summary.Updated, summary.Rejected)
+	}
+	if summary.Rejected > 0 {
+		serr := sr.Store.StreamRejects(ctx, summary.IngestID, func(rej LineError) error {
+			summary.Rejects = append(summary.Rejects, rej)
+			return nil
+		})
+		if serr != nil {
+			log.Printf("Spool: loading rejects of %s failed: %v", name, serr)
+		}
+	}
+
+	if err := fileSpooled(path, filepath.Join(sr.Dir, dir), summary); err != nil {
+		log.Printf("Spool: filing %s under %s failed, it stays in %s: %v", name, dir, spoolProcessing, err)
+	}
+}
+
+// ingest runs one claimed file through an Ingester, refusing files that
+// were ingested before if DuplicateFiles says so
+func (sr SpoolRunner) ingest(ctx context.Context, ingestID, path, name string) (IngestResponse, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return IngestResponse{IngestID: ingestID}, err
+	}
+	defer file.Close()
+
+	opts := sr.Options
+	opts.RefuseDuplicate = sr.DuplicateFiles == DuplicateFilesRefuse
+	opts.Format = DetectFormat("", name).Name
+	if opts.Uploader == "" {
+		opts.Uploader = "spool"
+	}
+	ing := Ingester{
+		Store:                 sr.Store,
+		Options:               opts,
+		MaxDecompressionRatio: sr.MaxDecompressionRatio,
+		BulkThreshold:         sr.BulkThreshold,
+		FileName:              name,
+		Source:                SourceSpool,
+		Timestamps:            sr.Timestamps,
+		Schema:                sr.Schema,
+		Decoders:              sr.Decoders,
+		Writers:               sr.Writers,
+	}
+	return ing.Run(ctx, ingestID, file)
+}
+
+// fileSpooled writes the summary of a processed file into dir and then moves
+// the file there. Names already taken in dir, by an earlier delivery of the
+// same file name, get the ingest ID as a prefix.
+func fileSpooled(path, dir string, summary SpoolSummary) error {
+	name := filepath.Base(path)
+	if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+		name = summary.IngestID + "-" + name
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode summary: %w", err)
+	}
+	tmp := filepath.Join(dir, "."+name+".json.tmp")
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write summary: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name+".json")); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write summary: %w", err)
+	}
+	return os.Rename(path, filepath.Join(dir, name))
+}
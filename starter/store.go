@@ -5,7 +5,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 // Purchase represents a gaming purchase in the system
@@ -23,8 +26,26 @@ type Purchase struct {
 	PlayerLevel       int        `json:"player_level"`
 	CreatedAt         time.Time  `json:"created_at"`
 	Enriched          bool       `json:"enriched"`
+
+	// Provenance of the version stored: the ingest that created or last
+	// updated the row, and where in that ingest it came from
+	IngestID     string       `json:"ingest_id,omitempty"`
+	IngestSource IngestSource `json:"ingest_source,omitempty"`
+	SourceFile   string       `json:"source_file,omitempty"`
+	SourceLine   int          `json:"source_line,omitempty"`
 }
 
+// IngestSource is the channel through which purchases were ingested
+type IngestSource string
+
+const (
+	SourceMultipart IngestSource = "multipart" // file upload to POST /ingest
+	SourceStream    IngestSource = "stream"    // raw body to POST /ingest/stream
+	SourceWebhook   IngestSource = "webhook"   // platform notification to POST /webhooks/{platform}
+	SourceCLI       IngestSource = "cli"       // command-line ingest
+	SourceSpool     IngestSource = "spool"     // file dropped into the -spool-dir directory
+)
+
 // PlayerLoyalty represents a player's loyalty points
 type PlayerLoyalty struct {
 	PlayerID      string    `json:"player_id"`
@@ -34,23 +55,35 @@ type PlayerLoyalty struct {
 
 // PurchaseInput represents input data for purchase creation/update
 type PurchaseInput struct {
-	TransactionID     string   `json:"transaction_id"`
-	PlayerID          string   `json:"player_id"`
-	PlayerUsername    string   `json:"player_username"`
-	GameTitle         string   `json:"game_title"`
-	ItemType          string   `json:"item_type"`
-	Genre             string   `json:"genre"`
-	Platform          string   `json:"platform"`
-	AmountCents       int      `json:"amount_cents"`
-	Currency          string   `json:"currency"`
-	PlayerLevel       int      `json:"player_level"`
-	CreatedAt         string   `json:"created_at"` // ISO8601 string, will be parsed to time.Time
-}
-
-// UpsertResult contains the result of an upsert operation
+	TransactionID  string    `json:"transaction_id"`
+	PlayerID       string    `json:"player_id"`
+	PlayerUsername string    `json:"player_username"`
+	GameTitle      string    `json:"game_title"`
+	ItemType       string    `json:"item_type"`
+	Genre          string    `json:"genre"`
+	Platform       string    `json:"platform"`
+	AmountCents    int       `json:"amount_cents"`
+	Currency       string    `json:"currency"`
+	PlayerLevel    int       `json:"player_level"`
+	CreatedAt      Timestamp `json:"created_at"` // parsed by a TimestampParser
+
+	// EventType is "purchase" (the default), "refund" or "chargeback"; the
+	// latter two reverse the purchase with the same transaction_id
+	EventType string `json:"event_type,omitempty"`
+}
+
+// UpsertResult contains the result of an upsert operation. When neither
+// Created nor Updated is set, the conflict policy kept the stored version.
 type UpsertResult struct {
 	Created bool `json:"created"`
 	Updated bool `json:"updated"`
+
+	// Conflict lists the fields that differ from the stored version under RejectOnDiff
+	Conflict []string `json:"conflict,omitempty"`
+
+	// Reversal is a refund or chargeback as processed by AddRefund, when its
+	// purchase had already earned its points and they were taken back at once
+	Reversal *Refund `json:"reversal,omitempty"`
 }
 
 // Common errors
@@ -60,10 +93,89 @@ var (
 	ErrInvalidFormat = errors.New("invalid format")
 )
 
+// toPurchase validates the input and converts it into a Purchase, reading
+// created_at with tp
+func (in PurchaseInput) toPurchase(tp *TimestampParser) (Purchase, error) {
+	if err := validatePurchaseFields(in); err != nil {
+		return Purchase{}, err
+	}
+
+	createdAt, err := tp.Parse(in.CreatedAt, in.Platform)
+	if err != nil {
+		return Purchase{}, err
+	}
+
+	currency := in.Currency
+	if currency == "" {
+		currency = "USD"
+	}
+
+	return Purchase{
+		TransactionID:  in.TransactionID,
+		PlayerID:       in.PlayerID,
+		PlayerUsername: in.PlayerUsername,
+		GameTitle:      in.GameTitle,
+		ItemType:       in.ItemType,
+		Genre:          in.Genre,
+		Platform:       in.Platform,
+		AmountCents:    in.AmountCents,
+		Currency:       currency,
+		PlayerLevel:    in.PlayerLevel,
+		CreatedAt:      createdAt,
+	}, nil
+}
+
+// dbTimeout bounds every individual database operation
+const dbTimeout = 5 * time.Second
+
+// Store is the full set of storage operations the HTTP server depends on
+type Store interface {
+	PurchaseStore
+	RejectStore
+	JobStore
+	CheckpointStore
+	BulkStore
+	HistoryStore
+	RefundStore
+	IdempotencyStore
+	FileStore
+	RollbackStore
+	LookupStore
+}
+
+// LineRef identifies the ingest line a purchase was read from and the
+// conflict policy it is written under
+type LineRef struct {
+	IngestID string
+	UploadID string // resumable upload key; empty when the ingest is not checkpointed
+	Line     int
+	Policy   ConflictPolicy // empty means LastWriteWins
+	Source   IngestSource
+	FileName string // name of the uploaded file, if any
+}
+
+// PurchaseFilter narrows a purchase listing
+type PurchaseFilter struct {
+	IngestID string // only purchases last written by this ingest
+}
+
 // PurchaseStore defines the interface for purchase storage operations
 type PurchaseStore interface {
-	// AddPurchase inserts or updates a purchase by transaction_id
-	AddPurchase(ctx context.Context, p Purchase) (created bool, err error)
+	// AddPurchase inserts or updates a purchase by transaction_id according to
+	// ref.Policy. Updates keep the prior row image in purchase_revisions,
+	// tagged with ref.IngestID, ref.Line and the source of ref; a version
+	// identical to the stored one is ignored, leaving the row and its
+	// provenance as they are. When ref.UploadID is set, the upload's checkpoint is advanced
+	// to ref.Line in the same statement, so a commit and its checkpoint cannot diverge.
+	// Created and updated rows record ref as their provenance.
+	AddPurchase(ctx context.Context, p Purchase, ref LineRef) (UpsertResult, error)
+
+	// GetPurchase returns a purchase by transaction_id, or ErrNotFound
+	GetPurchase(ctx context.Context, transactionID string) (Purchase, error)
+
+	// ListAfterID returns up to limit purchases with an id above afterID,
+	// in id order, that match the filter
+	ListAfterID(ctx context.Context, afterID int64, limit int, filter PurchaseFilter) ([]Purchase, error)
 	
 	// ClaimBatchForEnrichment selects unenriched purchases using FOR UPDATE SKIP LOCKED
 	// Returns up to 'batch' purchases that are locked for processing
@@ -73,30 +185,412 @@ type PurchaseStore interface {
 	MarkEnriched(ctx context.Context, id int64) error
 }
 
+// RejectStore persists lines rejected during lenient ingestion
+type RejectStore interface {
+	// SaveRejects records rejected lines under the given ingest ID
+	SaveRejects(ctx context.Context, ingestID string, rejects []LineError) error
+
+	// StreamRejects calls fn for each rejected line of an ingest in line order.
+	// Returns ErrNotFound if the ingest has no rejected lines.
+	StreamRejects(ctx context.Context, ingestID string, fn func(LineError) error) error
+}
+
+// CheckpointStore tracks how far resumable uploads have been committed
+type CheckpointStore interface {
+	// GetCheckpoint returns the last handled line of an upload, or 0 if unknown
+	GetCheckpoint(ctx context.Context, uploadID string) (int, error)
+
+	// SaveCheckpoint advances the checkpoint of an upload to line, on behalf
+	// of the given ingest
+	SaveCheckpoint(ctx context.Context, uploadID, ingestID string, line int) error
+
+	// ClearCheckpoint forgets an upload once it has been ingested in full,
+	// so its Upload-ID may be reused for other data
+	ClearCheckpoint(ctx context.Context, uploadID string) error
+}
+
+// pgStore implements the storage interfaces on top of PostgreSQL
+type pgStore struct {
+	db *sql.DB
+}
+
+// NewStore returns a Store backed by the PostgreSQL database db
+func NewStore(db *sql.DB) Store {
+	return &pgStore{db: db}
+}
+
+const insertPurchaseSQL = `
+	INSERT INTO purchases (
+		transaction_id, player_id, player_username, game_title, item_type,
+		genre, platform, amount_cents, currency, player_level, created_at,
+		ingest_id, ingest_source, source_file, source_line
+	)`
+
+const onConflictUpdateSQL = `
+	ON CONFLICT (transaction_id) DO UPDATE SET
+		player_id       = EXCLUDED.player_id,
+		player_username = EXCLUDED.player_username,
+		game_title      = EXCLUDED.game_title,
+		item_type       = EXCLUDED.item_type,
+		genre           = EXCLUDED.genre,
+		platform        = EXCLUDED.platform,
+		amount_cents    = EXCLUDED.amount_cents,
+		currency        = EXCLUDED.currency,
+		player_level    = EXCLUDED.player_level,
+		created_at      = EXCLUDED.created_at,
+		ingest_id       = EXCLUDED.ingest_id,
+		ingest_source   = EXCLUDED.ingest_source,
+		source_file     = EXCLUDED.source_file,
+		source_line     = EXCLUDED.source_line`
+
+// onConflictSQL is the ON CONFLICT clause implementing each policy. Rows the
+// policy leaves untouched, including those a new version would not change,
+// are not returned by RETURNING.
+var onConflictSQL = map[ConflictPolicy]string{
+	LastWriteWins: onConflictUpdateSQL + `
+		WHERE ` + distinctFieldsSQL("purchases", "EXCLUDED"),
+	NewerCreatedAtWins: onConflictUpdateSQL + `
+		WHERE purchases.created_at < EXCLUDED.created_at`,
+	FirstWriteWins: `
+	ON CONFLICT (transaction_id) DO NOTHING`,
+	RejectOnDiff: `
+	ON CONFLICT (transaction_id) DO NOTHING`,
+}
+
+// addPurchaseSQL upserts a purchase under each conflict policy, records the
+// prior image when an existing row is updated and, for resumable uploads,
+// advances the upload checkpoint, all in one statement
+var addPurchaseSQL = func() map[ConflictPolicy]string {
+	stmts := make(map[ConflictPolicy]string, len(onConflictSQL))
+	for policy, onConflict := range onConflictSQL {
+		stmts[policy] = `
+	WITH previous AS (
+		SELECT * FROM purchases WHERE transaction_id = $1
+	), upserted AS (` + insertPurchaseSQL + `
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11,
+			NULLIF($14::text, ''), NULLIF($15::text, ''), NULLIF($16::text, ''), NULLIF($13::int, 0))` + onConflict + `
+		RETURNING *, (xmax = 0) AS created
+	), revision AS (` + insertRevisionSQL + `
+		SELECT cur.id, cur.transaction_id, NULLIF($14::text, ''), $13::int,
+			` + changedFieldsSQL("cur", "prev") + `, to_jsonb(prev),
+			NULLIF($15::text, ''), NULLIF($16::text, '')
+		FROM upserted cur
+		JOIN previous prev ON prev.id = cur.id
+		WHERE NOT cur.created AND ` + distinctFieldsSQL("cur", "prev") + `
+	), checkpoint AS (
+		INSERT INTO ingest_checkpoints (upload_id, last_line, ingest_id)
+		SELECT $12::text, $13::int, NULLIF($14::text, '')
+		WHERE $12::text <> ''
+		ON CONFLICT (upload_id) DO UPDATE SET
+			last_line  = GREATEST(ingest_checkpoints.last_line, EXCLUDED.last_line),
+			ingest_id  = EXCLUDED.ingest_id,
+			updated_at = NOW()
+	)
+	SELECT created FROM upserted`
+	}
+	return stmts
+}()
+
 // AddPurchase implements PurchaseStore.AddPurchase
-func (s *pgStore) AddPurchase(ctx context.Context, p Purchase) (bool, error) {
-	// TODO: implement purchase
-	
-	return false, nil
+func (s *pgStore) AddPurchase(ctx context.Context, p Purchase, ref LineRef) (UpsertResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	policy := ref.Policy
+	if policy == "" {
+		policy = LastWriteWins
+	}
+
+	var created bool
+	err := s.db.QueryRowContext(ctx, addPurchaseSQL[policy],
+		p.TransactionID, p.PlayerID, p.PlayerUsername, p.GameTitle, p.ItemType,
+		p.Genre, p.Platform, p.AmountCents, p.Currency, p.PlayerLevel, p.CreatedAt,
+		ref.UploadID, ref.Line, ref.IngestID, ref.Source, ref.FileName,
+	).Scan(&created)
+	switch {
+	case err == nil:
+		return UpsertResult{Created: created, Updated: !created}, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return UpsertResult{}, fmt.Errorf("upsert purchase %s: %w", p.TransactionID, err)
+	case policy != RejectOnDiff:
+		// The policy kept the stored version
+		return UpsertResult{}, nil
+	}
+
+	stored, err := s.getPurchase(ctx, p.TransactionID)
+	if err != nil {
+		return UpsertResult{}, err
+	}
+	return UpsertResult{Conflict: diffPurchases(stored, p)}, nil
+}
+
+const purchaseColumns = `
+	id, transaction_id, player_id, player_username, game_title, item_type,
+	genre, platform, amount_cents, currency, player_level, created_at, enriched,
+	COALESCE(ingest_id, ''), COALESCE(ingest_source, ''), COALESCE(source_file, ''), COALESCE(source_line, 0)`
+
+// scanPurchase reads a row selected with purchaseColumns
+func scanPurchase(row interface{ Scan(...any) error }) (Purchase, error) {
+	var p Purchase
+	err := row.Scan(&p.ID, &p.TransactionID, &p.PlayerID, &p.PlayerUsername, &p.GameTitle, &p.ItemType,
+		&p.Genre, &p.Platform, &p.AmountCents, &p.Currency, &p.PlayerLevel, &p.CreatedAt, &p.Enriched,
+		&p.IngestID, &p.IngestSource, &p.SourceFile, &p.SourceLine)
+	return p, err
+}
+
+// getPurchase loads a purchase by transaction_id, or returns ErrNotFound
+func (s *pgStore) getPurchase(ctx context.Context, transactionID string) (Purchase, error) {
+	p, err := scanPurchase(s.db.QueryRowContext(ctx,
+		`SELECT`+purchaseColumns+` FROM purchases WHERE transaction_id = $1`, transactionID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Purchase{}, ErrNotFound
+	}
+	if err != nil {
+		return Purchase{}, fmt.Errorf("get purchase %s: %w", transactionID, err)
+	}
+	return p, nil
 }
 
-// ClaimBatchForEnrichment implements PurchaseStore.ClaimBatchForEnrichment
+// enrichClaimLease is how long a claimed purchase or refund is reserved for
+// the worker that claimed it before others may pick it up again
+const enrichClaimLease = 5 * time.Minute
+
+// GetPurchase implements PurchaseStore.GetPurchase
+func (s *pgStore) GetPurchase(ctx context.Context, transactionID string) (Purchase, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	return s.getPurchase(ctx, transactionID)
+}
+
+// ListAfterID implements PurchaseStore.ListAfterID
+func (s *pgStore) ListAfterID(ctx context.Context, afterID int64, limit int, filter PurchaseFilter) ([]Purchase, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT`+purchaseColumns+`
+		FROM purchases
+		WHERE id > $1 AND ($3 = '' OR ingest_id = $3)
+		ORDER BY id
+		LIMIT $2`, afterID, limit, filter.IngestID)
+	if err != nil {
+		return nil, fmt.Errorf("list purchases: %w", err)
+	}
+	defer rows.Close()
+
+	purchases := []Purchase{}
+	for rows.Next() {
+		p, err := scanPurchase(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan purchase: %w", err)
+		}
+		purchases = append(purchases, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate purchases: %w", err)
+	}
+	return purchases, nil
+}
+
+// ClaimBatchForEnrichment implements PurchaseStore.ClaimBatchForEnrichment.
+// Row locks end with the statement, so claims are leased through
+// enrich_claimed_at instead.
 func (s *pgStore) ClaimBatchForEnrichment(ctx context.Context, batch int) ([]Purchase, error) {
-	// TODO: implement claim batch for enrichment
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
 
-	return nil, errors.New("not implemented")
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE purchases SET enrich_claimed_at = NOW()
+		WHERE id IN (
+			SELECT id FROM purchases
+			WHERE NOT enriched
+				AND (enrich_claimed_at IS NULL OR enrich_claimed_at < NOW() - $2 * INTERVAL '1 second')
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING`+purchaseColumns, batch, enrichClaimLease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("claim purchases: %w", err)
+	}
+	defer rows.Close()
+
+	var purchases []Purchase
+	for rows.Next() {
+		p, err := scanPurchase(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan purchase: %w", err)
+		}
+		purchases = append(purchases, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate purchases: %w", err)
+	}
+	return purchases, nil
 }
 
 // MarkEnriched implements PurchaseStore.MarkEnriched
 func (s *pgStore) MarkEnriched(ctx context.Context, id int64) error {
-	// TODO: Mark purchase as enriched
-	
-	return errors.New("not implemented")
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE purchases SET enriched = TRUE, enrich_claimed_at = NULL WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("mark purchase %d enriched: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// creditLoyaltySQL records the points a purchase earned in the ledger and
+// adds them to the player's balance, unless the purchase was credited before
+const creditLoyaltySQL = `
+	WITH entry AS (
+		INSERT INTO loyalty_ledger (player_id, transaction_id, kind, points)
+		VALUES ($1, $2, 'purchase', $3)
+		ON CONFLICT (transaction_id) WHERE kind = 'purchase' AND NOT reversed DO NOTHING
+		RETURNING player_id, points
+	)
+	INSERT INTO player_loyalty (player_id, loyalty_points, updated_at)
+	SELECT player_id, points, NOW() FROM entry
+	ON CONFLICT (player_id) DO UPDATE SET
+		loyalty_points = player_loyalty.loyalty_points + EXCLUDED.loyalty_points,
+		updated_at     = NOW()`
+
+// CreditLoyalty implements EnrichmentStore.CreditLoyalty
+func (s *pgStore) CreditLoyalty(ctx context.Context, p Purchase, points int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, creditLoyaltySQL, p.PlayerID, p.TransactionID, points); err != nil {
+		return fmt.Errorf("credit loyalty for %s: %w", p.TransactionID, err)
+	}
+	return nil
 }
 
-// Helper function to parse ISO8601 timestamp
-func parseTimestamp(s string) (time.Time, error) {
-	// TODO: Parse ISO8601 timestamp string to time.Time
-	// Handle formats like "2025-08-15T10:00:00Z"
-	return time.Parse(time.RFC3339, s)
-}
\ No newline at end of file
+// saveRejectsSQL inserts a batch of rejected lines in one statement
+const saveRejectsSQL = `
+	INSERT INTO ingest_rejects (ingest_id, line_number, byte_offset, raw, reason)
+	SELECT $1, * FROM unnest($2::integer[], $3::bigint[], $4::text[], $5::text[])`
+
+// saveRejectsBatch is how many rejected lines go into one INSERT
+const saveRejectsBatch = 1000
+
+// SaveRejects implements RejectStore.SaveRejects. The lines are inserted in
+// multi-row batches, each with a timeout of its own, so a large number of
+// rejects neither goes row by row nor has to fit within a single dbTimeout.
+func (s *pgStore) SaveRejects(ctx context.Context, ingestID string, rejects []LineError) error {
+	for len(rejects) > 0 {
+		batch := rejects[:min(len(rejects), saveRejectsBatch)]
+		rejects = rejects[len(batch):]
+
+		lines := make([]int64, len(batch))
+		offsets := make([]int64, len(batch))
+		raws := make([]string, len(batch))
+		reasons := make([]string, len(batch))
+		for i, rej := range batch {
+			lines[i], offsets[i] = int64(rej.Line), rej.Offset
+			raws[i], reasons[i] = sanitizeText(rej.Raw), sanitizeText(rej.Reason)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+		_, err := s.db.ExecContext(ctx, saveRejectsSQL, ingestID,
+			pq.Array(lines), pq.Array(offsets), pq.Array(raws), pq.Array(reasons))
+		cancel()
+		if err != nil {
+			return fmt.Errorf("save rejects for lines %d-%d: %w", batch[0].Line, batch[len(batch)-1].Line, err)
+		}
+	}
+	return nil
+}
+
+// StreamRejects implements RejectStore.StreamRejects
+func (s *pgStore) StreamRejects(ctx context.Context, ingestID string, fn func(LineError) error) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT line_number, byte_offset, raw, reason
+		FROM ingest_rejects
+		WHERE ingest_id = $1
+		ORDER BY line_number`, ingestID)
+	if err != nil {
+		return fmt.Errorf("query rejects: %w", err)
+	}
+	defer rows.Close()
+
+	found := false
+	for rows.Next() {
+		var rej LineError
+		if err := rows.Scan(&rej.Line, &rej.Offset, &rej.Raw, &rej.Reason); err != nil {
+			return fmt.Errorf("scan reject: %w", err)
+		}
+		found = true
+		if err := fn(rej); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate rejects: %w", err)
+	}
+
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const saveCheckpointSQL = `
+	INSERT INTO ingest_checkpoints (upload_id, last_line, ingest_id)
+	VALUES ($1, $2, NULLIF($3::text, ''))
+	ON CONFLICT (upload_id) DO UPDATE SET
+		last_line  = GREATEST(ingest_checkpoints.last_line, EXCLUDED.last_line),
+		ingest_id  = EXCLUDED.ingest_id,
+		updated_at = NOW()`
+
+// GetCheckpoint implements CheckpointStore.GetCheckpoint
+func (s *pgStore) GetCheckpoint(ctx context.Context, uploadID string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var line int
+	err := s.db.QueryRowContext(ctx,
+		`SELECT last_line FROM ingest_checkpoints WHERE upload_id = $1`, uploadID).Scan(&line)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("get checkpoint %s: %w", uploadID, err)
+	}
+	return line, nil
+}
+
+// SaveCheckpoint implements CheckpointStore.SaveCheckpoint
+func (s *pgStore) SaveCheckpoint(ctx context.Context, uploadID, ingestID string, line int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, saveCheckpointSQL, uploadID, line, ingestID)
+	if err != nil {
+		return fmt.Errorf("save checkpoint %s: %w", uploadID, err)
+	}
+	return nil
+}
+
+// ClearCheckpoint implements CheckpointStore.ClearCheckpoint
+func (s *pgStore) ClearCheckpoint(ctx context.Context, uploadID string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM ingest_checkpoints WHERE upload_id = $1`, uploadID); err != nil {
+		return fmt.Errorf("clear checkpoint %s: %w", uploadID, err)
+	}
+	return nil
+}
+
+// sanitizeText makes arbitrary input safe to store in a TEXT column,
+// which rejects NUL bytes and invalid UTF-8
+func sanitizeText(s string) string {
+	return strings.ReplaceAll(strings.ToValidUTF8(s, "\uFFFD"), "\x00", "")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timestamp is a created_at value as sent by a partner: a date-time string,
+// or epoch seconds or milliseconds given as a number or a string
+type Timestamp string
+
+// UnmarshalJSON accepts a JSON string or number
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) > 0 && data[0] == '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*t = Timestamp(s)
+	case string(data) == "null":
+		*t = ""
+	default:
+		var n json.Number
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("created_at must be a string or a number")
+		}
+		*t = Timestamp(n)
+	}
+	return nil
+}
+
+// DefaultTimestampLayouts are the date-time formats accepted unless
+// configured otherwise: RFC3339 with optional fractional seconds, and the
+// same without a zone, which is read in the partner's timezone
+var DefaultTimestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+// epochMillisThreshold separates epoch seconds from milliseconds: as
+// seconds it would be in the year 5138, as milliseconds it is March 1973
+const epochMillisThreshold = 100_000_000_000
+
+// TimestampParser parses created_at values and normalizes them to UTC.
+// A nil *TimestampParser uses the defaults of NewTimestampParser.
+type TimestampParser struct {
+	// Layouts are the time.Parse layouts tried in order. Values made up of
+	// digits only are always read as epoch seconds or milliseconds.
+	Layouts []string
+
+	// Location is the timezone of values without a zone; nil means UTC.
+	// PlatformLocations overrides it for the purchases of a platform.
+	Location          *time.Location
+	PlatformLocations map[string]*time.Location
+
+	// Earliest rejects timestamps before it (zero = no lower bound);
+	// MaxFuture rejects timestamps further ahead of now (0 = no upper bound)
+	Earliest  time.Time
+	MaxFuture time.Duration
+
+	// Now returns the current time; nil means time.Now
+	Now func() time.Time
+}
+
+// NewTimestampParser returns a parser with the default layouts, UTC, no
+// timestamps before 2000 and at most a day of clock skew into the future
+func NewTimestampParser() *TimestampParser {
+	return &TimestampParser{
+		Layouts:   DefaultTimestampLayouts,
+		Earliest:  time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		MaxFuture: 24 * time.Hour,
+	}
+}
+
+var defaultTimestamps = NewTimestampParser()
+
+// Parse reads the created_at of a record of the given platform ("" for
+// refunds) and returns it in UTC. Errors wrap ErrBadInput.
+func (tp *TimestampParser) Parse(value Timestamp, platform string) (time.Time, error) {
+	if tp == nil {
+		tp = defaultTimestamps
+	}
+
+	s := strings.TrimSpace(string(value))
+	if s == "" {
+		return time.Time{}, fmt.Errorf("%w: created_at is required", ErrBadInput)
+	}
+
+	t, ok := parseEpoch(s)
+	if !ok {
+		loc := tp.location(platform)
+		for _, layout := range tp.Layouts {
+			var err error
+			if t, err = time.ParseInLocation(layout, s, loc); err == nil {
+				ok = true
+				break
+			}
+		}
+	}
+	if !ok {
+		return time.Time{}, fmt.Errorf("%w: invalid created_at %q", ErrBadInput, string(value))
+	}
+	t = t.UTC()
+
+	if !tp.Earliest.IsZero() && t.Before(tp.Earliest) {
+		return time.Time{}, fmt.Errorf("%w: created_at %s is before the earliest accepted time %s",
+			ErrBadInput, t.Format(time.RFC3339), tp.Earliest.UTC().Format(time.RFC3339))
+	}
+	if tp.MaxFuture > 0 {
+		now := time.Now
+		if tp.Now != nil {
+			now = tp.Now
+		}
+		if limit := now().Add(tp.MaxFuture); t.After(limit) {
+			return time.Time{}, fmt.Errorf("%w: created_at %s is more than %s in the future",
+				ErrBadInput, t.Format(time.RFC3339), tp.MaxFuture)
+		}
+	}
+	return t, nil
+}
+
+// location returns the timezone of zoneless values of a platform
+func (tp *TimestampParser) location(platform string) *time.Location {
+	if loc, ok := tp.PlatformLocations[platform]; ok {
+		return loc
+	}
+	if tp.Location != nil {
+		return tp.Location
+	}
+	return time.UTC
+}
+
+// parseEpoch reads a string of digits as epoch seconds or milliseconds
+func parseEpoch(s string) (time.Time, bool) {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return time.Time{}, false
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if n >= epochMillisThreshold {
+		return time.UnixMilli(n), true
+	}
+	return time.Unix(n, 0), true
+}
+
+// ParsePlatformTimezones parses a comma-separated list of platform=zone
+// pairs, e.g. "steam=America/Los_Angeles,mobile=Asia/Tokyo"
+func ParsePlatformTimezones(spec string) (map[string]*time.Location, error) {
+	locs := make(map[string]*time.Location)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		platform, zone, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: platform timezone %q is not platform=zone", ErrBadInput, pair)
+		}
+		platform = strings.TrimSpace(platform)
+		if !validPlatforms[platform] {
+			return nil, fmt.Errorf("%w: invalid platform %q in platform timezones", ErrBadInput, platform)
+		}
+		loc, err := time.LoadLocation(strings.TrimSpace(zone))
+		if err != nil {
+			return nil, fmt.Errorf("%w: timezone of %s: %v", ErrBadInput, platform, err)
+		}
+		locs[platform] = loc
+	}
+	return locs, nil
+}
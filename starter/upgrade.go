@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// CurrentSchemaVersion is the schema_version of the PurchaseInput shape.
+// Records without a schema_version are taken to be in the current shape.
+const CurrentSchemaVersion = 3
+
+// RecordFields is a JSON record by field name, as rewritten by an Upgrade
+type RecordFields map[string]json.RawMessage
+
+// Upgrade rewrites a record of one schema version into the shape of the next
+type Upgrade func(RecordFields) error
+
+// upgrades holds the Upgrade from each version to the one after it
+var upgrades = map[int]Upgrade{}
+
+// RegisterUpgrade adds the Upgrade from version from to from+1. It panics if
+// that upgrade is already registered or would go past the current version.
+func RegisterUpgrade(from int, fn Upgrade) {
+	if from < 1 || from >= CurrentSchemaVersion {
+		panic(fmt.Sprintf("ingest: RegisterUpgrade from version %d, current is %d", from, CurrentSchemaVersion))
+	}
+	if _, dup := upgrades[from]; dup {
+		panic(fmt.Sprintf("ingest: RegisterUpgrade called twice for version %d", from))
+	}
+	upgrades[from] = fn
+}
+
+func init() {
+	// v1 used the field names of the original partner export
+	RegisterUpgrade(1, func(f RecordFields) error {
+		return f.rename(map[string]string{
+			"txn_id":       "transaction_id",
+			"user_id":      "player_id",
+			"username":     "player_username",
+			"title":        "game_title",
+			"purchased_at": "created_at",
+		})
+	})
+
+	// v2 sent the price as a decimal amount and currency, e.g. "59.99 EUR"
+	RegisterUpgrade(2, func(f RecordFields) error {
+		raw, ok := f["amount"]
+		if !ok {
+			return nil
+		}
+		delete(f, "amount")
+
+		var amount string
+		if err := json.Unmarshal(raw, &amount); err != nil {
+			return &FieldError{Field: "amount", Reason: `must be a string such as "59.99 EUR"`, Err: ErrBadInput}
+		}
+		cents, currency, err := parseAmount(amount)
+		if err != nil {
+			return &FieldError{Field: "amount", Reason: err.Error(), Err: ErrBadInput}
+		}
+		f["amount_cents"], _ = json.Marshal(cents)
+		if currency != "" {
+			f["currency"], _ = json.Marshal(currency)
+		}
+		return nil
+	})
+}
+
+// rename moves fields to their new names; a record with both the old and
+// the new name of a field is ambiguous
+func (f RecordFields) rename(names map[string]string) error {
+	for from, to := range names {
+		v, ok := f[from]
+		if !ok {
+			continue
+		}
+		if _, dup := f[to]; dup {
+			return &FieldError{Field: from, Reason: fmt.Sprintf("conflicts with %q", to), Err: ErrBadInput}
+		}
+		delete(f, from)
+		f[to] = v
+	}
+	return nil
+}
+
+// parseAmount splits a decimal amount with an optional currency code, such
+// as "59.99 EUR", into cents and the currency
+func parseAmount(s string) (int, string, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, "", fmt.Errorf("%q is not an amount and currency", s)
+	}
+
+	r, ok := new(big.Rat).SetString(fields[0])
+	if !ok || r.Sign() < 0 {
+		return 0, "", fmt.Errorf("invalid amount %q", fields[0])
+	}
+	r.Mul(r, big.NewRat(100, 1))
+	if !r.IsInt() || !r.Num().IsInt64() {
+		return 0, "", fmt.Errorf("amount %q is not a whole number of cents", fields[0])
+	}
+
+	var currency string
+	if len(fields) == 2 {
+		currency = strings.ToUpper(fields[1])
+	}
+	return int(r.Num().Int64()), currency, nil
+}
+
+// schemaVersionField is searched for before a record is decoded for its
+// version, so that records in the current shape are decoded only once
+var schemaVersionField = []byte(`"schema_version"`)
+
+// upgradeRecord returns a JSON record in the current shape together with the
+// schema_version it was sent with. Records in the current shape are
+// returned as is; syntax errors are left for the caller's decode to report.
+func upgradeRecord(raw []byte) ([]byte, int, error) {
+	if !bytes.Contains(raw, schemaVersionField) {
+		return raw, CurrentSchemaVersion, nil
+	}
+
+	var v struct {
+		SchemaVersion *int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return raw, 0, &FieldError{Field: "schema_version", Reason: "must be an integer", Err: ErrBadInput}
+		}
+		return raw, CurrentSchemaVersion, nil
+	}
+
+	version := CurrentSchemaVersion
+	if v.SchemaVersion != nil {
+		version = *v.SchemaVersion
+	}
+	switch {
+	case version == CurrentSchemaVersion:
+		return raw, version, nil
+	case version < 1 || version > CurrentSchemaVersion:
+		return raw, version, &FieldError{
+			Field:  "schema_version",
+			Reason: fmt.Sprintf("%d is not supported, expected 1 to %d", version, CurrentSchemaVersion),
+			Err:    ErrBadInput,
+		}
+	}
+
+	var fields RecordFields
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return raw, version, fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+	}
+	for from := version; from < CurrentSchemaVersion; from++ {
+		upgrade, ok := upgrades[from]
+		if !ok {
+			return raw, version, fmt.Errorf("%w: no upgrade from schema_version %d", ErrBadInput, from)
+		}
+		if err := upgrade(fields); err != nil {
+			return raw, version, fmt.Errorf("upgrading from schema_version %d: %w", from, err)
+		}
+	}
+	delete(fields, "schema_version")
+
+	upgraded, err := json.Marshal(fields)
+	if err != nil {
+		return raw, version, fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+	}
+	return upgraded, version, nil
+}
+
+// decodeJSONRecord upgrades rec.Raw to the current schema version and
+// decodes it into rec.Input with pd, setting rec.Version and rec.Err. It
+// returns the record in its current shape.
+func decodeJSONRecord(rec *RawRecord, pd *PurchaseDecoder) []byte {
+	current, version, err := upgradeRecord(rec.Raw)
+	rec.Version = version
+	if err == nil {
+		if err = pd.Decode(current, &rec.Input); err != nil {
+			err = fmt.Errorf("%w: %v", ErrInvalidFormat, err)
+		}
+	}
+	rec.Err = err
+	return current
+}
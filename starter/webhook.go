@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxWebhookBody bounds the size of a single purchase notification
+const maxWebhookBody = 1 << 20
+
+// webhookAdapter understands one store's native purchase notifications
+type webhookAdapter struct {
+	// signatureHeader carries the hex HMAC-SHA256 of the raw body, keyed
+	// with the platform's secret and optionally prefixed with "sha256="
+	signatureHeader string
+
+	// decode maps the native payload to PurchaseInput
+	decode func(body []byte) (PurchaseInput, error)
+}
+
+// webhookAdapters has one adapter for every platform in the purchases CHECK list
+var webhookAdapters = map[string]webhookAdapter{
+	"steam":       {signatureHeader: "X-Steam-Signature", decode: decodeSteamWebhook},
+	"epic":        {signatureHeader: "X-Epic-Signature", decode: decodeEpicWebhook},
+	"xbox":        {signatureHeader: "X-Xbox-Signature", decode: decodeXboxWebhook},
+	"playstation": {signatureHeader: "X-PSN-Signature", decode: decodePlayStationWebhook},
+	"nintendo":    {signatureHeader: "X-Nintendo-Signature", decode: decodeNintendoWebhook},
+	"mobile":      {signatureHeader: "X-Mobile-Signature", decode: decodeMobileWebhook},
+}
+
+// WebhookPlatforms lists the platforms that have a webhook adapter
+func WebhookPlatforms() []string {
+	platforms := make([]string, 0, len(webhookAdapters))
+	for p := range webhookAdapters {
+		platforms = append(platforms, p)
+	}
+	return platforms
+}
+
+// DecodeWebhook maps a platform's native purchase notification to PurchaseInput.
+// The result still has to pass ValidatePurchaseInput.
+func DecodeWebhook(platform string, body []byte) (PurchaseInput, error) {
+	adapter, ok := webhookAdapters[platform]
+	if !ok {
+		return PurchaseInput{}, fmt.Errorf("%w: no webhook adapter for platform %q", ErrNotFound, platform)
+	}
+	in, err := adapter.decode(body)
+	if err != nil {
+		return PurchaseInput{}, fmt.Errorf("%w: %s payload: %v", ErrInvalidFormat, platform, err)
+	}
+	in.Platform = platform
+	if in.PlayerLevel == 0 {
+		// Store notifications carry no player level; use the schema default
+		in.PlayerLevel = 1
+	}
+	return in, nil
+}
+
+// VerifyWebhookSignature checks a signature header value against the
+// HMAC-SHA256 of body under secret
+func VerifyWebhookSignature(secret string, body []byte, signature string) bool {
+	got, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(signature), "sha256="))
+	if err != nil || secret == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// handleWebhook accepts a purchase notification in a store's native format,
+// verifies its signature and upserts it like a one-line ingest.
+// ?conflict_policy= applies as for /ingest.
+func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	platform := r.PathValue("platform")
+	adapter, ok := webhookAdapters[platform]
+	secret := s.cfg.WebhookSecrets[platform]
+	if !ok || secret == "" {
+		writeJSONError(w, "No webhook configured for platform "+platform, http.StatusNotFound)
+		return
+	}
+
+	policy, err := ParseConflictPolicy(r.URL.Query().Get("conflict_policy"))
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, fmt.Sprintf("Payload exceeds %d bytes", maxWebhookBody), http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeJSONError(w, "Failed to read payload", http.StatusBadRequest)
+		return
+	}
+
+	if !VerifyWebhookSignature(secret, body, r.Header.Get(adapter.signatureHeader)) {
+		writeJSONError(w, "Invalid or missing "+adapter.signatureHeader, http.StatusUnauthorized)
+		return
+	}
+
+	ingestID, err := newIngestID()
+	if err != nil {
+		writeJSONError(w, "Failed to start ingest", http.StatusInternalServerError)
+		return
+	}
+	resp, err := s.ingestWebhook(r.Context(), ingestID, platform, body, policy)
+	if err != nil {
+		if statusForError(err) == http.StatusInternalServerError {
+			log.Printf("webhook %s (%s) failed: %v", ingestID, platform, err)
+		}
+		writeIngestError(w, resp, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// ingestWebhook decodes, validates and upserts one notification, counting it
+// in the response the way a one-line file ingest would
+func (s *Server) ingestWebhook(ctx context.Context, ingestID, platform string, body []byte, policy ConflictPolicy) (resp IngestResponse, err error) {
+	resp.IngestID = ingestID
+	defer resp.tally()
+
+	input, err := DecodeWebhook(platform, body)
+	if err != nil {
+		resp.Rejected++
+		return resp, err
+	}
+	p, err := input.toPurchase(s.cfg.Timestamps)
+	if err != nil {
+		resp.Rejected++
+		return resp, err
+	}
+
+	res, err := s.store.AddPurchase(ctx, p, LineRef{IngestID: ingestID, Line: 1, Policy: policy, Source: SourceWebhook})
+	switch {
+	case err != nil:
+		return resp, err
+	case res.Created:
+		resp.Created++
+	case res.Updated:
+		resp.Updated++
+	case len(res.Conflict) > 0:
+		resp.addConflict(Conflict{Line: 1, TransactionID: p.TransactionID, Fields: res.Conflict})
+	default:
+		resp.Ignored++
+	}
+	return resp, nil
+}
+
+// webhookItemTypes maps the product kinds used by the stores to item_type
+var webhookItemTypes = map[string]string{
+	"game": "game", "base_game": "game", "full_game": "game", "application": "game", "durable_game": "game",
+	"dlc": "dlc", "add_on": "dlc", "addon": "dlc", "aoc": "dlc", "durable": "dlc",
+	"cosmetic": "cosmetic", "skin": "cosmetic", "item": "cosmetic",
+	"currency": "currency", "virtual_currency": "currency", "consumable": "currency",
+	"season_pass": "season_pass", "pass": "season_pass", "subscription": "season_pass", "ticket": "season_pass",
+}
+
+// itemType normalises a store product kind; unknown kinds are passed through
+// so validation reports them
+func itemType(kind string) string {
+	k := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(kind), "-", "_"))
+	if t, ok := webhookItemTypes[k]; ok {
+		return t
+	}
+	return kind
+}
+
+// unixTimestamp formats epoch seconds as the RFC3339 created_at expected by PurchaseInput
+func unixTimestamp(sec int64) Timestamp {
+	if sec == 0 {
+		return ""
+	}
+	return Timestamp(time.Unix(sec, 0).UTC().Format(time.RFC3339))
+}
+
+// decodeSteamWebhook maps a Steam microtransaction notification. The amount
+// is the sum of its line items; the first item names the purchase.
+func decodeSteamWebhook(body []byte) (PurchaseInput, error) {
+	var n struct {
+		OrderID     string `json:"orderid"`
+		SteamID     string `json:"steamid"`
+		PersonaName string `json:"persona_name"`
+		AppName     string `json:"appname"`
+		Currency    string `json:"currency"`
+		TimeCreated int64  `json:"time_created"`
+		Items       []struct {
+			Description string `json:"description"`
+			Category    string `json:"category"`
+			ItemType    string `json:"itemtype"`
+			Amount      int    `json:"amount"` // cents
+			Quantity    int    `json:"qty"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &n); err != nil {
+		return PurchaseInput{}, err
+	}
+	if len(n.Items) == 0 {
+		return PurchaseInput{}, errors.New("order has no items")
+	}
+
+	amount := 0
+	for _, item := range n.Items {
+		amount += item.Amount * max(item.Quantity, 1)
+	}
+	return PurchaseInput{
+		TransactionID:  prefixedID("steam", n.OrderID),
+		PlayerID:       prefixedID("steam", n.SteamID),
+		PlayerUsername: n.PersonaName,
+		GameTitle:      n.AppName,
+		ItemType:       itemType(n.Items[0].ItemType),
+		Genre:          n.Items[0].Category,
+		AmountCents:    amount,
+		Currency:       n.Currency,
+		CreatedAt:      unixTimestamp(n.TimeCreated),
+	}, nil
+}
+
+// decodeEpicWebhook maps an Epic Games Store PURCHASE_COMPLETED event
+func decodeEpicWebhook(body []byte) (PurchaseInput, error) {
+	var n struct {
+		EventType   string `json:"eventType"`
+		PurchaseID  string `json:"purchaseId"`
+		AccountID   string `json:"accountId"`
+		DisplayName string `json:"displayName"`
+		Offer       struct {
+			Title     string `json:"title"`
+			OfferType string `json:"offerType"`
+			Category  string `json:"category"`
+		} `json:"offer"`
+		Price struct {
+			TotalPrice   int    `json:"totalPrice"` // minor units
+			CurrencyCode string `json:"currencyCode"`
+		} `json:"price"`
+		PurchasedAt Timestamp `json:"purchasedAt"`
+	}
+	if err := json.Unmarshal(body, &n); err != nil {
+		return PurchaseInput{}, err
+	}
+	if n.EventType != "" && n.EventType != "PURCHASE_COMPLETED" {
+		return PurchaseInput{}, fmt.Errorf("unsupported event type %q", n.EventType)
+	}
+
+	return PurchaseInput{
+		TransactionID:  prefixedID("epic", n.PurchaseID),
+		PlayerID:       prefixedID("epic", n.AccountID),
+		PlayerUsername: n.DisplayName,
+		GameTitle:      n.Offer.Title,
+		ItemType:       itemType(n.Offer.OfferType),
+		Genre:          n.Offer.Category,
+		AmountCents:    n.Price.TotalPrice,
+		Currency:       n.Price.CurrencyCode,
+		CreatedAt:      n.PurchasedAt,
+	}, nil
+}
+
+// decodeXboxWebhook maps a Microsoft Store order notification, whose prices
+// are decimal amounts in major units
+func decodeXboxWebhook(body []byte) (PurchaseInput, error) {
+	var n struct {
+		OrderID     string `json:"orderId"`
+		Beneficiary struct {
+			XUID     string `json:"xuid"`
+			Gamertag string `json:"gamertag"`
+		} `json:"beneficiary"`
+		Product struct {
+			Title       string `json:"title"`
+			ProductKind string `json:"productKind"`
+			Genre       string `json:"genre"`
+		} `json:"product"`
+		ListPrice     float64   `json:"listPrice"`
+		CurrencyCode  string    `json:"currencyCode"`
+		PurchasedDate Timestamp `json:"purchasedDate"`
+	}
+	if err := json.Unmarshal(body, &n); err != nil {
+		return PurchaseInput{}, err
+	}
+
+	return PurchaseInput{
+		TransactionID:  prefixedID("xbox", n.OrderID),
+		PlayerID:       prefixedID("xbox", n.Beneficiary.XUID),
+		PlayerUsername: n.Beneficiary.Gamertag,
+		GameTitle:      n.Product.Title,
+		ItemType:       itemType(n.Product.ProductKind),
+		Genre:          n.Product.Genre,
+		AmountCents:    int(math.Round(n.ListPrice * 100)),
+		Currency:       n.CurrencyCode,
+		CreatedAt:      n.PurchasedDate,
+	}, nil
+}
+
+// decodePlayStationWebhook maps a PlayStation Store entitlement grant
+func decodePlayStationWebhook(body []byte) (PurchaseInput, error) {
+	var n struct {
+		TransactionID string `json:"transactionId"`
+		AccountID     string `json:"accountId"`
+		OnlineID      string `json:"onlineId"`
+		Entitlement   struct {
+			Name  string `json:"name"`
+			Type  string `json:"type"`
+			Genre string `json:"genre"`
+		} `json:"entitlement"`
+		Price struct {
+			Value    int    `json:"value"` // minor units
+			Currency string `json:"currency"`
+		} `json:"price"`
+		PurchaseDate Timestamp `json:"purchaseDate"`
+	}
+	if err := json.Unmarshal(body, &n); err != nil {
+		return PurchaseInput{}, err
+	}
+
+	return PurchaseInput{
+		TransactionID:  prefixedID("psn", n.TransactionID),
+		PlayerID:       prefixedID("psn", n.AccountID),
+		PlayerUsername: n.OnlineID,
+		GameTitle:      n.Entitlement.Name,
+		ItemType:       itemType(n.Entitlement.Type),
+		Genre:          n.Entitlement.Genre,
+		AmountCents:    n.Price.Value,
+		Currency:       n.Price.Currency,
+		CreatedAt:      n.PurchaseDate,
+	}, nil
+}
+
+// decodeNintendoWebhook maps a Nintendo eShop order notification
+func decodeNintendoWebhook(body []byte) (PurchaseInput, error) {
+	var n struct {
+		OrderID     string    `json:"order_id"`
+		NSAID       string    `json:"nsa_id"`
+		Nickname    string    `json:"nickname"`
+		TitleName   string    `json:"title_name"`
+		ContentType string    `json:"content_type"`
+		Genre       string    `json:"genre"`
+		Amount      int       `json:"amount"` // minor units
+		Currency    string    `json:"currency"`
+		OrderedAt   Timestamp `json:"ordered_at"`
+	}
+	if err := json.Unmarshal(body, &n); err != nil {
+		return PurchaseInput{}, err
+	}
+
+	return PurchaseInput{
+		TransactionID:  prefixedID("nintendo", n.OrderID),
+		PlayerID:       prefixedID("nintendo", n.NSAID),
+		PlayerUsername: n.Nickname,
+		GameTitle:      n.TitleName,
+		ItemType:       itemType(n.ContentType),
+		Genre:          n.Genre,
+		AmountCents:    n.Amount,
+		Currency:       n.Currency,
+		CreatedAt:      n.OrderedAt,
+	}, nil
+}
+
+// decodeMobileWebhook maps a mobile app store receipt notification, priced
+// in micro-units and timestamped in epoch milliseconds
+func decodeMobileWebhook(body []byte) (PurchaseInput, error) {
+	var n struct {
+		ReceiptID          string `json:"receipt_id"`
+		UserID             string `json:"user_id"`
+		UserName           string `json:"user_name"`
+		AppName            string `json:"app_name"`
+		ProductType        string `json:"product_type"`
+		Category           string `json:"category"`
+		PriceMicros        int64  `json:"price_micros"`
+		Currency           string `json:"currency"`
+		PurchaseTimeMillis int64  `json:"purchase_time_millis"`
+	}
+	if err := json.Unmarshal(body, &n); err != nil {
+		return PurchaseInput{}, err
+	}
+
+	return PurchaseInput{
+		TransactionID:  prefixedID("mobile", n.ReceiptID),
+		PlayerID:       prefixedID("mobile", n.UserID),
+		PlayerUsername: n.UserName,
+		GameTitle:      n.AppName,
+		ItemType:       itemType(n.ProductType),
+		Genre:          n.Category,
+		AmountCents:    int((n.PriceMicros + 5000) / 10000),
+		Currency:       n.Currency,
+		CreatedAt:      unixTimestamp(n.PurchaseTimeMillis / 1000),
+	}, nil
+}
+
+// prefixedID namespaces a store identifier by platform, as in the player IDs
+// of the NDJSON feeds ("steam_7656..."); empty IDs stay empty for validation
+func prefixedID(platform, id string) string {
+	if id == "" {
+		return ""
+	}
+	return platform + "_" + id
+}
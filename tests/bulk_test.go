@@ -0,0 +1,179 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+// bulkStore records whether records were upserted one at a time or loaded
+// in bulk into a memStore
+type bulkStore struct {
+	*memStore
+
+	upserts    int
+	loaded     []int // lines added to the bulk load
+	commitLine int   // the lastLine the bulk load was committed with
+}
+
+func (s *bulkStore) AddPurchase(ctx context.Context, p main.Purchase, ref main.LineRef) (main.UpsertResult, error) {
+	s.upserts++
+	return s.memStore.AddPurchase(ctx, p, ref)
+}
+
+func (s *bulkStore) BeginBulk(ctx context.Context, ref main.LineRef) (main.BulkWriter, error) {
+	bulk, err := s.memStore.BeginBulk(ctx, ref)
+	return &bulkWriter{BulkWriter: bulk, s: s}, err
+}
+
+// bulkWriter is the bulk load of a bulkStore
+type bulkWriter struct {
+	main.BulkWriter
+	s *bulkStore
+}
+
+func (w *bulkWriter) Add(ctx context.Context, rec main.Record) error {
+	w.s.loaded = append(w.s.loaded, rec.Line)
+	return w.BulkWriter.Add(ctx, rec)
+}
+
+func (w *bulkWriter) Commit(ctx context.Context, lastLine int, conflict func(main.Conflict)) (main.BulkResult, error) {
+	w.s.commitLine = lastLine
+	return w.BulkWriter.Commit(ctx, lastLine, conflict)
+}
+
+// TestIngestBulkThreshold tests that an ingest switches to a bulk load only
+// once it has read more records than the BulkThreshold
+func TestIngestBulkThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		records   int
+		threshold int
+		bulk      bool
+	}{
+		{"No threshold", 10, 0, false},
+		{"At the threshold", 10, 10, false},
+		{"Over the threshold", 11, 10, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input strings.Builder
+			for i := 1; i <= tt.records; i++ {
+				fmt.Fprintf(&input, limitRecord+"\n", i)
+			}
+
+			store := &bulkStore{memStore: newMemStore()}
+			ing := main.Ingester{Store: store, BulkThreshold: tt.threshold}
+			resp, err := ing.Run(context.Background(), "bulk", strings.NewReader(input.String()))
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if resp.Created != tt.records {
+				t.Errorf("Got %d created, want %d", resp.Created, tt.records)
+			}
+
+			switch {
+			case tt.bulk && (store.upserts != 0 || len(store.loaded) != tt.records):
+				t.Errorf("Upserted %d and loaded %d records, want all %d loaded in bulk", store.upserts, len(store.loaded), tt.records)
+			case !tt.bulk && (store.upserts != tt.records || len(store.loaded) != 0):
+				t.Errorf("Upserted %d and loaded %d records, want all %d upserted", store.upserts, len(store.loaded), tt.records)
+			}
+		})
+	}
+}
+
+// TestIngestBulkDeferredRefund tests that the checkpoint of a bulk load stops
+// short of the first refund, which is only added once the load commits
+func TestIngestBulkDeferredRefund(t *testing.T) {
+	input := fmt.Sprintf(limitRecord+"\n"+limitRecord+"\n", 1, 2) +
+		`{"event_type":"refund","transaction_id":"TXN-1","created_at":"2025-08-16T10:00:00Z"}` + "\n" +
+		fmt.Sprintf(limitRecord+"\n"+limitRecord+"\n", 3, 4)
+
+	store := &bulkStore{memStore: newMemStore()}
+	store.failLine = 3
+	ing := main.Ingester{Store: store, BulkThreshold: 2, Options: main.IngestOptions{UploadID: "upload-1"}}
+	resp, err := ing.Run(context.Background(), "bulk", strings.NewReader(input))
+	if err == nil {
+		t.Fatal("Run succeeded although the refund could not be added")
+	}
+	if fmt.Sprint(store.loaded) != "[1 2 4 5]" || resp.Created != 4 {
+		t.Errorf("Loaded lines %v with %d created, want lines [1 2 4 5] created", store.loaded, resp.Created)
+	}
+	checkpoint, _ := store.GetCheckpoint(context.Background(), "upload-1")
+	if store.commitLine != 2 || checkpoint != 2 {
+		t.Errorf("Committed through line %d with checkpoint %d, want both before the refund on line 3", store.commitLine, checkpoint)
+	}
+
+	store.failLine = 0
+	resp, err = ing.Run(context.Background(), "bulk", strings.NewReader(input))
+	checkpoint, _ = store.GetCheckpoint(context.Background(), "upload-1")
+	if err != nil || resp.Reversals != 1 || checkpoint != 0 {
+		t.Errorf("Run returned %+v, %v with checkpoint %d; want the refund added and the checkpoint cleared", resp, err, checkpoint)
+	}
+}
+
+// TestBulkMerge tests that a bulk load keeps one version of every repeated
+// transaction_id, chosen by the conflict policy, and counts its records as
+// if they had been upserted one at a time in file order
+func TestBulkMerge(t *testing.T) {
+	staged := []main.Purchase{
+		testPurchase("TXN-1", 200, "2025-08-15T11:00:00Z"),
+		testPurchase("TXN-2", 300, "2025-08-15T10:00:00Z"),
+		testPurchase("TXN-2", 400, "2025-08-15T09:00:00Z"),
+		testPurchase("TXN-2", 500, "2025-08-15T12:00:00Z"),
+	}
+
+	tests := []struct {
+		policy    main.ConflictPolicy
+		want      main.BulkResult
+		conflicts []int
+		amounts   [2]int // stored amount_cents of TXN-1 and TXN-2
+	}{
+		{main.LastWriteWins, main.BulkResult{Created: 1, Updated: 3}, nil, [2]int{200, 500}},
+		{main.FirstWriteWins, main.BulkResult{Created: 1, Ignored: 3}, nil, [2]int{100, 300}},
+		{main.NewerCreatedAtWins, main.BulkResult{Created: 1, Updated: 2, Ignored: 1}, nil, [2]int{200, 500}},
+		{main.RejectOnDiff, main.BulkResult{Created: 1, Conflicted: 3}, []int{1, 3, 4}, [2]int{100, 300}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			store := testStore(t)
+			ctx := context.Background()
+			if _, err := store.AddPurchase(ctx, testPurchase("TXN-1", 100, "2025-08-15T10:00:00Z"), main.LineRef{IngestID: "earlier"}); err != nil {
+				t.Fatal(err)
+			}
+
+			bulk, err := store.BeginBulk(ctx, main.LineRef{IngestID: "bulk", UploadID: "upload-1", Policy: tt.policy})
+			if err != nil {
+				t.Fatalf("BeginBulk failed: %v", err)
+			}
+			for i, p := range staged {
+				if err := bulk.Add(ctx, main.Record{Line: i + 1, Purchase: p}); err != nil {
+					t.Fatalf("Add failed: %v", err)
+				}
+			}
+			var conflicts []int
+			res, err := bulk.Commit(ctx, len(staged), func(c main.Conflict) { conflicts = append(conflicts, c.Line) })
+			if err != nil {
+				t.Fatalf("Commit failed: %v", err)
+			}
+			if res != tt.want || fmt.Sprint(conflicts) != fmt.Sprint(tt.conflicts) {
+				t.Errorf("Got %+v with conflicts on lines %v, want %+v with %v", res, conflicts, tt.want, tt.conflicts)
+			}
+
+			for i, id := range []string{"TXN-1", "TXN-2"} {
+				p, err := store.GetPurchase(ctx, id)
+				if err != nil || p.AmountCents != tt.amounts[i] {
+					t.Errorf("Stored %s with amount %d, %v; want %d", id, p.AmountCents, err, tt.amounts[i])
+				}
+			}
+			if line, err := store.GetCheckpoint(ctx, "upload-1"); err != nil || line != len(staged) {
+				t.Errorf("Checkpoint is %d, %v; want %d", line, err, len(staged))
+			}
+		})
+	}
+}
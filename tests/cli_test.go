@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+// TestIngestCommand tests that the ingest subcommand adds up the outcome of
+// several files, gzipped or not, reports each rejected line and applies
+// the record limits
+func TestIngestCommand(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	fmt.Fprintf(zw, limitRecord+"\n", 3)
+	zw.Close()
+
+	var progress, rejects strings.Builder
+	cmd := main.IngestCommand{
+		Store:    newMemStore(),
+		Progress: &progress,
+		Rejects:  &rejects,
+	}
+
+	plain := fmt.Sprintf(limitRecord+"\n{not json\n"+limitRecord+"\n", 1, 2)
+	if err := cmd.IngestFile(context.Background(), "stdin", strings.NewReader(plain)); err != nil {
+		t.Fatalf("Ingesting plain NDJSON failed: %v", err)
+	}
+	if err := cmd.IngestFile(context.Background(), "archive.ndjson.gz", &gz); err != nil {
+		t.Fatalf("Ingesting gzipped NDJSON failed: %v", err)
+	}
+
+	if cmd.Totals.Created != 3 || cmd.Totals.Rejected != 1 || cmd.Totals.Total != 4 {
+		t.Errorf("Got totals %+v, want 3 created and 1 rejected of 4", cmd.Totals)
+	}
+	if !strings.HasPrefix(rejects.String(), "stdin:2: ") || strings.Count(rejects.String(), "\n") != 1 {
+		t.Errorf("Got rejects %q, want line 2 of stdin", rejects.String())
+	}
+	want := "stdin: 3 lines, 2 created, 0 updated, 1 rejected\narchive.ndjson.gz: 1 lines, 1 created, 0 updated, 0 rejected\n"
+	if progress.String() != want {
+		t.Errorf("Got progress %q, want %q", progress.String(), want)
+	}
+
+	// The record limits of the server apply to each file
+	cmd.Limits = main.IngestLimits{MaxRecords: 1}
+	var limit *main.LimitError
+	if err := cmd.IngestFile(context.Background(), "stdin", strings.NewReader(plain)); !errors.As(err, &limit) || limit.Limit != "max_records" {
+		t.Errorf("Ingesting more records than MaxRecords returned %v, want a max_records LimitError", err)
+	}
+}
@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+// gzipped compresses s
+func gzipped(s string) string {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.String()
+}
+
+// TestIngestCompression tests that gzip uploads are detected from their
+// declared encoding or their magic bytes, and that the ratio guard stops
+// decompression bombs but not small, highly compressible files
+func TestIngestCompression(t *testing.T) {
+	records := func(n int) string {
+		return strings.Repeat(fmt.Sprintf(limitRecord+"\n", 1), n)
+	}
+	small := records(3)
+	large := records(20000) // over 3 MiB, compressing about 300 to 1
+
+	tests := []struct {
+		name     string
+		body     string
+		encoding string
+		maxRatio float64
+		wantErr  error
+		want     int
+	}{
+		{"Plain", small, "", 0, nil, 3},
+		{"Identity", small, "identity", 0, nil, 3},
+		{"Gzip detected from magic bytes", gzipped(small), "", 0, nil, 3},
+		{"Declared gzip", gzipped(small), "gzip", 0, nil, 3},
+		{"Declared x-gzip", gzipped(small), "X-Gzip", 0, nil, 3},
+		{"Declared gzip that is not", small, "gzip", 0, main.ErrInvalidFormat, 0},
+		{"Unsupported encoding", gzipped(small), "br", 0, main.ErrBadInput, 0},
+		{"Small file within the grace", gzipped(records(5000)), "", 10, nil, 5000},
+		{"Ratio exceeded", gzipped(large), "gzip", 10, main.ErrBadInput, -1},
+		{"Ratio guard disabled", gzipped(large), "gzip", 0, nil, 20000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ing := main.Ingester{
+				Store:                 newMemStore(),
+				ContentEncoding:       tt.encoding,
+				MaxDecompressionRatio: tt.maxRatio,
+			}
+			resp, err := ing.Run(context.Background(), "compressed", strings.NewReader(tt.body))
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("Unexpected error: %v", err)
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Fatalf("Got error %v, want %v", err, tt.wantErr)
+			}
+			// every record repeats the first, so all but one are ignored
+			written := resp.Created + resp.Ignored
+			if tt.want >= 0 && written != tt.want {
+				t.Errorf("Got %d written, want %d", written, tt.want)
+			}
+			if tt.want < 0 && (written == 0 || written >= 20000) {
+				t.Errorf("Got %d written, want the records before the guard stopped the upload", written)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+const conflictRecord = `{"transaction_id":"%s","player_id":"player_001","game_title":"Hades","item_type":"game","platform":"steam","amount_cents":%d,"player_level":3,"created_at":"%s"}`
+
+// TestConflictPolicies tests each conflict policy against a stored row and
+// against an earlier line of the same file
+func TestConflictPolicies(t *testing.T) {
+	input := fmt.Sprintf(conflictRecord+"\n", "TXN-1", 200, "2025-08-15T11:00:00Z") + // the stored row, newer
+		fmt.Sprintf(conflictRecord+"\n", "TXN-2", 300, "2025-08-15T10:00:00Z") +
+		fmt.Sprintf(conflictRecord+"\n", "TXN-2", 400, "2025-08-15T09:00:00Z") + // line 2, older
+		fmt.Sprintf(conflictRecord+"\n", "TXN-2", 500, "2025-08-15T12:00:00Z") // line 2, newer
+
+	tests := []struct {
+		policy                              main.ConflictPolicy
+		created, updated, ignored, conflict int
+		amounts                             [2]int // stored amount_cents of TXN-1 and TXN-2
+	}{
+		{main.LastWriteWins, 1, 3, 0, 0, [2]int{200, 500}},
+		{main.FirstWriteWins, 1, 0, 3, 0, [2]int{100, 300}},
+		{main.NewerCreatedAtWins, 1, 2, 1, 0, [2]int{200, 500}},
+		{main.RejectOnDiff, 1, 0, 0, 3, [2]int{100, 300}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			store := testStore(t)
+			ctx := context.Background()
+			if _, err := store.AddPurchase(ctx, testPurchase("TXN-1", 100, "2025-08-15T10:00:00Z"), main.LineRef{IngestID: "earlier"}); err != nil {
+				t.Fatal(err)
+			}
+
+			ing := main.Ingester{Store: store, Options: main.IngestOptions{ConflictPolicy: tt.policy}}
+			resp, err := ing.Run(ctx, "conflicts", strings.NewReader(input))
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if resp.Created != tt.created || resp.Updated != tt.updated || resp.Ignored != tt.ignored || resp.Conflicted != tt.conflict {
+				t.Errorf("Got %+v, want %d created, %d updated, %d ignored and %d conflicted",
+					resp, tt.created, tt.updated, tt.ignored, tt.conflict)
+			}
+
+			for i, id := range []string{"TXN-1", "TXN-2"} {
+				p, err := store.GetPurchase(ctx, id)
+				if err != nil || p.AmountCents != tt.amounts[i] {
+					t.Errorf("Stored %s with amount %d, %v; want %d", id, p.AmountCents, err, tt.amounts[i])
+				}
+			}
+		})
+	}
+}
+
+// TestRejectOnDiffConflicts tests that reject-on-diff reports the line and
+// differing fields of every conflict, and ignores identical duplicates
+func TestRejectOnDiffConflicts(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	if _, err := store.AddPurchase(ctx, testPurchase("TXN-1", 100, "2025-08-15T10:00:00Z"), main.LineRef{IngestID: "earlier"}); err != nil {
+		t.Fatal(err)
+	}
+
+	input := fmt.Sprintf(conflictRecord+"\n", "TXN-1", 100, "2025-08-15T10:00:00Z") + // identical to the stored row
+		fmt.Sprintf(conflictRecord+"\n", "TXN-1", 200, "2025-08-15T10:00:00Z") +
+		fmt.Sprintf(conflictRecord+"\n", "TXN-2", 300, "2025-08-15T10:00:00Z") +
+		fmt.Sprintf(conflictRecord+"\n", "TXN-2", 300, "2025-08-15T11:00:00Z")
+
+	ing := main.Ingester{Store: store, Options: main.IngestOptions{ConflictPolicy: main.RejectOnDiff}}
+	resp, err := ing.Run(ctx, "conflicts", strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if resp.Created != 1 || resp.Ignored != 1 || resp.Conflicted != 2 {
+		t.Errorf("Got %+v, want 1 created, 1 ignored and 2 conflicted", resp)
+	}
+	want := "[{2 TXN-1 [amount_cents]} {4 TXN-2 [created_at]}]"
+	if got := fmt.Sprint(resp.Conflicts); got != want {
+		t.Errorf("Got conflicts %s, want %s", got, want)
+	}
+}
+
+// TestConflictReportCap tests that every conflict is counted but only the
+// first 1000 are detailed in the response
+func TestConflictReportCap(t *testing.T) {
+	var input strings.Builder
+	for i := 1; i <= 1005; i++ {
+		fmt.Fprintf(&input, limitRecord+"\n", i)
+	}
+
+	store := newMemStore()
+	if _, err := (main.Ingester{Store: store}).Run(context.Background(), "first", strings.NewReader(input.String())); err != nil {
+		t.Fatal(err)
+	}
+	changed := strings.ReplaceAll(input.String(), `"amount_cents":2499`, `"amount_cents":2999`)
+	ing := main.Ingester{Store: store, Options: main.IngestOptions{ConflictPolicy: main.RejectOnDiff}}
+	resp, err := ing.Run(context.Background(), "conflicts", strings.NewReader(changed))
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if resp.Conflicted != 1005 || len(resp.Conflicts) != 1000 {
+		t.Fatalf("Got %d conflicts with %d detailed, want 1005 with 1000 detailed", resp.Conflicted, len(resp.Conflicts))
+	}
+	if first, last := resp.Conflicts[0], resp.Conflicts[999]; first.Line != 1 || last.Line != 1000 || last.TransactionID != "TXN-1000" {
+		t.Errorf("Detailed conflicts run from %+v to %+v, want lines 1 to 1000", first, last)
+	}
+}
@@ -0,0 +1,655 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	main "gaming-purchases-system"
+)
+
+// testDB connects to the PostgreSQL database in TEST_DATABASE_URL, applies
+// sql/schema.sql and empties every table. Tests using it are skipped when
+// the variable is unset.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	schema, err := os.ReadFile("../sql/schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, string(schema)); err != nil {
+		t.Fatalf("Applying the schema failed: %v", err)
+	}
+	_, err = db.ExecContext(ctx, `
+		TRUNCATE purchases, player_loyalty, refunds, loyalty_ledger, purchase_revisions,
+			ingest_rejects, ingest_jobs, ingest_job_uploads, ingest_checkpoints,
+			ingest_idempotency_keys, ingest_files
+		RESTART IDENTITY CASCADE`)
+	if err != nil {
+		t.Fatalf("Emptying the tables failed: %v", err)
+	}
+	return db
+}
+
+// testStore returns a Store on an empty test database; see testDB
+func testStore(t *testing.T) main.Store {
+	t.Helper()
+	return main.NewStore(testDB(t))
+}
+
+// testPurchase returns a valid purchase of amountCents at createdAt, an RFC 3339 time
+func testPurchase(transactionID string, amountCents int, createdAt string) main.Purchase {
+	at, err := time.Parse(time.RFC3339, createdAt)
+	if err != nil {
+		panic(err)
+	}
+	return main.Purchase{
+		TransactionID: transactionID,
+		PlayerID:      "player_001",
+		GameTitle:     "Hades",
+		ItemType:      "game",
+		Platform:      "steam",
+		AmountCents:   amountCents,
+		Currency:      "USD",
+		PlayerLevel:   3,
+		CreatedAt:     at,
+	}
+}
+
+// memStore is an in-memory Store for the tests that need no database.
+// Tests wanting other behaviour embed it and override the methods
+// concerned, so every other method they reach still works.
+type memStore struct {
+	latency  time.Duration // added to every purchase and refund written
+	failLine int           // the write of this line fails, when set
+
+	mu          sync.Mutex
+	lastID      int64
+	purchases   map[string]main.Purchase
+	revisions   map[string][]main.PurchaseRevision
+	refunds     map[string]map[main.EventType]main.Refund
+	loyalty     map[string]int // balance of each player
+	credits     map[string]int // points of each credited purchase not yet taken back
+	rejects     map[string][]main.LineError
+	batches     []int // sizes of the reject batches saved
+	checkpoints map[string]int
+	jobs        map[string]main.IngestJob
+	uploads     map[string][]byte
+	keys        map[string]main.IdempotencyRecord
+	files       map[string]main.IngestFile
+}
+
+var _ main.Store = (*memStore)(nil)
+
+func newMemStore() *memStore {
+	return &memStore{
+		purchases:   make(map[string]main.Purchase),
+		revisions:   make(map[string][]main.PurchaseRevision),
+		refunds:     make(map[string]map[main.EventType]main.Refund),
+		loyalty:     make(map[string]int),
+		credits:     make(map[string]int),
+		rejects:     make(map[string][]main.LineError),
+		checkpoints: make(map[string]int),
+		jobs:        make(map[string]main.IngestJob),
+		uploads:     make(map[string][]byte),
+		keys:        make(map[string]main.IdempotencyRecord),
+		files:       make(map[string]main.IngestFile),
+	}
+}
+
+// errWriteFailed is returned for the write of memStore.failLine
+var errWriteFailed = errors.New("connection lost")
+
+func (s *memStore) AddPurchase(ctx context.Context, p main.Purchase, ref main.LineRef) (main.UpsertResult, error) {
+	time.Sleep(s.latency)
+	if s.failLine != 0 && ref.Line == s.failLine {
+		return main.UpsertResult{}, errWriteFailed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := s.upsert(p, ref)
+	if ref.UploadID != "" {
+		s.checkpoints[ref.UploadID] = max(s.checkpoints[ref.UploadID], ref.Line)
+	}
+	return res, nil
+}
+
+// upsert applies a purchase under the conflict policy of ref
+func (s *memStore) upsert(p main.Purchase, ref main.LineRef) main.UpsertResult {
+	p.IngestID, p.IngestSource, p.SourceFile, p.SourceLine = ref.IngestID, ref.Source, ref.FileName, ref.Line
+	stored, ok := s.purchases[p.TransactionID]
+	if !ok {
+		s.lastID++
+		p.ID = s.lastID
+		s.purchases[p.TransactionID] = p
+		return main.UpsertResult{Created: true}
+	}
+
+	fields := changedFields(stored, p)
+	switch {
+	case len(fields) == 0, ref.Policy == main.FirstWriteWins:
+		return main.UpsertResult{}
+	case ref.Policy == main.RejectOnDiff:
+		return main.UpsertResult{Conflict: fields}
+	case ref.Policy == main.NewerCreatedAtWins && !p.CreatedAt.After(stored.CreatedAt):
+		return main.UpsertResult{}
+	}
+	s.revisions[p.TransactionID] = append(s.revisions[p.TransactionID], main.PurchaseRevision{
+		ID:            int64(len(s.revisions[p.TransactionID]) + 1),
+		IngestID:      ref.IngestID,
+		IngestSource:  ref.Source,
+		SourceFile:    ref.FileName,
+		Line:          ref.Line,
+		ChangedFields: fields,
+		Previous:      stored,
+		RevisedAt:     time.Now(),
+	})
+	p.ID, p.Enriched = stored.ID, stored.Enriched
+	s.purchases[p.TransactionID] = p
+	return main.UpsertResult{Updated: true}
+}
+
+// changedFields returns the names of the ingested fields that differ between two purchases
+func changedFields(a, b main.Purchase) []string {
+	var fields []string
+	for _, f := range []struct {
+		name    string
+		differs bool
+	}{
+		{"player_id", a.PlayerID != b.PlayerID},
+		{"player_username", a.PlayerUsername != b.PlayerUsername},
+		{"game_title", a.GameTitle != b.GameTitle},
+		{"item_type", a.ItemType != b.ItemType},
+		{"genre", a.Genre != b.Genre},
+		{"platform", a.Platform != b.Platform},
+		{"amount_cents", a.AmountCents != b.AmountCents},
+		{"currency", a.Currency != b.Currency},
+		{"player_level", a.PlayerLevel != b.PlayerLevel},
+		{"created_at", !a.CreatedAt.Equal(b.CreatedAt)},
+	} {
+		if f.differs {
+			fields = append(fields, f.name)
+		}
+	}
+	return fields
+}
+
+func (s *memStore) GetPurchase(ctx context.Context, transactionID string) (main.Purchase, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.purchases[transactionID]
+	if !ok {
+		return main.Purchase{}, main.ErrNotFound
+	}
+	return p, nil
+}
+
+func (s *memStore) ListAfterID(ctx context.Context, afterID int64, limit int, filter main.PurchaseFilter) ([]main.Purchase, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []main.Purchase
+	for _, p := range s.purchases {
+		if p.ID > afterID && (filter.IngestID == "" || p.IngestID == filter.IngestID) {
+			list = append(list, p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+func (s *memStore) ClaimBatchForEnrichment(ctx context.Context, batch int) ([]main.Purchase, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var claimed []main.Purchase
+	for _, p := range s.purchases {
+		if !p.Enriched && len(claimed) < batch {
+			claimed = append(claimed, p)
+		}
+	}
+	return claimed, nil
+}
+
+// CreditLoyalty credits a purchase once, like EnrichmentStore.CreditLoyalty
+func (s *memStore) CreditLoyalty(ctx context.Context, p main.Purchase, points int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.credits[p.TransactionID]; !ok {
+		s.credits[p.TransactionID] = points
+		s.loyalty[p.PlayerID] += points
+	}
+	return nil
+}
+
+func (s *memStore) MarkEnriched(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for txn, p := range s.purchases {
+		if p.ID == id {
+			p.Enriched = true
+			s.purchases[txn] = p
+			return nil
+		}
+	}
+	return main.ErrNotFound
+}
+
+// SaveRejects fails on a line saved before for the ingest, like the
+// primary key of ingest_rejects
+func (s *memStore) SaveRejects(ctx context.Context, ingestID string, rejects []main.LineError) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rej := range rejects {
+		for _, saved := range s.rejects[ingestID] {
+			if saved.Line == rej.Line {
+				return fmt.Errorf("line %d of ingest %s was already rejected", rej.Line, ingestID)
+			}
+		}
+	}
+	s.rejects[ingestID] = append(s.rejects[ingestID], rejects...)
+	s.batches = append(s.batches, len(rejects))
+	return nil
+}
+
+func (s *memStore) StreamRejects(ctx context.Context, ingestID string, fn func(main.LineError) error) error {
+	s.mu.Lock()
+	rejects := s.rejects[ingestID]
+	s.mu.Unlock()
+	if len(rejects) == 0 {
+		return main.ErrNotFound
+	}
+	for _, rej := range rejects {
+		if err := fn(rej); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// savedBatches returns the sizes of the reject batches saved so far
+func (s *memStore) savedBatches() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.batches...)
+}
+
+func (s *memStore) CreateJob(ctx context.Context, job main.IngestJob, upload io.Reader) (main.IngestJob, error) {
+	data, err := io.ReadAll(upload)
+	if err != nil {
+		return main.IngestJob{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.State, job.UploadBytes, job.CreatedAt = main.JobQueued, int64(len(data)), time.Now()
+	s.jobs[job.ID] = job
+	s.uploads[job.ID] = data
+	return job, nil
+}
+
+func (s *memStore) GetJob(ctx context.Context, id string) (main.IngestJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return main.IngestJob{}, main.ErrNotFound
+	}
+	return job, nil
+}
+
+func (s *memStore) OpenJobUpload(ctx context.Context, id string) (io.Reader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.uploads[id]
+	if !ok {
+		return nil, main.ErrNotFound
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (s *memStore) ClaimJob(ctx context.Context, runner string, lease time.Duration) (main.IngestJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var oldest *main.IngestJob
+	for _, job := range s.jobs {
+		if job.State == main.JobQueued && (oldest == nil || job.CreatedAt.Before(oldest.CreatedAt)) {
+			oldest = &job
+		}
+	}
+	if oldest == nil {
+		return main.IngestJob{}, main.ErrNotFound
+	}
+	now := time.Now()
+	expires := now.Add(lease)
+	oldest.State, oldest.StartedAt, oldest.ClaimedBy, oldest.LeaseExpiresAt = main.JobRunning, &now, runner, &expires
+	s.jobs[oldest.ID] = *oldest
+	return *oldest, nil
+}
+
+// runningJob returns the running job id held by runner
+func (s *memStore) runningJob(id, runner string) (main.IngestJob, error) {
+	job, ok := s.jobs[id]
+	if !ok || job.State != main.JobRunning || job.ClaimedBy != runner {
+		return main.IngestJob{}, main.ErrNotFound
+	}
+	return job, nil
+}
+
+func (s *memStore) RenewJobLease(ctx context.Context, id, runner string, lease time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, err := s.runningJob(id, runner)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(lease)
+	job.LeaseExpiresAt = &expires
+	s.jobs[id] = job
+	return nil
+}
+
+func (s *memStore) UpdateJobProgress(ctx context.Context, id string, progress main.IngestResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return main.ErrNotFound
+	}
+	job.LinesProcessed, job.Created, job.Updated, job.Rejected = progress.Total, progress.Created, progress.Updated, progress.Rejected
+	s.jobs[id] = job
+	return nil
+}
+
+func (s *memStore) FinishJob(ctx context.Context, id, runner string, result main.IngestResponse, jobErr error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, err := s.runningJob(id, runner)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	job.State, job.FinishedAt, job.Result = main.JobSucceeded, &now, &result
+	if jobErr != nil {
+		job.State, job.Error = main.JobFailed, jobErr.Error()
+	}
+	job.LinesProcessed, job.Created, job.Updated, job.Rejected = result.Total, result.Created, result.Updated, result.Rejected
+	job.ClaimedBy, job.LeaseExpiresAt = "", nil
+	s.jobs[id] = job
+	delete(s.uploads, id)
+	return nil
+}
+
+func (s *memStore) RequeueExpiredJobs(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, job := range s.jobs {
+		if job.State != main.JobRunning || job.LeaseExpiresAt == nil || job.LeaseExpiresAt.After(time.Now()) {
+			continue
+		}
+		s.jobs[id] = main.IngestJob{ID: id, State: main.JobQueued, FileName: job.FileName, UploadBytes: job.UploadBytes,
+			ContentEncoding: job.ContentEncoding, Options: job.Options, CreatedAt: job.CreatedAt}
+		delete(s.rejects, id)
+		n++
+	}
+	return n, nil
+}
+
+func (s *memStore) GetCheckpoint(ctx context.Context, uploadID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoints[uploadID], nil
+}
+
+func (s *memStore) SaveCheckpoint(ctx context.Context, uploadID, ingestID string, line int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[uploadID] = max(s.checkpoints[uploadID], line)
+	return nil
+}
+
+func (s *memStore) ClearCheckpoint(ctx context.Context, uploadID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.checkpoints, uploadID)
+	return nil
+}
+
+// BeginBulk starts a bulk load whose purchases are applied when it commits
+func (s *memStore) BeginBulk(ctx context.Context, ref main.LineRef) (main.BulkWriter, error) {
+	return &memBulk{s: s, ref: ref}, nil
+}
+
+// memBulk is a bulk load into a memStore
+type memBulk struct {
+	s    *memStore
+	ref  main.LineRef
+	recs []main.Record
+}
+
+func (b *memBulk) Add(ctx context.Context, rec main.Record) error {
+	b.recs = append(b.recs, rec)
+	return nil
+}
+
+func (b *memBulk) Commit(ctx context.Context, lastLine int, conflict func(main.Conflict)) (main.BulkResult, error) {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+	var res main.BulkResult
+	for _, rec := range b.recs {
+		ref := b.ref
+		ref.Line = rec.Line
+		switch up := b.s.upsert(rec.Purchase, ref); {
+		case up.Created:
+			res.Created++
+		case up.Updated:
+			res.Updated++
+		case len(up.Conflict) > 0:
+			res.Conflicted++
+			conflict(main.Conflict{Line: rec.Line, TransactionID: rec.Purchase.TransactionID, Fields: up.Conflict})
+		default:
+			res.Ignored++
+		}
+	}
+	if b.ref.UploadID != "" {
+		b.s.checkpoints[b.ref.UploadID] = max(b.s.checkpoints[b.ref.UploadID], lastLine)
+	}
+	return res, nil
+}
+
+func (b *memBulk) Rollback() error {
+	b.recs = nil
+	return nil
+}
+
+func (s *memStore) PurchaseHistory(ctx context.Context, transactionID string) (main.Purchase, []main.PurchaseRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.purchases[transactionID]
+	if !ok {
+		return main.Purchase{}, nil, main.ErrNotFound
+	}
+	return p, append([]main.PurchaseRevision(nil), s.revisions[transactionID]...), nil
+}
+
+// AddRefund records a refund or chargeback of a stored purchase; one
+// already recorded is ignored
+func (s *memStore) AddRefund(ctx context.Context, r main.Refund, ref main.LineRef) (main.UpsertResult, error) {
+	time.Sleep(s.latency)
+	if s.failLine != 0 && ref.Line == s.failLine {
+		return main.UpsertResult{}, errWriteFailed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.purchases[r.TransactionID]
+	if !ok {
+		return main.UpsertResult{}, fmt.Errorf("%w: %s references unknown transaction_id %q", main.ErrBadInput, r.EventType, r.TransactionID)
+	}
+	if ref.UploadID != "" {
+		s.checkpoints[ref.UploadID] = max(s.checkpoints[ref.UploadID], ref.Line)
+	}
+	if _, ok := s.refunds[r.TransactionID][r.EventType]; ok {
+		return main.UpsertResult{}, nil
+	}
+	if s.refunds[r.TransactionID] == nil {
+		s.refunds[r.TransactionID] = make(map[main.EventType]main.Refund)
+	}
+	if r.AmountCents == 0 {
+		r.AmountCents = p.AmountCents
+	}
+	res := main.UpsertResult{Created: true}
+	if credit, ok := s.credits[r.TransactionID]; ok && p.Enriched {
+		r.Processed, r.PointsDue = true, min(r.AmountCents/100, credit)
+		r.PointsDeducted = min(r.PointsDue, s.loyalty[p.PlayerID])
+		r.DeductionCapped = r.PointsDeducted < r.PointsDue
+		s.credits[r.TransactionID] -= r.PointsDeducted
+		s.loyalty[p.PlayerID] -= r.PointsDeducted
+		res.Reversal = &r
+	}
+	s.refunds[r.TransactionID][r.EventType] = r
+	return res, nil
+}
+
+func (s *memStore) GetRefunds(ctx context.Context, transactionID string) ([]main.Refund, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var refunds []main.Refund
+	for _, r := range s.refunds[transactionID] {
+		refunds = append(refunds, r)
+	}
+	if len(refunds) == 0 {
+		return nil, main.ErrNotFound
+	}
+	sort.Slice(refunds, func(i, j int) bool { return refunds[i].CreatedAt.Before(refunds[j].CreatedAt) })
+	return refunds, nil
+}
+
+// ClaimIdempotencyKey claims a key unless it is held or completed; a
+// memStore never lets a lease run out
+func (s *memStore) ClaimIdempotencyKey(ctx context.Context, key, bodyHash string, retention, lease time.Duration) (main.IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.keys[key]; ok && rec.ExpiresAt.After(time.Now()) {
+		return rec, false, nil
+	}
+	s.keys[key] = main.IdempotencyRecord{Key: key, BodyHash: bodyHash, ExpiresAt: time.Now().Add(retention)}
+	return s.keys[key], true, nil
+}
+
+func (s *memStore) RenewIdempotencyKey(ctx context.Context, key string) error {
+	return nil
+}
+
+func (s *memStore) CompleteIdempotencyKey(ctx context.Context, key string, status int, location string, response []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.keys[key]
+	if !ok || rec.Completed {
+		return main.ErrNotFound
+	}
+	rec.Completed, rec.StatusCode, rec.Location, rec.Response = true, status, location, response
+	s.keys[key] = rec
+	return nil
+}
+
+func (s *memStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.keys[key].Completed {
+		delete(s.keys, key)
+	}
+	return nil
+}
+
+func (s *memStore) PurgeIdempotencyKeys(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for key, rec := range s.keys {
+		if !rec.ExpiresAt.After(time.Now()) {
+			delete(s.keys, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memStore) FindIngestFile(ctx context.Context, hash string) (main.IngestFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[hash]
+	if !ok {
+		return main.IngestFile{}, main.ErrNotFound
+	}
+	return f, nil
+}
+
+func (s *memStore) RecordIngestFile(ctx context.Context, f main.IngestFile) (main.IngestFile, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if original, ok := s.files[f.Hash]; ok {
+		return original, true, nil
+	}
+	f.IngestedAt = time.Now()
+	s.files[f.Hash] = f
+	return main.IngestFile{}, false, nil
+}
+
+// RollbackIngest deletes the purchases an ingest created and restores those
+// it updated, leaving alone those changed by a later ingest
+func (s *memStore) RollbackIngest(ctx context.Context, ingestID string, skipConflicts bool) (main.RollbackResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := main.RollbackResult{IngestID: ingestID, RolledBack: true}
+	for txn, p := range s.purchases {
+		if p.IngestID != ingestID {
+			continue
+		}
+		revs := s.revisions[txn]
+		if n := len(revs); n > 0 && revs[n-1].IngestID == ingestID {
+			s.purchases[txn] = revs[n-1].Previous
+			s.revisions[txn] = revs[:n-1]
+			res.Restored++
+			continue
+		}
+		delete(s.purchases, txn)
+		delete(s.revisions, txn)
+		res.Deleted++
+	}
+	return res, nil
+}
+
+func (s *memStore) LookupTransactions(ctx context.Context, transactionIDs []string) (map[string]main.StoredTransaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := make(map[string]main.StoredTransaction)
+	for _, id := range transactionIDs {
+		if p, ok := s.purchases[id]; ok {
+			found[id] = main.StoredTransaction{Purchase: p, Refunds: s.refunds[id]}
+		}
+	}
+	return found, nil
+}
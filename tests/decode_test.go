@@ -0,0 +1,170 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+// TestDecoders tests that every format yields the same purchases and rejects
+func TestDecoders(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		input       string
+		wantLines   []int // lines, or array elements, of the valid records
+		wantRejects []int
+	}{
+		{
+			name:   "ndjson",
+			format: "ndjson",
+			input: `{"transaction_id":"TXN-001","player_id":"player_001","game_title":"Cyberpunk 2077","item_type":"game","platform":"steam","amount_cents":5999,"player_level":15,"created_at":"2025-08-15T10:00:00Z"}
+{"transaction_id":"TXN-002","player_id":"player_002","game_title":"Minecraft","item_type":"game","platform":"sega","amount_cents":2699,"player_level":8,"created_at":"2025-08-15T11:00:00Z"}
+
+{"transaction_id":"TXN-003","player_id":"player_003","game_title":"Fortnite","item_type":"cosmetic","platform":"epic","amount_cents":"lots","player_level":3,"created_at":"2025-08-15T12:00:00Z"}
+{"transaction_id":"TXN-004","player_id":"player_004","game_title":"Halo","item_type":"dlc","platform":"xbox","amount_cents":999,"player_level":20,"created_at":"2025-08-15T13:00:00Z"}
+`,
+			wantLines:   []int{1, 5},
+			wantRejects: []int{2, 4},
+		},
+		{
+			name:   "json array",
+			format: "json",
+			input: `[
+  {"transaction_id":"TXN-001","player_id":"player_001","game_title":"Cyberpunk 2077","item_type":"game","platform":"steam","amount_cents":5999,"player_level":15,"created_at":"2025-08-15T10:00:00Z"},
+  {"transaction_id":"TXN-002","player_id":"player_002","game_title":"Minecraft","item_type":"game","platform":"sega","amount_cents":2699,"player_level":8,"created_at":"2025-08-15T11:00:00Z"},
+  {"transaction_id":"TXN-003","player_id":"player_003","game_title":"Fortnite","item_type":"cosmetic","platform":"epic","amount_cents":"lots","player_level":3,"created_at":"2025-08-15T12:00:00Z"},
+  {"transaction_id":"TXN-004","player_id":"player_004","game_title":"Halo","item_type":"dlc","platform":"xbox","amount_cents":999,"player_level":20,"created_at":"2025-08-15T13:00:00Z"}
+]`,
+			wantLines:   []int{1, 4},
+			wantRejects: []int{2, 3},
+		},
+		{
+			name:   "csv",
+			format: "csv",
+			input: "Transaction_ID,player_id,game_title,item_type,platform,amount_cents,player_level,created_at,notes\n" +
+				"TXN-001,player_001,Cyberpunk 2077,game,steam,5999,15,2025-08-15T10:00:00Z,\n" +
+				"TXN-002,player_002,Minecraft,game,sega,2699,8,2025-08-15T11:00:00Z,\n" +
+				"TXN-003,player_003,Fortnite,cosmetic,epic,lots,3,2025-08-15T12:00:00Z,\n" +
+				"TXN-004,player_004,\"Halo, Combat Evolved\",dlc,xbox,999,20,2025-08-15T13:00:00Z,\"multi\nline\"\n",
+			wantLines:   []int{2, 5},
+			wantRejects: []int{3, 4},
+		},
+		{
+			name:   "tsv",
+			format: "tsv",
+			input: "transaction_id\tplayer_id\tgame_title\titem_type\tplatform\tamount_cents\tplayer_level\tcreated_at\n" +
+				"TXN-001\tplayer_001\tCyberpunk 2077\tgame\tsteam\t5999\t15\t2025-08-15T10:00:00Z\n" +
+				"TXN-002\tplayer_002\tMinecraft\tgame\tsega\t2699\t8\t2025-08-15T11:00:00Z\n" +
+				"TXN-003\tplayer_003\tFortnite\tcosmetic\tepic\tlots\t3\t2025-08-15T12:00:00Z\n" +
+				"TXN-004\tplayer_004\tHalo \"CE\"\tdlc\txbox\t999\t20\t2025-08-15T13:00:00Z\n",
+			wantLines:   []int{2, 5},
+			wantRejects: []int{3, 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := main.LookupFormat(tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				purchases []main.Purchase
+				lines     []int
+				rejects   []int
+			)
+			opts := main.StreamOptions{Reject: func(rej main.LineError) error {
+				rejects = append(rejects, rej.Line)
+				if rej.Raw == "" {
+					t.Errorf("reject at line %d has no raw record", rej.Line)
+				}
+				return nil
+			}}
+			err = main.StreamRecords(context.Background(), format.NewDecoder(strings.NewReader(tt.input)), opts, func(rec main.Record) error {
+				purchases = append(purchases, rec.Purchase)
+				lines = append(lines, rec.Line)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if len(purchases) != 2 || purchases[0].TransactionID != "TXN-001" || purchases[1].TransactionID != "TXN-004" {
+				t.Fatalf("Got purchases %+v, want TXN-001 and TXN-004", purchases)
+			}
+			if purchases[0].AmountCents != 5999 || purchases[0].PlayerLevel != 15 || purchases[0].Currency != "USD" {
+				t.Errorf("Got purchase %+v, want amount 5999, level 15, currency USD", purchases[0])
+			}
+			if fmt.Sprint(lines) != fmt.Sprint(tt.wantLines) {
+				t.Errorf("Got lines %v, want %v", lines, tt.wantLines)
+			}
+			if fmt.Sprint(rejects) != fmt.Sprint(tt.wantRejects) {
+				t.Errorf("Got rejects at %v, want %v", rejects, tt.wantRejects)
+			}
+		})
+	}
+}
+
+// TestDecoderFatalErrors tests input that cannot be read past
+func TestDecoderFatalErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		input  string
+	}{
+		{name: "json object instead of array", format: "json", input: `{"transaction_id":"TXN-001"}`},
+		{name: "truncated json array", format: "json", input: `[{"transaction_id":"TXN-001"}`},
+		{name: "malformed json element", format: "json", input: `[{"transaction_id":}]`},
+		{name: "data after json array", format: "json", input: `[] []`},
+		{name: "csv without transaction_id", format: "csv", input: "player_id,amount_cents\nplayer_001,100\n"},
+		{name: "csv with repeated column", format: "csv", input: "transaction_id,Transaction_ID\nTXN-001,TXN-001\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := main.LookupFormat(tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := main.StreamOptions{Reject: func(main.LineError) error { return nil }}
+			err = main.StreamRecords(context.Background(), format.NewDecoder(strings.NewReader(tt.input)), opts, func(main.Record) error { return nil })
+			if !errors.Is(err, main.ErrInvalidFormat) {
+				t.Errorf("Expected ErrInvalidFormat, got %v", err)
+			}
+		})
+	}
+}
+
+// TestDetectFormat tests format selection by Content-Type and file name
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		contentType string
+		fileName    string
+		want        string
+	}{
+		{contentType: "text/csv; charset=utf-8", fileName: "purchases.ndjson", want: "csv"},
+		{contentType: "application/json", fileName: "", want: "json"},
+		{contentType: "application/x-ndjson", fileName: "purchases.json", want: "ndjson"},
+		{contentType: "application/octet-stream", fileName: "purchases.tsv", want: "tsv"},
+		{contentType: "", fileName: "Purchases.CSV.gz", want: "csv"},
+		{contentType: "", fileName: "purchases.jsonl", want: "ndjson"},
+		{contentType: "", fileName: "purchases.txt", want: "ndjson"},
+		{contentType: "not a type", fileName: "", want: "ndjson"},
+	}
+
+	for _, tt := range tests {
+		if got := main.DetectFormat(tt.contentType, tt.fileName).Name; got != tt.want {
+			t.Errorf("DetectFormat(%q, %q) = %s, want %s", tt.contentType, tt.fileName, got, tt.want)
+		}
+	}
+
+	if _, err := main.LookupFormat("xml"); !errors.Is(err, main.ErrBadInput) {
+		t.Errorf("LookupFormat(xml) error = %v, want ErrBadInput", err)
+	}
+}
@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	main "gaming-purchases-system"
+)
+
+// sseEvent is one event read from a Server-Sent Events stream
+type sseEvent struct {
+	name string
+	data string
+}
+
+// readEvents collects the events of a stream until it ends
+func readEvents(t *testing.T, url string, ready chan<- struct{}) []sseEvent {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Got Content-Type %q, want text/event-stream", ct)
+	}
+	ready <- struct{}{}
+
+	var (
+		events []sseEvent
+		ev     sseEvent
+	)
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			ev.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		case line == "" && ev.name != "":
+			events = append(events, ev)
+			ev = sseEvent{}
+		}
+	}
+	return events
+}
+
+// TestJobEventsFinished tests that the summary of a job finished by another
+// process is its stored result, not only the totals kept with the job
+func TestJobEventsFinished(t *testing.T) {
+	result := main.IngestResponse{IngestID: "job-1", Created: 2, Ignored: 1, Reversals: 1, Total: 4}
+	store := newMemStore()
+	store.jobs["job-1"] = main.IngestJob{ID: "job-1", State: main.JobSucceeded, Created: 2, LinesProcessed: 4, Result: &result}
+	srv := httptest.NewServer(main.NewServer(store, main.ServerConfig{JobEvents: main.NewJobEvents()}))
+	defer srv.Close()
+
+	ready := make(chan struct{}, 1)
+	events := readEvents(t, srv.URL+"/ingest/jobs/job-1/events", ready)
+	if len(events) != 1 || events[0].name != "summary" {
+		t.Fatalf("Got events %v, want the summary only", events)
+	}
+	var summary main.JobSummary
+	if err := json.Unmarshal([]byte(events[0].data), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.State != main.JobSucceeded || summary.IngestResponse.Ignored != 1 || summary.Reversals != 1 {
+		t.Errorf("Got summary %+v, want the stored result of the succeeded job", summary)
+	}
+}
+
+// TestJobEvents tests that several clients watching a job all see its
+// progress and final summary
+func TestJobEvents(t *testing.T) {
+	hub := main.NewJobEvents()
+	store := newMemStore()
+	store.jobs["job-1"] = main.IngestJob{ID: "job-1", State: main.JobRunning}
+	srv := httptest.NewServer(main.NewServer(store, main.ServerConfig{JobEvents: hub}))
+	defer srv.Close()
+
+	if resp, err := http.Get(srv.URL + "/ingest/jobs/job-2/events"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Unknown job: got %v, %v; want 404", resp, err)
+	}
+
+	hub.Start("job-1")
+
+	const watchers = 3
+	ready := make(chan struct{}, watchers)
+	results := make(chan []sseEvent, watchers)
+	for i := 0; i < watchers; i++ {
+		go func() { results <- readEvents(t, srv.URL+"/ingest/jobs/job-1/events", ready) }()
+	}
+	for i := 0; i < watchers; i++ {
+		<-ready
+	}
+
+	hub.Progress("job-1", main.JobProgress{Lines: 10, Created: 9, Rejected: 1, Bytes: 512, TotalBytes: 1024})
+	time.Sleep(50 * time.Millisecond)
+	hub.Finish("job-1", main.JobSummary{
+		State:          main.JobSucceeded,
+		IngestResponse: main.IngestResponse{IngestID: "job-1", Created: 18, Rejected: 2, Total: 20},
+	})
+
+	for i := 0; i < watchers; i++ {
+		var events []sseEvent
+		select {
+		case events = <-results:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Event stream did not end after the summary")
+		}
+		if len(events) == 0 || events[len(events)-1].name != "summary" {
+			t.Fatalf("Got events %v, want a final summary", events)
+		}
+
+		var summary main.IngestResponse
+		if err := json.Unmarshal([]byte(events[len(events)-1].data), &summary); err != nil {
+			t.Fatal(err)
+		}
+		if summary.Created != 18 || summary.Rejected != 2 || summary.Total != 20 {
+			t.Errorf("Got summary %+v, want 18 created and 2 rejected of 20", summary)
+		}
+		for _, ev := range events[:len(events)-1] {
+			var p main.JobProgress
+			if ev.name != "progress" || json.Unmarshal([]byte(ev.data), &p) != nil || p.Lines != 10 || p.Bytes != 512 {
+				t.Errorf("Got event %v, want progress at line 10", ev)
+			}
+		}
+	}
+}
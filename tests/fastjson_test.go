@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+const fastRecord = `{"transaction_id":"txn-1","player_id":"p-1","player_username":"alice","game_title":"Elden Ring","item_type":"dlc","genre":"rpg","platform":"steam","amount_cents":1999,"currency":"USD","player_level":42,"created_at":"2024-03-01T12:00:00Z"}`
+
+// FuzzPurchaseDecoder tests that PurchaseDecoder decodes every input exactly
+// as encoding/json does, whether or not it takes its fast path
+func FuzzPurchaseDecoder(f *testing.F) {
+	for _, seed := range []string{
+		fastRecord,
+		` { "transaction_id" : "t" , "amount_cents" : -0 , "created_at" : 1.5e3 } `,
+		`{"created_at":1709294400,"event_type":"refund","extra":[1,2],"note":true}`,
+		`{"platform":"switch","platform":null,"created_at":"x","created_at":null}`,
+		`{"game_title":"Pokémon é","Currency":"eur","amount_cents":1.0}`,
+		`{"amount_cents":99999999999999999999,"player_level":"3"}`,
+		`{"genre":"\xff","schema_version":2}`,
+		`{"transaction_id":"a"}x`,
+		`{}`, `null`, `[]`, `{`, ``,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	pd := main.NewPurchaseDecoder()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var want main.PurchaseInput
+		wantErr := json.Unmarshal(data, &want)
+
+		var fast main.PurchaseInput
+		if pd.TryDecode(data, &fast) {
+			if wantErr != nil {
+				t.Fatalf("TryDecode(%q) succeeded, encoding/json failed: %v", data, wantErr)
+			}
+			if !reflect.DeepEqual(fast, want) {
+				t.Fatalf("TryDecode(%q) = %+v, encoding/json gives %+v", data, fast, want)
+			}
+		}
+
+		var got main.PurchaseInput
+		err := pd.Decode(data, &got)
+		if (err == nil) != (wantErr == nil) || err != nil && err.Error() != wantErr.Error() {
+			t.Fatalf("Decode(%q) error = %v, encoding/json gives %v", data, err, wantErr)
+		}
+		if err == nil && !reflect.DeepEqual(got, want) {
+			t.Fatalf("Decode(%q) = %+v, encoding/json gives %+v", data, got, want)
+		}
+	})
+}
+
+// TestPurchaseDecoderFastPath tests that ordinary records are decoded
+// without encoding/json and with at most one allocation
+func TestPurchaseDecoderFastPath(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"Full record", fastRecord},
+		{"Numeric created_at", `{"transaction_id":"t","created_at":1709294400,"event_type":"refund"}`},
+		{"Unknown scalar fields", `{"transaction_id":"t","note":"gift","gift":true,"points":12.5}`},
+		{"Non-ASCII title", `{"transaction_id":"t","game_title":"Pokémon Ω"}`},
+	}
+
+	pd := main.NewPurchaseDecoder()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var in main.PurchaseInput
+			if !pd.TryDecode([]byte(tt.data), &in) {
+				t.Fatalf("TryDecode(%s) fell back to encoding/json", tt.data)
+			}
+		})
+	}
+
+	data := []byte(fastRecord)
+	var in main.PurchaseInput
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := pd.Decode(data, &in); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 1 {
+		t.Errorf("Decode allocated %v times per record, want at most 1", allocs)
+	}
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+// TestIngestDuplicateFile tests that a file is recognised by its contents
+// whether or not it is gzipped, and that a duplicate is refused before
+// anything is written
+func TestIngestDuplicateFile(t *testing.T) {
+	ctx := context.Background()
+	file := fmt.Sprintf(limitRecord+"\n"+limitRecord+"\n", 1, 2)
+	store := newMemStore()
+	ing := main.Ingester{Store: store, FileName: "purchases.ndjson"}
+
+	if resp, err := ing.Run(ctx, "first", strings.NewReader(file)); err != nil || resp.DuplicateOf != nil {
+		t.Fatalf("First ingest returned %+v, %v; want it recorded", resp, err)
+	}
+
+	ing.FileName = "purchases.ndjson.gz"
+	resp, err := ing.Run(ctx, "gzipped", strings.NewReader(gzipped(file)))
+	if err != nil || resp.DuplicateOf == nil || resp.DuplicateOf.IngestID != "first" {
+		t.Fatalf("Gzipped re-upload returned %+v, %v; want it reported as a duplicate of first", resp, err)
+	}
+
+	if _, err := store.AddPurchase(ctx, testPurchase("TXN-1", 150, "2025-08-15T10:00:00Z"), main.LineRef{IngestID: "fix"}); err != nil {
+		t.Fatal(err)
+	}
+	ing.Options.RefuseDuplicate = true
+	resp, err = ing.Run(ctx, "refused", strings.NewReader(gzipped(file)))
+	if !errors.Is(err, main.ErrDuplicateFile) || resp.DuplicateOf == nil || resp.DuplicateOf.IngestID != "first" {
+		t.Errorf("Refused re-upload returned %+v, %v; want ErrDuplicateFile with the original ingest", resp, err)
+	}
+	if p, err := store.GetPurchase(ctx, "TXN-1"); err != nil || p.AmountCents != 150 || resp.Total != 0 {
+		t.Errorf("Refused re-upload read %d records and left TXN-1 with amount %d, %v; want nothing written", resp.Total, p.AmountCents, err)
+	}
+}
+
+// TestRefuseConcurrentDuplicates tests that of two ingests of the same file
+// running at once in refuse mode, exactly one succeeds and the records stay
+func TestRefuseConcurrentDuplicates(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	file := fmt.Sprintf(conflictRecord+"\n", "TXN-1", 100, "2025-08-15T10:00:00Z") +
+		fmt.Sprintf(conflictRecord+"\n", "TXN-2", 200, "2025-08-15T10:00:00Z")
+
+	ing := main.Ingester{Store: store, FileName: "purchases.ndjson", Options: main.IngestOptions{RefuseDuplicate: true}}
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = ing.Run(ctx, fmt.Sprintf("upload-%d", i), strings.NewReader(file))
+		}()
+	}
+	wg.Wait()
+
+	refused := 0
+	for i, err := range errs {
+		switch {
+		case errors.Is(err, main.ErrDuplicateFile):
+			refused++
+		case err != nil:
+			t.Fatalf("Ingest %d failed: %v", i, err)
+		}
+	}
+	if refused != 1 {
+		t.Fatalf("Got errors %v, want exactly one ingest refused", errs)
+	}
+	for i, id := range []string{"TXN-1", "TXN-2"} {
+		if p, err := store.GetPurchase(ctx, id); err != nil || p.AmountCents != 100*(i+1) {
+			t.Errorf("Stored %s with amount %d, %v; want %d", id, p.AmountCents, err, 100*(i+1))
+		}
+	}
+
+	// A later re-upload is refused without writing anything
+	if _, err := store.AddPurchase(ctx, testPurchase("TXN-1", 150, "2025-08-15T10:00:00Z"), main.LineRef{IngestID: "fix"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ing.Run(ctx, "late", strings.NewReader(file)); !errors.Is(err, main.ErrDuplicateFile) {
+		t.Fatalf("Late re-upload returned %v, want ErrDuplicateFile", err)
+	}
+	if p, err := store.GetPurchase(ctx, "TXN-1"); err != nil || p.AmountCents != 150 {
+		t.Errorf("Stored TXN-1 with amount %d, %v after the refused re-upload; want 150", p.AmountCents, err)
+	}
+}
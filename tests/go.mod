@@ -4,6 +4,6 @@ go 1.22
 
 require gaming-purchases-system v0.0.0
 
-require github.com/lib/pq v1.10.9 // indirect
+require github.com/lib/pq v1.10.9
 
 replace gaming-purchases-system => ../starter
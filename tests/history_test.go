@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+// TestPurchaseRevisions tests that a revision is recorded, with the source
+// of the new version, only when an update changes the purchase, whether
+// upserted one at a time or loaded in bulk
+func TestPurchaseRevisions(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+
+	original := testPurchase("TXN-1", 100, "2025-08-15T10:00:00Z")
+	if _, err := store.AddPurchase(ctx, original, main.LineRef{IngestID: "first", Line: 1, Source: main.SourceMultipart}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sending the same version again changes nothing, not even the provenance
+	res, err := store.AddPurchase(ctx, original, main.LineRef{IngestID: "same", Line: 1, Source: main.SourceMultipart})
+	if err != nil || res.Created || res.Updated {
+		t.Errorf("Identical upsert returned %+v, %v; want it ignored", res, err)
+	}
+	bulk, err := store.BeginBulk(ctx, main.LineRef{IngestID: "same-bulk", Source: main.SourceSpool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for line := 1; line <= 2; line++ {
+		if err := bulk.Add(ctx, main.Record{Line: line, Purchase: original}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res, err := bulk.Commit(ctx, 2, nil); err != nil || res != (main.BulkResult{Ignored: 2}) {
+		t.Errorf("Identical bulk load returned %+v, %v; want both records ignored", res, err)
+	}
+
+	changed := original
+	changed.AmountCents = 200
+	ref := main.LineRef{IngestID: "second", Line: 7, Source: main.SourceCLI, FileName: "fix.ndjson"}
+	if res, err := store.AddPurchase(ctx, changed, ref); err != nil || !res.Updated {
+		t.Fatalf("Upsert of a new amount returned %+v, %v; want it updated", res, err)
+	}
+
+	bulk, err = store.BeginBulk(ctx, main.LineRef{IngestID: "third", Source: main.SourceSpool, FileName: "late.ndjson"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed.PlayerLevel = 4
+	for line, p := range []main.Purchase{changed, changed} {
+		if err := bulk.Add(ctx, main.Record{Line: line + 1, Purchase: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res, err := bulk.Commit(ctx, 2, nil); err != nil || res != (main.BulkResult{Updated: 1, Ignored: 1}) {
+		t.Errorf("Bulk load of a new level returned %+v, %v; want 1 updated and 1 ignored", res, err)
+	}
+
+	current, revisions, err := store.PurchaseHistory(ctx, "TXN-1")
+	if err != nil {
+		t.Fatalf("PurchaseHistory failed: %v", err)
+	}
+	if current.IngestID != "third" || current.PlayerLevel != 4 {
+		t.Errorf("Current version is %+v, want level 4 from ingest third", current)
+	}
+
+	var got []string
+	for _, rev := range revisions {
+		got = append(got, fmt.Sprintf("%s/%s/%s:%d %v amount=%d",
+			rev.IngestID, rev.IngestSource, rev.SourceFile, rev.Line, rev.ChangedFields, rev.Previous.AmountCents))
+	}
+	want := []string{
+		"second/cli/fix.ndjson:7 [amount_cents] amount=100",
+		"third/spool/late.ndjson:2 [player_level] amount=200",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Got revisions %q, want %q", got, want)
+	}
+}
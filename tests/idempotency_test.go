@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	main "gaming-purchases-system"
+)
+
+// keyStore queues async uploads in a memStore, panicking instead while
+// panics is set
+type keyStore struct {
+	*memStore
+	panics atomic.Bool
+}
+
+func (s *keyStore) CreateJob(ctx context.Context, job main.IngestJob, upload io.Reader) (main.IngestJob, error) {
+	if s.panics.Load() {
+		panic("connection pool exhausted")
+	}
+	return s.memStore.CreateJob(ctx, job, upload)
+}
+
+// jobCount returns the number of jobs created
+func (s *keyStore) jobCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jobs)
+}
+
+// TestIdempotencyKey tests that a request replayed with its Idempotency-Key
+// gets the stored response without being run again, that the key cannot be
+// reused for another file, and that a request which panics releases its key
+func TestIdempotencyKey(t *testing.T) {
+	store := &keyStore{memStore: newMemStore()}
+	srv := httptest.NewServer(main.NewServer(store, main.ServerConfig{IdempotencyRetention: time.Hour}))
+	defer srv.Close()
+
+	post := func(key, file string) *http.Response {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", "purchases.ndjson")
+		io.WriteString(part, file)
+		mw.Close()
+
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/ingest?async=true", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil
+		}
+		resp.Body.Close()
+		return resp
+	}
+	file := fmt.Sprintf(limitRecord+"\n", 1)
+
+	first := post("key-1", file)
+	if first == nil || first.StatusCode != http.StatusAccepted {
+		t.Fatalf("First request got %v, want 202", first)
+	}
+
+	t.Run("Replay", func(t *testing.T) {
+		resp := post("key-1", file)
+		if resp == nil || resp.StatusCode != http.StatusAccepted || resp.Header.Get("Idempotent-Replayed") != "true" {
+			t.Fatalf("Replay got %v, want the stored 202", resp)
+		}
+		if resp.Header.Get("Location") != first.Header.Get("Location") || store.jobCount() != 1 {
+			t.Errorf("Replay points to %q after %d jobs, want %q after 1", resp.Header.Get("Location"), store.jobCount(), first.Header.Get("Location"))
+		}
+	})
+
+	t.Run("Different file", func(t *testing.T) {
+		resp := post("key-1", fmt.Sprintf(limitRecord+"\n", 2))
+		if resp == nil || resp.StatusCode != http.StatusConflict || store.jobCount() != 1 {
+			t.Errorf("Reuse for another file got %v after %d jobs, want 409 after 1", resp, store.jobCount())
+		}
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		store.panics.Store(true)
+		post("key-2", file)
+		store.panics.Store(false)
+
+		resp := post("key-2", file)
+		if resp == nil || resp.StatusCode != http.StatusAccepted || resp.Header.Get("Idempotent-Replayed") != "" {
+			t.Errorf("Retry after a panic got %v, want the request run again", resp)
+		}
+	})
+}
+
+// TestIdempotencyKeyLease tests that a key left in progress is taken over
+// by a retry of the same request once its lease runs out, but not before
+// and not by another request
+func TestIdempotencyKeyLease(t *testing.T) {
+	store := testStore(t).(main.IdempotencyStore)
+	ctx := context.Background()
+	const retention, lease = time.Hour, time.Second
+
+	if _, claimed, err := store.ClaimIdempotencyKey(ctx, "key-1", "hash-1", retention, lease); err != nil || !claimed {
+		t.Fatalf("First claim returned %v, %v; want it claimed", claimed, err)
+	}
+	if _, claimed, err := store.ClaimIdempotencyKey(ctx, "key-1", "hash-1", retention, lease); err != nil || claimed {
+		t.Errorf("Claim within the lease returned %v, %v; want it refused", claimed, err)
+	}
+
+	time.Sleep(2 * lease)
+	if rec, claimed, err := store.ClaimIdempotencyKey(ctx, "key-1", "hash-2", retention, lease); err != nil || claimed || rec.BodyHash != "hash-1" {
+		t.Errorf("Claim of a stale key for another request returned %+v, %v, %v; want it refused", rec, claimed, err)
+	}
+	if _, claimed, err := store.ClaimIdempotencyKey(ctx, "key-1", "hash-1", retention, lease); err != nil || !claimed {
+		t.Errorf("Claim of a stale key for the same request returned %v, %v; want it taken over", claimed, err)
+	}
+
+	// A renewed key is kept by its request
+	time.Sleep(2 * lease)
+	if err := store.RenewIdempotencyKey(ctx, "key-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, claimed, err := store.ClaimIdempotencyKey(ctx, "key-1", "hash-1", retention, lease); err != nil || claimed {
+		t.Errorf("Claim of a renewed key returned %v, %v; want it refused", claimed, err)
+	}
+}
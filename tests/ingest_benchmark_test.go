@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	main "gaming-purchases-system"
 )
@@ -209,4 +210,76 @@ func BenchmarkValidatePurchaseInput(b *testing.B) {
 			b.Fatalf("Validation failed: %v", err)
 		}
 	}
-}
\ No newline at end of file
+}
+
+// BenchmarkStreamNDJSONDecoders compares decoding on one goroutine with the
+// parallel decoding pipeline
+func BenchmarkStreamNDJSONDecoders(b *testing.B) {
+	sampleRecord := `{"transaction_id":"TXN-BENCH-%d","player_id":"player_bench_%d","player_username":"BenchPlayer%d","game_title":"Benchmark Game","item_type":"game","genre":"Action","platform":"steam","amount_cents":2999,"currency":"USD","player_level":25,"created_at":"2025-08-15T10:00:00Z"}`
+	recordCount := 50000
+
+	var jsonData strings.Builder
+	for i := 0; i < recordCount; i++ {
+		jsonData.WriteString(fmt.Sprintf(sampleRecord+"\n", i, i, i))
+	}
+	testData := jsonData.String()
+
+	for _, decoders := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("decoders_%d", decoders), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(testData)))
+
+			for i := 0; i < b.N; i++ {
+				processedCount := 0
+				opts := main.StreamOptions{Decoders: decoders}
+				err := main.StreamNDJSONWithOptions(context.Background(), strings.NewReader(testData), opts, func(rec main.Record) error {
+					processedCount++
+					return nil
+				})
+				if err != nil {
+					b.Fatalf("StreamNDJSONWithOptions failed: %v", err)
+				}
+				if processedCount != recordCount {
+					b.Fatalf("Expected %d records, got %d", recordCount, processedCount)
+				}
+			}
+			b.ReportMetric(float64(recordCount), "records/op")
+		})
+	}
+}
+
+// BenchmarkIngestWriters compares writing one record at a time with the
+// parallel decode and write pipeline, against a store with 100µs writes
+func BenchmarkIngestWriters(b *testing.B) {
+	sampleRecord := `{"transaction_id":"TXN-WRITE-%d","player_id":"player_%d","player_username":"Player%d","game_title":"Writer Test Game","item_type":"game","genre":"RPG","platform":"epic","amount_cents":4999,"currency":"USD","player_level":42,"created_at":"2025-08-15T15:30:00Z"}`
+	recordCount := 2000
+
+	var jsonData strings.Builder
+	for i := 0; i < recordCount; i++ {
+		jsonData.WriteString(fmt.Sprintf(sampleRecord+"\n", i, i, i))
+	}
+	testData := jsonData.String()
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("writers_%d", workers), func(b *testing.B) {
+			ing := main.Ingester{
+				Decoders: workers,
+				Writers:  workers,
+			}
+
+			for i := 0; i < b.N; i++ {
+				store := newMemStore()
+				store.latency = 100 * time.Microsecond
+				ing.Store = store
+				resp, err := ing.Run(context.Background(), "bench", strings.NewReader(testData))
+				if err != nil {
+					b.Fatalf("Run failed: %v", err)
+				}
+				if resp.Created != recordCount {
+					b.Fatalf("Expected %d created, got %d", recordCount, resp.Created)
+				}
+			}
+			b.ReportMetric(float64(recordCount), "records/op")
+		})
+	}
+}
@@ -2,6 +2,8 @@ package tests
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strings"
 	"testing"
 
@@ -189,3 +191,276 @@ func TestValidatePurchaseInput(t *testing.T) {
 	}
 }
 
+// TestStreamNDJSONLenient tests that lenient mode skips and reports invalid lines
+func TestStreamNDJSONLenient(t *testing.T) {
+	valid := `{"transaction_id":"TXN-001","player_id":"player_001","player_username":"GamerAlice","game_title":"Cyberpunk 2077","item_type":"game","genre":"RPG","platform":"steam","amount_cents":5999,"currency":"USD","player_level":15,"created_at":"2025-08-15T10:00:00Z"}`
+	badPlatform := `{"transaction_id":"TXN-002","player_id":"player_002","player_username":"Bob","game_title":"Minecraft","item_type":"game","genre":"Sandbox","platform":"sega","amount_cents":2699,"currency":"USD","player_level":8,"created_at":"2025-08-15T11:00:00Z"}`
+	notJSON := `{"transaction_id":`
+
+	input := valid + "\n" + badPlatform + "\n\n" + notJSON + "\n" + valid + "\n"
+
+	var purchases []main.Purchase
+	var rejects []main.LineError
+	opts := main.StreamOptions{
+		Reject: func(rej main.LineError) error {
+			rejects = append(rejects, rej)
+			return nil
+		},
+	}
+
+	err := main.StreamNDJSONWithOptions(context.Background(), strings.NewReader(input), opts, func(rec main.Record) error {
+		purchases = append(purchases, rec.Purchase)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(purchases) != 2 {
+		t.Errorf("Got %d purchases, want 2", len(purchases))
+	}
+
+	wantRejects := []struct {
+		line   int
+		offset int64
+		raw    string
+		err    error
+	}{
+		{line: 2, offset: int64(len(valid) + 1), raw: badPlatform, err: main.ErrBadInput},
+		{line: 4, offset: int64(len(valid) + len(badPlatform) + 3), raw: notJSON, err: main.ErrInvalidFormat},
+	}
+	if len(rejects) != len(wantRejects) {
+		t.Fatalf("Got %d rejects, want %d", len(rejects), len(wantRejects))
+	}
+	for i, want := range wantRejects {
+		got := rejects[i]
+		if got.Line != want.line || got.Offset != want.offset || got.Raw != want.raw {
+			t.Errorf("reject %d = line %d offset %d raw %q, want line %d offset %d raw %q",
+				i, got.Line, got.Offset, got.Raw, want.line, want.offset, want.raw)
+		}
+		if !errors.Is(got.Err, want.err) {
+			t.Errorf("reject %d error = %v, want %v", i, got.Err, want.err)
+		}
+		if got.Reason == "" {
+			t.Errorf("reject %d has empty reason", i)
+		}
+	}
+
+	// Without a Reject callback the first invalid line aborts the stream
+	err = main.StreamNDJSON(context.Background(), strings.NewReader(input), func(main.Purchase) error { return nil })
+	var lineErr *main.LineError
+	if !errors.As(err, &lineErr) || lineErr.Line != 2 {
+		t.Errorf("Strict mode error = %v, want LineError for line 2", err)
+	}
+}
+
+// TestStreamNDJSONSkipLines tests resuming a stream after already committed lines
+func TestStreamNDJSONSkipLines(t *testing.T) {
+	record := `{"transaction_id":"TXN-%03d","player_id":"player_001","player_username":"GamerAlice","game_title":"Cyberpunk 2077","item_type":"game","genre":"RPG","platform":"steam","amount_cents":5999,"currency":"USD","player_level":15,"created_at":"2025-08-15T10:00:00Z"}`
+
+	var input strings.Builder
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(&input, record+"\n", i)
+	}
+
+	tests := []struct {
+		name      string
+		skip      int
+		wantLines []int
+	}{
+		{name: "no skip", skip: 0, wantLines: []int{1, 2, 3, 4, 5}},
+		{name: "resume mid file", skip: 3, wantLines: []int{4, 5}},
+		{name: "already complete", skip: 5, wantLines: nil},
+		{name: "skip beyond end", skip: 10, wantLines: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lines []int
+			opts := main.StreamOptions{SkipLines: tt.skip}
+			err := main.StreamNDJSONWithOptions(context.Background(), strings.NewReader(input.String()), opts, func(rec main.Record) error {
+				if want := fmt.Sprintf("TXN-%03d", rec.Line); rec.Purchase.TransactionID != want {
+					t.Errorf("line %d has transaction %s, want %s", rec.Line, rec.Purchase.TransactionID, want)
+				}
+				lines = append(lines, rec.Line)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if fmt.Sprint(lines) != fmt.Sprint(tt.wantLines) {
+				t.Errorf("Got lines %v, want %v", lines, tt.wantLines)
+			}
+		})
+	}
+}
+
+// TestParseConflictPolicy tests conflict policy selection
+func TestParseConflictPolicy(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    main.ConflictPolicy
+		wantErr bool
+	}{
+		{input: "", want: main.LastWriteWins},
+		{input: "last-write-wins", want: main.LastWriteWins},
+		{input: "first-write-wins", want: main.FirstWriteWins},
+		{input: "newer-created_at-wins", want: main.NewerCreatedAtWins},
+		{input: "reject-on-diff", want: main.RejectOnDiff},
+		{input: "LAST-WRITE-WINS", wantErr: true},
+		{input: "newest-wins", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := main.ParseConflictPolicy(tt.input)
+			if tt.wantErr {
+				if !errors.Is(err, main.ErrBadInput) {
+					t.Errorf("Expected ErrBadInput, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestStreamNDJSONEventTypes tests decoding of refund and chargeback events
+func TestStreamNDJSONEventTypes(t *testing.T) {
+	purchase := `{"transaction_id":"TXN-001","player_id":"player_001","player_username":"GamerAlice","game_title":"Cyberpunk 2077","item_type":"game","genre":"RPG","platform":"steam","amount_cents":5999,"currency":"USD","player_level":15,"created_at":"2025-08-15T10:00:00Z"}`
+
+	tests := []struct {
+		name       string
+		line       string
+		wantRefund main.EventType
+		wantErr    bool
+	}{
+		{name: "default is purchase", line: purchase},
+		{name: "explicit purchase", line: strings.Replace(purchase, `{`, `{"event_type":"purchase",`, 1)},
+		{name: "refund", line: `{"event_type":"refund","transaction_id":"TXN-001","created_at":"2025-08-16T10:00:00Z"}`, wantRefund: main.EventRefund},
+		{name: "chargeback", line: `{"event_type":"chargeback","transaction_id":"TXN-001","amount_cents":5999,"created_at":"2025-08-16T10:00:00Z"}`, wantRefund: main.EventChargeback},
+		{name: "refund without transaction", line: `{"event_type":"refund","created_at":"2025-08-16T10:00:00Z"}`, wantErr: true},
+		{name: "refund with bad timestamp", line: `{"event_type":"refund","transaction_id":"TXN-001","created_at":"yesterday"}`, wantErr: true},
+		{name: "unknown event type", line: `{"event_type":"gift","transaction_id":"TXN-001","created_at":"2025-08-16T10:00:00Z"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []main.Record
+			err := main.StreamNDJSONWithOptions(context.Background(), strings.NewReader(tt.line), main.StreamOptions{}, func(rec main.Record) error {
+				got = append(got, rec)
+				return nil
+			})
+			if tt.wantErr {
+				if !errors.Is(err, main.ErrBadInput) {
+					t.Errorf("Expected ErrBadInput, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("Got %d records, want 1", len(got))
+			}
+
+			rec := got[0]
+			switch {
+			case tt.wantRefund == "" && rec.Refund != nil:
+				t.Errorf("Got refund %+v, want a purchase", *rec.Refund)
+			case tt.wantRefund != "" && rec.Refund == nil:
+				t.Errorf("Got purchase %+v, want a %s", rec.Purchase, tt.wantRefund)
+			case tt.wantRefund != "" && (rec.Refund.EventType != tt.wantRefund || rec.Refund.TransactionID != "TXN-001"):
+				t.Errorf("Got %+v, want a %s of TXN-001", *rec.Refund, tt.wantRefund)
+			}
+		})
+	}
+}
+
+// TestStreamNDJSONParallel tests that decoding on several goroutines yields
+// the same records and rejects, in file order, as decoding on one
+func TestStreamNDJSONParallel(t *testing.T) {
+	record := `{"transaction_id":"TXN-%05d","player_id":"player_001","game_title":"Cyberpunk 2077","item_type":"game","platform":"%s","amount_cents":5999,"player_level":15,"created_at":"2025-08-15T10:00:00Z"}`
+
+	var input strings.Builder
+	for i := 1; i <= 5000; i++ {
+		switch {
+		case i%97 == 0:
+			input.WriteString("{not json\n")
+		case i%31 == 0:
+			fmt.Fprintf(&input, record+"\n", i, "sega")
+		default:
+			fmt.Fprintf(&input, record+"\n", i, "steam")
+		}
+	}
+
+	stream := func(decoders int) (lines, rejects []int) {
+		opts := main.StreamOptions{
+			Decoders: decoders,
+			Reject: func(rej main.LineError) error {
+				rejects = append(rejects, rej.Line)
+				return nil
+			},
+		}
+		err := main.StreamNDJSONWithOptions(context.Background(), strings.NewReader(input.String()), opts, func(rec main.Record) error {
+			if want := fmt.Sprintf("TXN-%05d", rec.Line); rec.Purchase.TransactionID != want {
+				t.Errorf("line %d has transaction %s, want %s", rec.Line, rec.Purchase.TransactionID, want)
+			}
+			lines = append(lines, rec.Line)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error with %d decoders: %v", decoders, err)
+		}
+		return lines, rejects
+	}
+
+	wantLines, wantRejects := stream(1)
+	for _, decoders := range []int{2, 8} {
+		lines, rejects := stream(decoders)
+		if fmt.Sprint(lines) != fmt.Sprint(wantLines) || fmt.Sprint(rejects) != fmt.Sprint(wantRejects) {
+			t.Errorf("%d decoders: got %d records and rejects %v, want %d records and rejects %v",
+				decoders, len(lines), rejects, len(wantLines), wantRejects)
+		}
+	}
+
+	// Cancellation stops the pipeline without reading the rest of the input
+	ctx, cancel := context.WithCancel(context.Background())
+	seen := 0
+	opts := main.StreamOptions{Decoders: 4, Reject: func(main.LineError) error { return nil }}
+	err := main.StreamNDJSONWithOptions(ctx, strings.NewReader(input.String()), opts, func(rec main.Record) error {
+		if seen++; seen == 10 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || seen != 10 {
+		t.Errorf("Got %v after %d records, want context.Canceled after 10", err, seen)
+	}
+}
+
+// TestStreamNDJSONRefunds tests that StreamNDJSON fails at a refund event
+// rather than passing over it
+func TestStreamNDJSONRefunds(t *testing.T) {
+	input := fmt.Sprintf(limitRecord+"\n", 1) +
+		`{"event_type":"refund","transaction_id":"TXN-1","created_at":"2025-08-16T10:00:00Z"}` + "\n" +
+		fmt.Sprintf(limitRecord+"\n", 2)
+
+	var got []string
+	err := main.StreamNDJSON(context.Background(), strings.NewReader(input), func(p main.Purchase) error {
+		got = append(got, p.TransactionID)
+		return nil
+	})
+	var lineErr *main.LineError
+	if !errors.As(err, &lineErr) || lineErr.Line != 2 || lineErr.Field != "event_type" || !errors.Is(err, main.ErrBadInput) {
+		t.Errorf("Got error %v, want an ErrBadInput LineError for the event_type of line 2", err)
+	}
+	if len(got) != 1 {
+		t.Errorf("Got purchases %v, want only TXN-1", got)
+	}
+}
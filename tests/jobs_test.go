@@ -0,0 +1,266 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	main "gaming-purchases-system"
+)
+
+// TestJobQueue tests that jobs and their uploads are shared through the
+// database, and that only jobs whose lease expired are requeued, without the
+// rejects of their lost run
+func TestJobQueue(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+
+	upload := bytes.Repeat([]byte(fmt.Sprintf(limitRecord+"\n", 1)), 12000) // several chunks
+	job, err := store.CreateJob(ctx, main.IngestJob{ID: "job-1", FileName: "a.ndjson", ContentEncoding: "identity"}, bytes.NewReader(upload))
+	if err != nil {
+		t.Fatalf("CreateJob failed: %v", err)
+	}
+	if job.State != main.JobQueued || job.UploadBytes != int64(len(upload)) || job.ContentEncoding != "identity" {
+		t.Fatalf("Got job %+v, want a queued identity-encoded job of %d bytes", job, len(upload))
+	}
+
+	claimed, err := store.ClaimJob(ctx, "runner-a", time.Minute)
+	if err != nil || claimed.ID != "job-1" || claimed.ClaimedBy != "runner-a" || claimed.LeaseExpiresAt == nil {
+		t.Fatalf("ClaimJob returned %+v, %v; want job-1 leased to runner-a", claimed, err)
+	}
+	if _, err := store.ClaimJob(ctx, "runner-b", time.Minute); !errors.Is(err, main.ErrNotFound) {
+		t.Errorf("Claim of an empty queue returned %v, want ErrNotFound", err)
+	}
+
+	r, err := store.OpenJobUpload(ctx, "job-1")
+	if err != nil {
+		t.Fatalf("OpenJobUpload failed: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, upload) {
+		t.Errorf("Read %d bytes of the upload, %v; want all %d", len(got), err, len(upload))
+	}
+
+	// A live lease is neither requeued nor renewed or finished by another runner
+	if n, err := store.RequeueExpiredJobs(ctx); err != nil || n != 0 {
+		t.Errorf("Requeued %d jobs, %v; want none", n, err)
+	}
+	if err := store.RenewJobLease(ctx, "job-1", "runner-b", time.Minute); !errors.Is(err, main.ErrNotFound) {
+		t.Errorf("Renewal by another runner returned %v, want ErrNotFound", err)
+	}
+	if err := store.FinishJob(ctx, "job-1", "runner-b", main.IngestResponse{}, nil); !errors.Is(err, main.ErrNotFound) {
+		t.Errorf("FinishJob by another runner returned %v, want ErrNotFound", err)
+	}
+	if err := store.RenewJobLease(ctx, "job-1", "runner-a", time.Minute); err != nil {
+		t.Errorf("Renewal by the runner holding the lease failed: %v", err)
+	}
+
+	// An expired lease is requeued and lost by its runner
+	if _, err := store.CreateJob(ctx, main.IngestJob{ID: "job-2"}, strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ClaimJob(ctx, "runner-a", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	rejects := []main.LineError{{Line: 3, Raw: "{", Reason: "invalid JSON"}}
+	if err := store.SaveRejects(ctx, "job-2", rejects); err != nil {
+		t.Fatalf("SaveRejects failed: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n, err := store.RequeueExpiredJobs(ctx); err != nil || n != 1 {
+		t.Errorf("Requeued %d jobs, %v; want job-2", n, err)
+	}
+	err = store.StreamRejects(ctx, "job-2", func(main.LineError) error { return nil })
+	if !errors.Is(err, main.ErrNotFound) {
+		t.Errorf("StreamRejects of the requeued job returned %v, want ErrNotFound", err)
+	}
+	if err := store.SaveRejects(ctx, "job-2", rejects); err != nil {
+		t.Errorf("SaveRejects of the rerun failed: %v", err)
+	}
+	if claimed, err := store.ClaimJob(ctx, "runner-b", time.Minute); err != nil || claimed.ID != "job-2" {
+		t.Errorf("ClaimJob returned %+v, %v; want the requeued job-2", claimed, err)
+	}
+	if err := store.RenewJobLease(ctx, "job-2", "runner-a", time.Minute); !errors.Is(err, main.ErrNotFound) {
+		t.Errorf("Renewal of a lost lease returned %v, want ErrNotFound", err)
+	}
+
+	result := main.IngestResponse{IngestID: "job-1", Created: 11990, Ignored: 10, Total: 12000}
+	result.Conflicts = []main.Conflict{{Line: 7, TransactionID: "TXN-1", Fields: []string{"amount_cents"}}}
+	if err := store.FinishJob(ctx, "job-1", "runner-a", result, nil); err != nil {
+		t.Fatalf("FinishJob failed: %v", err)
+	}
+	job, err = store.GetJob(ctx, "job-1")
+	if err != nil || job.State != main.JobSucceeded || job.Created != 11990 {
+		t.Errorf("GetJob returned %+v, %v; want job-1 succeeded with 11990 created", job, err)
+	}
+	if job.Result == nil || fmt.Sprintf("%+v", *job.Result) != fmt.Sprintf("%+v", result) {
+		t.Errorf("Got result %+v, want %+v", job.Result, result)
+	}
+	r, err = store.OpenJobUpload(ctx, "job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); len(got) != 0 {
+		t.Errorf("The upload of a finished job still has %d bytes", len(got))
+	}
+}
+
+// queueStore runs its jobs through a shared memStore, handing out their
+// uploads slowly; lost makes every lease renewal fail, as another runner
+// takes the job over
+type queueStore struct {
+	*memStore
+	lost bool
+
+	mu       sync.Mutex
+	renewals int
+	opened   chan context.Context
+	finished chan string
+}
+
+func (s *queueStore) OpenJobUpload(ctx context.Context, id string) (io.Reader, error) {
+	upload, err := s.memStore.OpenJobUpload(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	s.opened <- ctx
+	return slowReader{upload}, nil
+}
+
+func (s *queueStore) RenewJobLease(ctx context.Context, id, runner string, lease time.Duration) error {
+	if s.lost {
+		s.memStore.mu.Lock()
+		job := s.jobs[id]
+		expires := time.Now().Add(time.Hour)
+		job.ClaimedBy, job.LeaseExpiresAt = "runner-b", &expires
+		s.jobs[id] = job
+		s.memStore.mu.Unlock()
+	}
+	if err := s.memStore.RenewJobLease(ctx, id, runner, lease); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renewals++
+	return nil
+}
+
+func (s *queueStore) FinishJob(ctx context.Context, id, runner string, result main.IngestResponse, jobErr error) error {
+	s.finished <- fmt.Sprintf("%s: %d created, %v", runner, result.Created, jobErr)
+	return s.memStore.FinishJob(ctx, id, runner, result, jobErr)
+}
+
+// slowReader returns a little data at a time, with a pause before each read
+type slowReader struct {
+	r io.Reader
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(5 * time.Millisecond)
+	return r.r.Read(p[:min(len(p), 256)])
+}
+
+// TestJobRunnerLease tests that a runner renews the lease of the job it runs,
+// and abandons the job without finishing it once the lease is lost
+func TestJobRunnerLease(t *testing.T) {
+	var upload strings.Builder
+	for i := 1; i <= 50; i++ {
+		fmt.Fprintf(&upload, limitRecord+"\n", i)
+	}
+
+	for _, lost := range []bool{false, true} {
+		t.Run(fmt.Sprintf("lost=%v", lost), func(t *testing.T) {
+			store := &queueStore{
+				memStore: newMemStore(),
+				lost:     lost,
+				opened:   make(chan context.Context, 1),
+				finished: make(chan string, 1),
+			}
+			if _, err := store.CreateJob(context.Background(), main.IngestJob{ID: "job-1"}, strings.NewReader(upload.String())); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			jr := main.JobRunner{Workers: 1, Poll: time.Hour, Store: store, ID: "runner-a", Lease: 30 * time.Millisecond}
+			go jr.Run(ctx)
+
+			jobCtx := <-store.opened
+			if !lost {
+				select {
+				case got := <-store.finished:
+					if want := "runner-a: 50 created, <nil>"; got != want {
+						t.Errorf("Got FinishJob(%s), want %s", got, want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("Job did not finish")
+				}
+				store.mu.Lock()
+				defer store.mu.Unlock()
+				if store.renewals == 0 {
+					t.Error("The lease was never renewed")
+				}
+				return
+			}
+
+			select {
+			case <-jobCtx.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("Job was not cancelled after losing its lease")
+			}
+			select {
+			case got := <-store.finished:
+				t.Errorf("Got FinishJob(%s) for a job whose lease was lost", got)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+// TestIngestAsync tests that an async upload is queued with its file and
+// its encoding in the store, for whichever runner claims the job
+func TestIngestAsync(t *testing.T) {
+	store := newMemStore()
+	srv := httptest.NewServer(main.NewServer(store, main.ServerConfig{}))
+	defer srv.Close()
+
+	file := gzipped(fmt.Sprintf(limitRecord+"\n", 1))
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="file"; filename="purchases.ndjson.gz"`},
+		"Content-Encoding":    {"gzip"},
+	})
+	io.WriteString(part, file)
+	mw.Close()
+
+	resp, err := http.Post(srv.URL+"/ingest?async=true&lenient=true", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var job main.IngestJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Location") != "/ingest/jobs/"+job.ID {
+		t.Errorf("Got status %d at %q, want 202 at /ingest/jobs/%s", resp.StatusCode, resp.Header.Get("Location"), job.ID)
+	}
+	if job.State != main.JobQueued || job.UploadBytes != int64(len(file)) {
+		t.Errorf("Got job %+v, want a queued job of %d bytes", job, len(file))
+	}
+	stored, upload := store.jobs[job.ID], store.uploads[job.ID]
+	if string(upload) != file || stored.FileName != "purchases.ndjson.gz" || stored.ContentEncoding != "gzip" || !stored.Options.Lenient {
+		t.Errorf("Stored job %+v with upload %q, want gzipped purchases.ndjson.gz in lenient mode with %q", stored, upload, file)
+	}
+}
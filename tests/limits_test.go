@@ -0,0 +1,211 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+const limitRecord = `{"transaction_id":"TXN-%d","player_id":"player_001","game_title":"Hades","item_type":"game","platform":"steam","amount_cents":2499,"player_level":3,"created_at":"2025-08-15T10:00:00Z"}`
+
+// TestStreamNDJSONLimits tests that an NDJSON stream stops with a
+// LimitError at an overlong line or one record too many, also in lenient mode
+func TestStreamNDJSONLimits(t *testing.T) {
+	short := fmt.Sprintf(limitRecord, 1)
+	long := `{"transaction_id":"` + strings.Repeat("x", 300*1024) + `"}`
+	input := short + "\n\n" + short + "\n" + long + "\n" + short + "\n"
+
+	tests := []struct {
+		name      string
+		opts      main.StreamOptions
+		wantLimit string
+		wantLine  int
+		wantSeen  int
+	}{
+		{"Overlong line", main.StreamOptions{MaxLineBytes: 1024}, "max_line_bytes", 4, 2},
+		{"Line within limit", main.StreamOptions{MaxLineBytes: 400 * 1024, Decoders: 4}, "", 0, 4},
+		{"Too many records", main.StreamOptions{MaxRecords: 2}, "max_records", 4, 2},
+		{"Too many records in parallel", main.StreamOptions{MaxRecords: 1, Decoders: 4}, "max_records", 3, 1},
+		{"Resumed upload counts the rest", main.StreamOptions{MaxRecords: 2, SkipLines: 1}, "max_records", 5, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := 0
+			tt.opts.Reject = func(main.LineError) error { seen++; return nil }
+			err := main.StreamNDJSONWithOptions(context.Background(), strings.NewReader(input), tt.opts, func(main.Record) error {
+				seen++
+				return nil
+			})
+
+			var limit *main.LimitError
+			switch {
+			case tt.wantLimit == "" && err != nil:
+				t.Fatalf("Unexpected error: %v", err)
+			case tt.wantLimit != "" && !errors.As(err, &limit):
+				t.Fatalf("Got error %v, want a LimitError", err)
+			case tt.wantLimit != "" && (limit.Limit != tt.wantLimit || limit.Line != tt.wantLine):
+				t.Errorf("Got %s at line %d, want %s at line %d", limit.Limit, limit.Line, tt.wantLimit, tt.wantLine)
+			}
+			if seen != tt.wantSeen {
+				t.Errorf("Got %d records before stopping, want %d", seen, tt.wantSeen)
+			}
+		})
+	}
+}
+
+// readCounter counts the bytes read from it
+type readCounter struct {
+	r io.Reader
+	n int
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// TestDecoderRecordLimits tests that CSV, TSV and JSON array uploads stop
+// with a LimitError at an overlong record, without reading it whole
+func TestDecoderRecordLimits(t *testing.T) {
+	const header = "transaction_id,player_id,game_title,item_type,platform,amount_cents,player_level,created_at\n"
+	row := func(id string) string {
+		return id + ",player_001,Hades,game,steam,2499,3,2025-08-15T10:00:00Z\n"
+	}
+	element := func(id string) string {
+		return fmt.Sprintf(`{"transaction_id":%q,"player_id":"player_001","game_title":"Hades","item_type":"game","platform":"steam","amount_cents":2499,"player_level":3,"created_at":"2025-08-15T10:00:00Z"}`, id)
+	}
+	huge := strings.Repeat("x", 10<<20)
+	long := strings.Repeat("x", 2048)
+
+	tests := []struct {
+		name     string
+		format   string
+		input    string
+		wantLine int
+	}{
+		{"CSV", "csv", header + row("TXN-1") + row(huge) + row("TXN-3"), 3},
+		{"CSV within the read-ahead", "csv", header + row("TXN-1") + row(long) + row("TXN-3"), 3},
+		{"Quoted CSV", "csv", header + row(`"TXN-1`+"\n"+`"`) + row(`"`+huge+`"`), 4},
+		{"TSV", "tsv", strings.ReplaceAll(header+row("TXN-1")+row(huge), ",", "\t"), 3},
+		{"JSON array", "json", "[" + element("TXN-1") + "," + element(huge) + "," + element("TXN-3") + "]", 2},
+		{"JSON array within the read-ahead", "json", "[" + element("TXN-1") + "," + element(long) + "]", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := main.LookupFormat(tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &readCounter{r: strings.NewReader(tt.input)}
+			seen := 0
+			opts := main.StreamOptions{MaxLineBytes: 1024, Reject: func(main.LineError) error { seen++; return nil }}
+			err = main.StreamRecords(context.Background(), format.NewDecoder(r), opts, func(main.Record) error {
+				seen++
+				return nil
+			})
+
+			var limit *main.LimitError
+			if !errors.As(err, &limit) || limit.Limit != "max_line_bytes" || limit.Line != tt.wantLine {
+				t.Fatalf("Got error %v, want max_line_bytes exceeded at line %d", err, tt.wantLine)
+			}
+			if seen != 1 {
+				t.Errorf("Got %d records before stopping, want 1", seen)
+			}
+			if r.n > 1<<20 {
+				t.Errorf("Read %d bytes, want the overlong record cut off", r.n)
+			}
+		})
+	}
+}
+
+// TestIngestLimits tests the 413 responses of /ingest and their override
+// for a client with limits of its own, which is found by its address and
+// not by the X-Uploader header it sends
+func TestIngestLimits(t *testing.T) {
+	limits := main.IngestLimits{MaxRecords: 2, MaxUploadBytes: 4096}
+	partner := main.IngestLimits{MaxRecords: 100, MaxUploadBytes: 64 * 1024}
+	srv := httptest.NewServer(main.NewServer(newMemStore(), main.ServerConfig{
+		Limits:       limits,
+		ClientLimits: map[string]main.IngestLimits{"partner-a": partner, "192.0.2.1": partner},
+	}))
+	defer srv.Close()
+	local := httptest.NewServer(main.NewServer(newMemStore(), main.ServerConfig{
+		Limits:       limits,
+		ClientLimits: map[string]main.IngestLimits{"127.0.0.1": partner, "::1": partner},
+	}))
+	defer local.Close()
+
+	upload := func(url string, records int, uploader string) *http.Response {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", "purchases.ndjson")
+		for i := 1; i <= records; i++ {
+			fmt.Fprintf(part, limitRecord+"\n", i)
+		}
+		mw.Close()
+
+		req, _ := http.NewRequest(http.MethodPost, url+"/ingest?lenient=true", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		if uploader != "" {
+			req.Header.Set("X-Uploader", uploader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name       string
+		url        string
+		records    int
+		uploader   string
+		wantStatus int
+		wantLimit  main.LimitError
+	}{
+		{"Within limits", srv.URL, 2, "partner-b", http.StatusOK, main.LimitError{}},
+		{"Too many records", srv.URL, 3, "partner-b", http.StatusRequestEntityTooLarge, main.LimitError{Limit: "max_records", Max: 2, Line: 3, Offset: 368}},
+		{"Body too large", srv.URL, 30, "partner-b", http.StatusRequestEntityTooLarge, main.LimitError{Limit: "max_upload_bytes", Max: 4096, Offset: 4096}},
+		{"Client limits", local.URL, 30, "", http.StatusOK, main.LimitError{}},
+		{"Spoofed uploader", srv.URL, 30, "partner-a", http.StatusRequestEntityTooLarge, main.LimitError{Limit: "max_upload_bytes", Max: 4096, Offset: 4096}},
+		{"Spoofed address", srv.URL, 30, "192.0.2.1", http.StatusRequestEntityTooLarge, main.LimitError{Limit: "max_upload_bytes", Max: 4096, Offset: 4096}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := upload(tt.url, tt.records, tt.uploader)
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("Got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantLimit.Limit == "" {
+				return
+			}
+
+			var body struct {
+				Error string           `json:"error"`
+				Limit *main.LimitError `json:"limit"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Limit == nil || *body.Limit != tt.wantLimit || body.Error == "" {
+				t.Errorf("Got error %q with limit %+v, want %+v", body.Error, body.Limit, tt.wantLimit)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	main "gaming-purchases-system"
+)
+
+// orderStore writes later lines faster than earlier ones, so that the
+// writes of several writers complete out of file order. Every write is
+// reported as a conflict, and the line failLine fails.
+type orderStore struct {
+	*memStore
+	lines     int
+	amounts   map[string][]int // amounts written to each transaction, in order
+	committed int
+}
+
+func (s *orderStore) AddPurchase(ctx context.Context, p main.Purchase, ref main.LineRef) (main.UpsertResult, error) {
+	time.Sleep(time.Duration(s.lines-ref.Line) * 200 * time.Microsecond)
+	if ref.Line == s.failLine {
+		return main.UpsertResult{}, errWriteFailed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.amounts[p.TransactionID] = append(s.amounts[p.TransactionID], p.AmountCents)
+	s.committed++
+	return main.UpsertResult{Conflict: []string{"amount_cents"}}, nil
+}
+
+// TestIngestWriterOrder tests that with several writers, outcomes are
+// settled in file order and writes to the same transaction are applied in
+// file order, and that writes committed after a failure are still counted
+func TestIngestWriterOrder(t *testing.T) {
+	const lines = 40
+	var input strings.Builder
+	for i := 1; i <= lines; i++ {
+		fmt.Fprintf(&input, conflictRecord+"\n", fmt.Sprintf("TXN-%d", i%3), i, "2025-08-15T10:00:00Z")
+	}
+
+	store := &orderStore{memStore: newMemStore(), lines: lines, amounts: make(map[string][]int)}
+	resp, err := main.Ingester{Store: store, Writers: 4}.Run(context.Background(), "order", strings.NewReader(input.String()))
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	var settled []int
+	for _, c := range resp.Conflicts {
+		settled = append(settled, c.Line)
+	}
+	for i, line := range settled {
+		if line != i+1 {
+			t.Fatalf("Settled lines %v, want 1 to %d in order", settled, lines)
+		}
+	}
+	if len(settled) != lines {
+		t.Errorf("Settled %d lines, want %d", len(settled), lines)
+	}
+	for id, amounts := range store.amounts {
+		for i := 1; i < len(amounts); i++ {
+			if amounts[i] < amounts[i-1] {
+				t.Errorf("Wrote %s with amounts %v, want them in file order", id, amounts)
+				break
+			}
+		}
+	}
+
+	t.Run("Failure", func(t *testing.T) {
+		store := &orderStore{memStore: newMemStore(), lines: lines, amounts: make(map[string][]int)}
+		store.failLine = 5
+		resp, err := main.Ingester{Store: store, Writers: 4}.Run(context.Background(), "failed", strings.NewReader(input.String()))
+		if err == nil {
+			t.Fatal("Run succeeded, want the error of line 5")
+		}
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		if resp.Conflicted != store.committed || resp.Conflicted <= 4 {
+			t.Errorf("Counted %d records, want the %d committed, more than the 4 before the failure", resp.Conflicted, store.committed)
+		}
+	})
+}
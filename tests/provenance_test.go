@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+// TestPurchaseProvenance tests that the purchases of an ingest can be paged
+// through with ?ingest_id=, and that each one reports where it came from
+func TestPurchaseProvenance(t *testing.T) {
+	srv := httptest.NewServer(main.NewServer(testStore(t), main.ServerConfig{}))
+	defer srv.Close()
+
+	get := func(path string, v any) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s got status %d, want 200", path, resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ingest := func(name string, first, last int) string {
+		t.Helper()
+		var file strings.Builder
+		for i := first; i <= last; i++ {
+			fmt.Fprintf(&file, conflictRecord+"\n", fmt.Sprintf("TXN-%d", i), 100*i, "2025-08-15T10:00:00Z")
+		}
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", name)
+		io.WriteString(part, file.String())
+		mw.Close()
+
+		resp, err := http.Post(srv.URL+"/ingest", mw.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result main.IngestResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Ingest of %s got status %d, %v", name, resp.StatusCode, err)
+		}
+		return result.IngestID
+	}
+
+	ingest("before.ndjson", 1, 2)
+	ingestID := ingest("batch.ndjson", 3, 7)
+	ingest("after.ndjson", 8, 9)
+
+	var got []string
+	path := "/purchases?limit=2&ingest_id=" + ingestID
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("Still paging after %d pages: %v", pages, got)
+		}
+		var page main.ListPurchasesResponse
+		get(path, &page)
+		for _, p := range page.Purchases {
+			got = append(got, p.TransactionID)
+		}
+		if page.NextAfterID == 0 {
+			break
+		}
+		path = fmt.Sprintf("/purchases?limit=2&ingest_id=%s&after_id=%d", ingestID, page.NextAfterID)
+	}
+	if want := "[TXN-3 TXN-4 TXN-5 TXN-6 TXN-7]"; fmt.Sprint(got) != want {
+		t.Errorf("Paged through %v, want %s", got, want)
+	}
+
+	var p main.Purchase
+	get("/purchases/TXN-5", &p)
+	if p.IngestID != ingestID || p.IngestSource != main.SourceMultipart || p.SourceFile != "batch.ndjson" || p.SourceLine != 3 {
+		t.Errorf("Got provenance %q/%q/%q:%d, want %q/multipart/batch.ndjson:3", p.IngestID, p.IngestSource, p.SourceFile, p.SourceLine, ingestID)
+	}
+}
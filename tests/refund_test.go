@@ -0,0 +1,146 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	main "gaming-purchases-system"
+)
+
+// TestIngestReversals tests that refund and chargeback events left out
+// because they were already processed are reported apart from those recorded,
+// and that those of a credited purchase are reversed during the ingest with
+// any capped deduction reported
+func TestIngestReversals(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	p := testPurchase("TXN-1", 2499, "2025-08-15T10:00:00Z")
+	if _, err := store.AddPurchase(ctx, p, main.LineRef{IngestID: "purchases"}); err != nil {
+		t.Fatal(err)
+	}
+	p, _ = store.GetPurchase(ctx, "TXN-1")
+	store.CreditLoyalty(ctx, p, 24)
+	store.MarkEnriched(ctx, p.ID)
+	store.loyalty[p.PlayerID] = 5 // spent since
+	store.refunds["TXN-1"] = map[main.EventType]main.Refund{
+		main.EventRefund: {TransactionID: "TXN-1", EventType: main.EventRefund, AmountCents: 1000, Processed: true},
+	}
+
+	input := fmt.Sprintf(limitRecord+"\n", 2) +
+		`{"event_type":"refund","transaction_id":"TXN-1","created_at":"2025-08-16T10:00:00Z"}` + "\n" +
+		`{"event_type":"chargeback","transaction_id":"TXN-1","created_at":"2025-08-17T10:00:00Z"}` + "\n" +
+		`{"event_type":"refund","transaction_id":"TXN-2","created_at":"2025-08-16T10:00:00Z"}` + "\n"
+
+	resp, err := main.Ingester{Store: store}.Run(ctx, "reversals", strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if resp.Created != 3 || resp.Ignored != 1 || resp.Reversals != 2 || resp.ReversalsIgnored != 1 {
+		t.Errorf("Got %+v, want 3 created and 1 ignored, with 2 reversals recorded and 1 ignored", resp)
+	}
+	if resp.ReversalsPending != 1 || resp.DeductionsCapped != 1 || fmt.Sprint(resp.CappedTransactions) != "[TXN-1]" {
+		t.Errorf("Got %d pending and %d capped of %v, want the refund of TXN-2 pending and the chargeback of TXN-1 capped",
+			resp.ReversalsPending, resp.DeductionsCapped, resp.CappedTransactions)
+	}
+	refunds, _ := store.GetRefunds(ctx, "TXN-1")
+	if chargeback := refunds[len(refunds)-1]; chargeback.PointsDue != 24 || chargeback.PointsDeducted != 5 {
+		t.Errorf("Chargeback reversed as %+v, want 5 of the 24 points due deducted", chargeback)
+	}
+}
+
+// TestRefundReversal tests that a partial refund takes back the points of
+// its amount, that a chargeback after it takes back the rest, and that a
+// repeated event is ignored once processed
+func TestRefundReversal(t *testing.T) {
+	db := testDB(t)
+	store := main.NewStore(db)
+	enrich := store.(main.EnrichmentStore)
+	ctx := context.Background()
+
+	p := testPurchase("TXN-1", 2499, "2025-08-15T10:00:00Z")
+	if _, err := store.AddPurchase(ctx, p, main.LineRef{IngestID: "purchases"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enrich.CreditLoyalty(ctx, p, 24); err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Date(2025, 8, 16, 10, 0, 0, 0, time.UTC)
+	reverse := func(r main.Refund) main.Refund {
+		t.Helper()
+		if res, err := store.AddRefund(ctx, r, main.LineRef{IngestID: "reversals"}); err != nil || !res.Created {
+			t.Fatalf("AddRefund of %s returned %+v, %v; want it created", r.EventType, res, err)
+		}
+		reversed, err := enrich.ReverseLoyalty(ctx, r)
+		if err != nil {
+			t.Fatalf("ReverseLoyalty of %s failed: %v", r.EventType, err)
+		}
+		return reversed
+	}
+
+	refund := reverse(main.Refund{TransactionID: "TXN-1", EventType: main.EventRefund, AmountCents: 1000, CreatedAt: at})
+	if refund.PointsEarned != 24 || refund.PointsDue != 10 || refund.PointsDeducted != 10 || refund.DeductionCapped {
+		t.Errorf("Partial refund reversed as %+v, want 10 of 24 points deducted", refund)
+	}
+
+	again := main.Refund{TransactionID: "TXN-1", EventType: main.EventRefund, AmountCents: 2499, CreatedAt: at}
+	if res, err := store.AddRefund(ctx, again, main.LineRef{IngestID: "reversals"}); err != nil || res.Created || res.Updated {
+		t.Errorf("Repeated refund returned %+v, %v; want it ignored", res, err)
+	}
+
+	chargeback := reverse(main.Refund{TransactionID: "TXN-1", EventType: main.EventChargeback, AmountCents: 2499, CreatedAt: at.Add(time.Hour)})
+	if chargeback.PointsDue != 14 || chargeback.PointsDeducted != 14 {
+		t.Errorf("Chargeback reversed as %+v, want the remaining 14 points deducted", chargeback)
+	}
+
+	var balance int
+	if err := db.QueryRowContext(ctx, `SELECT loyalty_points FROM player_loyalty WHERE player_id = $1`, p.PlayerID).Scan(&balance); err != nil || balance != 0 {
+		t.Errorf("Player has %d points, %v; want 0", balance, err)
+	}
+	refunds, err := store.GetRefunds(ctx, "TXN-1")
+	if err != nil || len(refunds) != 2 || refunds[0].AmountCents != 1000 || refunds[1].EventType != main.EventChargeback {
+		t.Errorf("GetRefunds returned %+v, %v; want the partial refund and the chargeback", refunds, err)
+	}
+}
+
+// TestRefundReversedOnWrite tests that a refund of an enriched purchase is
+// reversed as it is written, reporting a deduction capped at the balance
+func TestRefundReversedOnWrite(t *testing.T) {
+	db := testDB(t)
+	store := main.NewStore(db)
+	enrich := store.(main.EnrichmentStore)
+	ctx := context.Background()
+
+	p := testPurchase("TXN-1", 2499, "2025-08-15T10:00:00Z")
+	if _, err := store.AddPurchase(ctx, p, main.LineRef{IngestID: "purchases"}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := store.GetPurchase(ctx, "TXN-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enrich.CreditLoyalty(ctx, p, 24); err != nil {
+		t.Fatal(err)
+	}
+	if err := enrich.MarkEnriched(ctx, p.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE player_loyalty SET loyalty_points = 5 WHERE player_id = $1`, p.PlayerID); err != nil {
+		t.Fatal(err)
+	}
+
+	r := main.Refund{TransactionID: "TXN-1", EventType: main.EventRefund, CreatedAt: time.Date(2025, 8, 16, 10, 0, 0, 0, time.UTC)}
+	res, err := store.AddRefund(ctx, r, main.LineRef{IngestID: "reversals"})
+	if err != nil || !res.Created || res.Reversal == nil {
+		t.Fatalf("AddRefund returned %+v, %v; want it created and reversed", res, err)
+	}
+	if rev := res.Reversal; !rev.Processed || rev.PointsDue != 24 || rev.PointsDeducted != 5 || !rev.DeductionCapped {
+		t.Errorf("Refund reversed as %+v, want 5 of the 24 points due deducted and capped", rev)
+	}
+	if claimed, err := enrich.ClaimRefundsForReversal(ctx, 10); err != nil || len(claimed) != 0 {
+		t.Errorf("ClaimRefundsForReversal returned %+v, %v; want nothing left to reverse", claimed, err)
+	}
+}
@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	main "gaming-purchases-system"
+)
+
+// TestIngestRejectBatches tests that a lenient ingest saves its rejected
+// lines in batches while the input is still being read
+func TestIngestRejectBatches(t *testing.T) {
+	for _, writers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("writers_%d", writers), func(t *testing.T) {
+			store := newMemStore()
+			ing := main.Ingester{Store: store, Options: main.IngestOptions{Lenient: true}, Writers: writers}
+
+			pr, pw := io.Pipe()
+			type result struct {
+				resp main.IngestResponse
+				err  error
+			}
+			done := make(chan result, 1)
+			go func() {
+				resp, err := ing.Run(context.Background(), "rejects", pr)
+				done <- result{resp, err}
+			}()
+
+			io.WriteString(pw, strings.Repeat("{not json\n", 600))
+			deadline := time.Now().Add(5 * time.Second)
+			for len(store.savedBatches()) == 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got := store.savedBatches(); fmt.Sprint(got) != "[500]" {
+				t.Errorf("Got batches %v before the end of the input, want [500]", got)
+			}
+
+			io.WriteString(pw, fmt.Sprintf(limitRecord+"\n", 1)+strings.Repeat("{not json\n", 601))
+			pw.Close()
+			res := <-done
+			if res.err != nil {
+				t.Fatalf("Run failed: %v", res.err)
+			}
+			if res.resp.Rejected != 1201 || res.resp.Created != 1 {
+				t.Errorf("Got %d rejected and %d created, want 1201 and 1", res.resp.Rejected, res.resp.Created)
+			}
+			if got := store.savedBatches(); fmt.Sprint(got) != "[500 500 201]" {
+				t.Errorf("Got batches %v, want [500 500 201]", got)
+			}
+		})
+	}
+}
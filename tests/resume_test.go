@@ -0,0 +1,57 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+// TestIngestResume tests that a failed resumable upload resumes after its
+// last committed line, as a dry run of it predicts, and that its Upload-ID
+// is free again once complete
+func TestIngestResume(t *testing.T) {
+	var input strings.Builder
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(&input, limitRecord+"\n", i)
+	}
+	input.WriteString("{not json\n")
+
+	store := newMemStore()
+	store.failLine = 4
+	ing := main.Ingester{Store: store, Options: main.IngestOptions{UploadID: "upload-1", Lenient: true}}
+
+	resp, err := ing.Run(context.Background(), "attempt-1", strings.NewReader(input.String()))
+	if err == nil || resp.Created != 3 {
+		t.Fatalf("First attempt returned %+v, %v; want a failure after 3 created", resp, err)
+	}
+	if got, _ := store.GetCheckpoint(context.Background(), "upload-1"); got != 3 {
+		t.Errorf("Checkpoint after the failure is %d, want 3", got)
+	}
+
+	// A dry run of the retry predicts what it will do
+	dry, err := ing.DryRun(context.Background(), strings.NewReader(input.String()))
+	if err != nil || dry.Skipped != 3 || dry.Created != 2 || dry.Rejected != 1 {
+		t.Errorf("Dry run of the retry returned %+v, %v; want 3 skipped, 2 created and 1 rejected", dry.IngestResponse, err)
+	}
+
+	store.failLine = 0
+	resp, err = ing.Run(context.Background(), "attempt-2", strings.NewReader(input.String()))
+	if err != nil || resp.Skipped != 3 || resp.Created != 2 || resp.Rejected != 1 {
+		t.Fatalf("Second attempt returned %+v, %v; want 3 skipped, 2 created and 1 rejected", resp, err)
+	}
+	store.mu.Lock()
+	_, kept := store.checkpoints["upload-1"]
+	store.mu.Unlock()
+	if kept {
+		t.Error("The checkpoint of the completed upload was kept")
+	}
+
+	// The Upload-ID of a completed upload starts afresh
+	resp, err = ing.Run(context.Background(), "reuse", strings.NewReader(input.String()))
+	if err != nil || resp.Skipped != 0 || resp.Ignored != 5 {
+		t.Errorf("Reusing the Upload-ID returned %+v, %v; want all 5 written again", resp, err)
+	}
+}
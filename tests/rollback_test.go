@@ -0,0 +1,118 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+// TestRollbackBatch tests that rolling back an ingest deletes the purchases
+// it created, restores those it updated and takes back the loyalty points
+// they earned, and that a row changed since aborts the rollback unless
+// ?skip_conflicts=true leaves it alone
+func TestRollbackBatch(t *testing.T) {
+	db := testDB(t)
+	store := main.NewStore(db)
+	enrich := store.(main.EnrichmentStore)
+	ctx := context.Background()
+
+	for _, id := range []string{"TXN-1", "TXN-4"} {
+		if _, err := store.AddPurchase(ctx, testPurchase(id, 100, "2025-08-15T10:00:00Z"), main.LineRef{IngestID: "earlier"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	input := fmt.Sprintf(conflictRecord+"\n", "TXN-1", 200, "2025-08-15T10:00:00Z") +
+		fmt.Sprintf(conflictRecord+"\n", "TXN-2", 300, "2025-08-15T10:00:00Z") +
+		fmt.Sprintf(conflictRecord+"\n", "TXN-4", 400, "2025-08-15T10:00:00Z")
+	if _, err := (main.Ingester{Store: store}).Run(ctx, "batch", strings.NewReader(input)); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	created, err := store.GetPurchase(ctx, "TXN-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enrich.CreditLoyalty(ctx, created, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkEnriched(ctx, created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddPurchase(ctx, testPurchase("TXN-4", 500, "2025-08-15T10:00:00Z"), main.LineRef{IngestID: "later"}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(main.NewServer(store, main.ServerConfig{}))
+	defer srv.Close()
+	rollback := func(query string, wantStatus int) main.RollbackResult {
+		t.Helper()
+		resp, err := http.Post(srv.URL+"/ingest/batches/batch/rollback"+query, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result main.RollbackResult
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode != wantStatus {
+			t.Fatalf("Rollback%s got status %d, %v; want %d", query, resp.StatusCode, err, wantStatus)
+		}
+		return result
+	}
+	wantConflicts := "[{TXN-4 updated by a later ingest later}]"
+
+	result := rollback("", http.StatusConflict)
+	if result.RolledBack || fmt.Sprint(result.Conflicts) != wantConflicts {
+		t.Errorf("Got %+v, want nothing rolled back because of %s", result, wantConflicts)
+	}
+	if _, err := store.GetPurchase(ctx, "TXN-2"); err != nil {
+		t.Errorf("GetPurchase of TXN-2 after the aborted rollback failed: %v", err)
+	}
+
+	result = rollback("?skip_conflicts=true", http.StatusOK)
+	if !result.RolledBack || result.Deleted != 1 || result.Restored != 1 || result.PointsDeducted != 3 || fmt.Sprint(result.Conflicts) != wantConflicts {
+		t.Errorf("Got %+v, want 1 deleted, 1 restored and 3 points deducted, skipping %s", result, wantConflicts)
+	}
+
+	if _, err := store.GetPurchase(ctx, "TXN-2"); !errors.Is(err, main.ErrNotFound) {
+		t.Errorf("GetPurchase of the created TXN-2 returned %v, want ErrNotFound", err)
+	}
+	for id, want := range map[string]struct {
+		amount   int
+		ingestID string
+	}{"TXN-1": {100, "earlier"}, "TXN-4": {500, "later"}} {
+		if p, err := store.GetPurchase(ctx, id); err != nil || p.AmountCents != want.amount || p.IngestID != want.ingestID {
+			t.Errorf("Stored %s with amount %d from %q, %v; want %d from %q", id, p.AmountCents, p.IngestID, err, want.amount, want.ingestID)
+		}
+	}
+
+	var balance int
+	if err := db.QueryRowContext(ctx, `SELECT loyalty_points FROM player_loyalty WHERE player_id = $1`, created.PlayerID).Scan(&balance); err != nil || balance != 0 {
+		t.Errorf("Player has %d points, %v; want 0", balance, err)
+	}
+	rows, err := db.QueryContext(ctx, `SELECT kind, points, reversed FROM loyalty_ledger WHERE transaction_id = 'TXN-2' ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ledger []string
+	for rows.Next() {
+		var (
+			kind     string
+			points   int
+			reversed bool
+		)
+		if err := rows.Scan(&kind, &points, &reversed); err != nil {
+			t.Fatal(err)
+		}
+		ledger = append(ledger, fmt.Sprintf("%s %d %v", kind, points, reversed))
+	}
+	if want := "[purchase 3 true rollback -3 false]"; fmt.Sprint(ledger) != want {
+		t.Errorf("Got ledger %v, want %s", ledger, want)
+	}
+}
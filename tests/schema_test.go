@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+// TestStrictSchema tests that strict mode names the line and field at fault
+func TestStrictSchema(t *testing.T) {
+	const valid = `{"transaction_id":"TXN-001","player_id":"player_001","game_title":"Cyberpunk 2077","item_type":"game","platform":"steam","amount_cents":5999,"player_level":15,"created_at":"2025-08-15T10:00:00Z"}`
+
+	tests := []struct {
+		name      string
+		format    string
+		input     string
+		schema    main.SchemaPolicy
+		wantField string // "" when the record is accepted
+	}{
+		{name: "valid", format: "ndjson", input: valid, schema: main.SchemaPolicy{Strict: true}},
+		{
+			name:      "misspelled field",
+			format:    "ndjson",
+			input:     strings.Replace(valid, `"amount_cents"`, `"amount_cent"`, 1),
+			schema:    main.SchemaPolicy{Strict: true},
+			wantField: "amount_cent",
+		},
+		{
+			name:      "missing required field",
+			format:    "ndjson",
+			input:     strings.Replace(valid, `"player_level":15,`, ``, 1),
+			schema:    main.SchemaPolicy{Strict: true},
+			wantField: "player_level",
+		},
+		{
+			name:      "null required field",
+			format:    "json",
+			input:     "[" + strings.Replace(valid, `5999`, `null`, 1) + "]",
+			schema:    main.SchemaPolicy{Strict: true},
+			wantField: "amount_cents",
+		},
+		{
+			name:      "zero is present",
+			format:    "ndjson",
+			input:     strings.Replace(valid, `5999`, `0`, 1),
+			schema:    main.SchemaPolicy{Strict: true},
+			wantField: "",
+		},
+		{
+			name:      "refund without created_at",
+			format:    "ndjson",
+			input:     `{"event_type":"refund","transaction_id":"TXN-001"}`,
+			schema:    main.SchemaPolicy{Strict: true},
+			wantField: "created_at",
+		},
+		{
+			name:   "platform tolerates extra fields",
+			format: "ndjson",
+			input:  strings.Replace(valid, `{`, `{"steam_app_id":1091500,`, 1),
+			schema: main.SchemaPolicy{Strict: true, Platforms: map[string]bool{"steam": false}},
+		},
+		{
+			name:      "only the strict platform is checked",
+			format:    "ndjson",
+			input:     strings.Replace(valid, `{`, `{"steam_app_id":1091500,`, 1),
+			schema:    main.SchemaPolicy{Platforms: map[string]bool{"steam": true}},
+			wantField: "steam_app_id",
+		},
+		{
+			name:   "csv unknown column",
+			format: "csv",
+			input: "transaction_id,player_id,game_title,item_type,platform,amount_cents,player_level,created_at,notes\n" +
+				"TXN-001,player_001,Cyberpunk 2077,game,steam,5999,15,2025-08-15T10:00:00Z,gift\n",
+			schema:    main.SchemaPolicy{Strict: true},
+			wantField: "notes",
+		},
+		{
+			name:   "csv empty required cell",
+			format: "csv",
+			input: "transaction_id,player_id,game_title,item_type,platform,amount_cents,player_level,created_at\n" +
+				"TXN-001,player_001,Cyberpunk 2077,game,steam,,15,2025-08-15T10:00:00Z\n",
+			schema:    main.SchemaPolicy{Strict: true},
+			wantField: "amount_cents",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := main.LookupFormat(tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opts := main.StreamOptions{Schema: tt.schema}
+			err = main.StreamRecords(context.Background(), format.NewDecoder(strings.NewReader(tt.input)), opts, func(main.Record) error { return nil })
+			if tt.wantField == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+
+			var lineErr *main.LineError
+			if !errors.As(err, &lineErr) {
+				t.Fatalf("Expected LineError, got %v", err)
+			}
+			if lineErr.Field != tt.wantField || !strings.Contains(lineErr.Error(), tt.wantField) || !errors.Is(err, main.ErrBadInput) {
+				t.Errorf("Got field %q, error %v; want field %q", lineErr.Field, err, tt.wantField)
+			}
+			if lineErr.Line == 0 {
+				t.Errorf("Error %v does not name the line", err)
+			}
+		})
+	}
+
+	// Without strict mode a misspelled field still decodes to a zero value
+	input := strings.Replace(valid, `"amount_cents"`, `"amount_cent"`, 1)
+	err := main.StreamNDJSON(context.Background(), strings.NewReader(input), func(p main.Purchase) error {
+		if p.AmountCents != 0 {
+			t.Errorf("Got amount %d, want 0", p.AmountCents)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Unexpected error in lenient schema mode: %v", err)
+	}
+}
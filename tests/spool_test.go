@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	main "gaming-purchases-system"
+)
+
+// TestSpoolRunner tests that files dropped into a spool directory are
+// ingested once and filed under done/ or failed/ with their summaries
+func TestSpoolRunner(t *testing.T) {
+	dir := t.TempDir()
+	// records returns n records, from transaction TXN-<first> on
+	records := func(first, n int) string {
+		var b strings.Builder
+		for i := first; i < first+n; i++ {
+			fmt.Fprintf(&b, limitRecord+"\n", i)
+		}
+		return b.String()
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(records(3, 1)))
+	zw.Close()
+
+	files := map[string]string{
+		"a.ndjson":    records(1, 1) + "{not json\n" + records(2, 1),
+		"b.ndjson.gz": gz.String(),
+		"c.ndjson":    records(4, 4),
+		"notes.txt":   records(8, 1),
+		".d.ndjson":   records(9, 1),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sr := main.SpoolRunner{
+		Dir:     dir,
+		Store:   newMemStore(),
+		Options: main.IngestOptions{Lenient: true, MaxRecords: 3},
+		Settle:  time.Hour,
+	}
+	if n, err := sr.Scan(context.Background()); err != nil || n != 0 {
+		t.Fatalf("Scan of fresh files claimed %d, %v; want none", n, err)
+	}
+
+	sr.Settle = 0
+	if n, err := sr.Scan(context.Background()); err != nil || n != 3 {
+		t.Fatalf("Scan claimed %d files, %v; want 3", n, err)
+	}
+	if n, err := sr.Scan(context.Background()); err != nil || n != 0 {
+		t.Fatalf("Second scan claimed %d files, %v; want none", n, err)
+	}
+
+	tests := []struct {
+		path         string
+		wantCreated  int
+		wantRejected int
+		wantError    string
+	}{
+		{"done/a.ndjson", 2, 1, ""},
+		{"done/b.ndjson.gz", 1, 0, ""},
+		{"failed/c.ndjson", 3, 0, "max_records"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if _, err := os.Stat(filepath.Join(dir, tt.path)); err != nil {
+				t.Fatalf("File was not moved: %v", err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, tt.path+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var summary main.SpoolSummary
+			if err := json.Unmarshal(data, &summary); err != nil {
+				t.Fatal(err)
+			}
+			if summary.Created != tt.wantCreated || summary.Rejected != tt.wantRejected || len(summary.Rejects) != tt.wantRejected {
+				t.Errorf("Got %d created and %d rejected with %d rejects, want %d and %d",
+					summary.Created, summary.Rejected, len(summary.Rejects), tt.wantCreated, tt.wantRejected)
+			}
+			if !strings.Contains(summary.Error, tt.wantError) || (tt.wantError == "") != (summary.Error == "") {
+				t.Errorf("Got error %q, want one mentioning %q", summary.Error, tt.wantError)
+			}
+		})
+	}
+
+	for _, name := range []string{"notes.txt", ".d.ndjson"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s should have been left alone: %v", name, err)
+		}
+	}
+
+	// A second delivery under the same name is filed next to the first
+	if err := os.WriteFile(filepath.Join(dir, "a.ndjson"), []byte(records(10, 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := sr.Scan(context.Background()); err != nil || n != 1 {
+		t.Fatalf("Scan of a redelivered file claimed %d, %v; want 1", n, err)
+	}
+	done, _ := filepath.Glob(filepath.Join(dir, "done", "*a.ndjson*"))
+	if len(done) != 4 {
+		t.Errorf("Got %v in done/, want both deliveries of a.ndjson with their summaries", done)
+	}
+}
+
+// TestSpoolReclaim tests that a file left in processing/ by a runner that
+// died is ingested again once it has gone untouched for Reclaim, and that
+// a file still being worked on is left alone
+func TestSpoolReclaim(t *testing.T) {
+	dir := t.TempDir()
+	processing := filepath.Join(dir, "processing")
+	if err := os.MkdirAll(processing, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"stale.ndjson", "busy.ndjson"} {
+		if err := os.WriteFile(filepath.Join(processing, name), []byte(fmt.Sprintf(limitRecord+"\n", 1)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(processing, "stale.ndjson"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	sr := main.SpoolRunner{
+		Dir:     dir,
+		Store:   newMemStore(),
+		Reclaim: time.Minute,
+	}
+	if n, err := sr.Scan(context.Background()); err != nil || n != 1 {
+		t.Fatalf("Scan claimed %d files, %v; want the stale one", n, err)
+	}
+	for _, path := range []string{"done/stale.ndjson", "processing/busy.ndjson"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("Want %s: %v", path, err)
+		}
+	}
+}
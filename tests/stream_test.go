@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+	"time"
+
+	main "gaming-purchases-system"
+)
+
+// feedResult is the outcome of a request to /ingest/stream
+type feedResult struct {
+	status   int
+	ingestID string
+	resp     main.IngestResponse
+	err      error
+}
+
+// startFeed sends a lenient NDJSON feed to /ingest/stream from the returned
+// writer. The ingest ID of the interim response is sent on early.
+func startFeed(url string, early chan<- string) (*io.PipeWriter, <-chan feedResult) {
+	pr, pw := io.Pipe()
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints && early != nil {
+				early <- header.Get("Ingest-ID")
+			}
+			return nil
+		},
+	}
+	req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace),
+		http.MethodPost, url+"/ingest/stream?lenient=true", pr)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	done := make(chan feedResult, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			pr.CloseWithError(err)
+			done <- feedResult{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		res := feedResult{status: resp.StatusCode, ingestID: resp.Header.Get("Ingest-ID")}
+		res.err = json.NewDecoder(resp.Body).Decode(&res.resp)
+		done <- res
+	}()
+	return pw, done
+}
+
+// TestIngestStreamRejects tests that the rejected lines of a feed can be
+// read from /ingest/batches/{id}/rejects before the feed ends
+func TestIngestStreamRejects(t *testing.T) {
+	store := newMemStore()
+	srv := httptest.NewServer(main.NewServer(store, main.ServerConfig{}))
+	defer srv.Close()
+
+	early := make(chan string, 1)
+	feed, done := startFeed(srv.URL, early)
+	fmt.Fprintf(feed, limitRecord+"\n{not json\n", 1)
+
+	var ingestID string
+	select {
+	case ingestID = <-early:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No interim response with the ingest ID")
+	}
+
+	var rejects []main.LineError
+	for deadline := time.Now().Add(5 * time.Second); len(rejects) == 0 && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		resp, err := http.Get(srv.URL + "/ingest/batches/" + ingestID + "/rejects")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			var rej main.LineError
+			for dec := json.NewDecoder(resp.Body); dec.Decode(&rej) == nil; {
+				rejects = append(rejects, rej)
+			}
+		}
+		resp.Body.Close()
+	}
+	if len(rejects) != 1 || rejects[0].Line != 2 {
+		t.Fatalf("Got rejects %+v of the running feed, want line 2", rejects)
+	}
+
+	fmt.Fprintf(feed, "{not json either\n"+limitRecord+"\n", 2)
+	feed.Close()
+	res := <-done
+	if res.err != nil || res.status != http.StatusOK {
+		t.Fatalf("Feed ended with status %d, %v", res.status, res.err)
+	}
+	if res.ingestID != ingestID || res.resp.IngestID != ingestID || res.resp.Created != 2 || res.resp.Rejected != 2 {
+		t.Errorf("Got %+v with Ingest-ID %s, want ingest %s with 2 created and 2 rejected", res.resp, res.ingestID, ingestID)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if got := len(store.rejects[ingestID]); got != 2 {
+		t.Errorf("Saved %d rejects, want 2", got)
+	}
+}
+
+// TestIngestStreamIdleTimeout tests that a feed outlives the server
+// timeouts while data keeps arriving, and is cut off once it stalls
+func TestIngestStreamIdleTimeout(t *testing.T) {
+	srv := httptest.NewUnstartedServer(main.NewServer(newMemStore(), main.ServerConfig{
+		StreamIdleTimeout: 200 * time.Millisecond,
+	}))
+	srv.Config.ReadTimeout = 300 * time.Millisecond
+	srv.Config.WriteTimeout = 300 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	t.Run("Steady feed", func(t *testing.T) {
+		feed, done := startFeed(srv.URL, nil)
+		for i := 1; i <= 10; i++ {
+			fmt.Fprintf(feed, limitRecord+"\n", i)
+			time.Sleep(80 * time.Millisecond)
+		}
+		feed.Close()
+		if res := <-done; res.err != nil || res.status != http.StatusOK || res.resp.Created != 10 {
+			t.Errorf("Got status %d with %+v, %v; want 10 created", res.status, res.resp, res.err)
+		}
+	})
+
+	t.Run("Stalled feed", func(t *testing.T) {
+		feed, done := startFeed(srv.URL, nil)
+		fmt.Fprintf(feed, limitRecord+"\n", 11)
+		select {
+		case res := <-done:
+			if res.err != nil || res.status == http.StatusOK || res.resp.Created != 1 {
+				t.Errorf("Got status %d with %+v, %v; want an error after 1 created", res.status, res.resp, res.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("The stalled feed was not cut off")
+		}
+		feed.Close()
+	})
+}
@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	main "gaming-purchases-system"
+)
+
+// TestTimestampParser tests the accepted created_at forms and their bounds
+func TestTimestampParser(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skipf("timezone database unavailable: %v", err)
+	}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tp := main.NewTimestampParser()
+	tp.PlatformLocations = map[string]*time.Location{"steam": la}
+	tp.Now = func() time.Time { return now }
+
+	tests := []struct {
+		name     string
+		value    main.Timestamp
+		platform string
+		want     time.Time
+		wantErr  bool
+	}{
+		{name: "RFC3339", value: "2024-01-15T16:00:00Z", want: time.Date(2024, 1, 15, 16, 0, 0, 0, time.UTC)},
+		{name: "RFC3339 with offset", value: "2024-01-15T16:00:00+02:00", want: time.Date(2024, 1, 15, 14, 0, 0, 0, time.UTC)},
+		{name: "fractional seconds", value: "2024-01-15T16:00:00.250Z", want: time.Date(2024, 1, 15, 16, 0, 0, 250e6, time.UTC)},
+		{name: "zoneless in UTC", value: "2024-01-15 16:00:00", platform: "epic", want: time.Date(2024, 1, 15, 16, 0, 0, 0, time.UTC)},
+		{name: "zoneless in platform timezone", value: "2024-01-15 16:00:00", platform: "steam", want: time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{name: "epoch seconds", value: "1705334400", want: time.Date(2024, 1, 15, 16, 0, 0, 0, time.UTC)},
+		{name: "epoch milliseconds", value: "1705334400123", want: time.Date(2024, 1, 15, 16, 0, 0, 123e6, time.UTC)},
+		{name: "empty", value: "", wantErr: true},
+		{name: "garbage", value: "yesterday", wantErr: true},
+		{name: "before earliest", value: "1999-12-31T23:59:59Z", wantErr: true},
+		{name: "far future", value: "2024-06-03T00:00:00Z", wantErr: true},
+		{name: "clock skew allowed", value: "2024-06-02T00:00:00Z", want: time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tp.Parse(tt.value, tt.platform)
+			if tt.wantErr {
+				if !errors.Is(err, main.ErrBadInput) {
+					t.Errorf("Expected ErrBadInput, got %v (%v)", err, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !got.Equal(tt.want) || got.Location() != time.UTC {
+				t.Errorf("Got %v, want %v in UTC", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestTimestampJSON tests that created_at may be a JSON string or number
+func TestTimestampJSON(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    main.Timestamp
+		wantErr bool
+	}{
+		{json: `{"created_at":"2024-01-15T16:00:00Z"}`, want: "2024-01-15T16:00:00Z"},
+		{json: `{"created_at":1705334400}`, want: "1705334400"},
+		{json: `{"created_at":"1705334400000"}`, want: "1705334400000"},
+		{json: `{"created_at":null}`, want: ""},
+		{json: `{"created_at":true}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var in main.PurchaseInput
+		err := json.Unmarshal([]byte(tt.json), &in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.json)
+			}
+			continue
+		}
+		if err != nil || in.CreatedAt != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.json, in.CreatedAt, err, tt.want)
+		}
+	}
+}
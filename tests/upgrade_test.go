@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+// TestSchemaVersionUpgrades tests that older records are upgraded to the
+// current shape and that unsupported versions are rejected
+func TestSchemaVersionUpgrades(t *testing.T) {
+	tests := []struct {
+		name        string
+		line        string
+		wantVersion int
+		wantAmount  int
+		wantCur     string
+		wantField   string // the field at fault when the record is rejected
+	}{
+		{
+			name:        "v1 field names",
+			line:        `{"schema_version":1,"txn_id":"TXN-001","user_id":"player_001","title":"Cyberpunk 2077","item_type":"game","platform":"steam","amount":"59.99 eur","player_level":15,"purchased_at":"2025-08-15T10:00:00Z"}`,
+			wantVersion: 1,
+			wantAmount:  5999,
+			wantCur:     "EUR",
+		},
+		{
+			name:        "v2 amount and currency",
+			line:        `{"schema_version":2,"transaction_id":"TXN-001","player_id":"player_001","game_title":"Cyberpunk 2077","item_type":"game","platform":"steam","amount":"12","player_level":15,"created_at":"2025-08-15T10:00:00Z"}`,
+			wantVersion: 2,
+			wantAmount:  1200,
+			wantCur:     "USD",
+		},
+		{
+			name:        "current version",
+			line:        `{"schema_version":3,"transaction_id":"TXN-001","player_id":"player_001","game_title":"Cyberpunk 2077","item_type":"game","platform":"steam","amount_cents":5999,"currency":"GBP","player_level":15,"created_at":"2025-08-15T10:00:00Z"}`,
+			wantVersion: 3,
+			wantAmount:  5999,
+			wantCur:     "GBP",
+		},
+		{
+			name:        "unversioned is current",
+			line:        `{"transaction_id":"TXN-001","player_id":"player_001","game_title":"Cyberpunk 2077","item_type":"game","platform":"steam","amount_cents":5999,"player_level":15,"created_at":"2025-08-15T10:00:00Z"}`,
+			wantVersion: main.CurrentSchemaVersion,
+			wantAmount:  5999,
+			wantCur:     "USD",
+		},
+		{
+			name:      "future version",
+			line:      `{"schema_version":4,"transaction_id":"TXN-001"}`,
+			wantField: "schema_version",
+		},
+		{
+			name:      "version zero",
+			line:      `{"schema_version":0,"transaction_id":"TXN-001"}`,
+			wantField: "schema_version",
+		},
+		{
+			name:      "non-integer version",
+			line:      `{"schema_version":"2","transaction_id":"TXN-001"}`,
+			wantField: "schema_version",
+		},
+		{
+			name:      "fractional cents",
+			line:      `{"schema_version":2,"transaction_id":"TXN-001","amount":"59.999 USD"}`,
+			wantField: "amount",
+		},
+		{
+			name:      "old and new name",
+			line:      `{"schema_version":1,"txn_id":"TXN-001","transaction_id":"TXN-001"}`,
+			wantField: "txn_id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []main.Record
+			opts := main.StreamOptions{Schema: main.SchemaPolicy{Strict: true}}
+			err := main.StreamNDJSONWithOptions(context.Background(), strings.NewReader(tt.line), opts, func(rec main.Record) error {
+				got = append(got, rec)
+				return nil
+			})
+
+			if tt.wantField != "" {
+				var lineErr *main.LineError
+				if !errors.As(err, &lineErr) || lineErr.Field != tt.wantField || !errors.Is(err, main.ErrBadInput) {
+					t.Errorf("Got error %v, want a rejected %s", err, tt.wantField)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if len(got) != 1 {
+				t.Fatalf("Got %d records, want 1", len(got))
+			}
+			p := got[0].Purchase
+			if got[0].Version != tt.wantVersion || p.TransactionID != "TXN-001" || p.PlayerID != "player_001" ||
+				p.GameTitle != "Cyberpunk 2077" || p.AmountCents != tt.wantAmount || p.Currency != tt.wantCur {
+				t.Errorf("Got version %d, purchase %+v; want version %d, %d %s", got[0].Version, p, tt.wantVersion, tt.wantAmount, tt.wantCur)
+			}
+		})
+	}
+}
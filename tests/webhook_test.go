@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	main "gaming-purchases-system"
+)
+
+// TestDecodeWebhook maps recorded platform notifications to purchases
+func TestDecodeWebhook(t *testing.T) {
+	tests := []struct {
+		platform string
+		want     main.PurchaseInput
+	}{
+		{
+			platform: "steam",
+			want: main.PurchaseInput{
+				TransactionID: "steam_4387150211", PlayerID: "steam_76561198111111111", PlayerUsername: "JsonGamer",
+				GameTitle: "The Witcher 3", ItemType: "dlc", Genre: "RPG", Platform: "steam",
+				AmountCents: 2998, Currency: "USD", PlayerLevel: 1, CreatedAt: "2024-01-15T16:00:00Z",
+			},
+		},
+		{
+			platform: "epic",
+			want: main.PurchaseInput{
+				TransactionID: "epic_b1f0c9e4a7d24c8e9f3a2b6d5e4c3b21", PlayerID: "epic_json_player_456", PlayerUsername: "EpicJsonFan",
+				GameTitle: "Rocket League Car Pack", ItemType: "dlc", Genre: "Sports", Platform: "epic",
+				AmountCents: 499, Currency: "USD", PlayerLevel: 1, CreatedAt: "2024-01-15T16:15:00.000Z",
+			},
+		},
+		{
+			platform: "xbox",
+			want: main.PurchaseInput{
+				TransactionID: "xbox_0a4f1e2b-7c3d-4e5f-8a9b-1c2d3e4f5a6b", PlayerID: "xbox_2533274812345678", PlayerUsername: "MasterChief117",
+				GameTitle: "Halo Infinite Battle Pass", ItemType: "season_pass", Genre: "Shooter", Platform: "xbox",
+				AmountCents: 999, Currency: "USD", PlayerLevel: 1, CreatedAt: "2024-01-15T17:30:00Z",
+			},
+		},
+		{
+			platform: "playstation",
+			want: main.PurchaseInput{
+				TransactionID: "psn_PSN-7781-2240-5521", PlayerID: "psn_6515971742264256071", PlayerUsername: "KratosFan",
+				GameTitle: "God of War Ragnarok", ItemType: "game", Genre: "Action", Platform: "playstation",
+				AmountCents: 6999, Currency: "USD", PlayerLevel: 1, CreatedAt: "2024-01-15T18:00:00Z",
+			},
+		},
+		{
+			platform: "nintendo",
+			want: main.PurchaseInput{
+				TransactionID: "nintendo_NX-0091-3382", PlayerID: "nintendo_a1b2c3d4e5f60718", PlayerUsername: "HyruleHero",
+				GameTitle: "Zelda: Tears of the Kingdom", ItemType: "game", Genre: "Adventure", Platform: "nintendo",
+				AmountCents: 6999, Currency: "USD", PlayerLevel: 1, CreatedAt: "2024-01-15T19:45:00Z",
+			},
+		},
+		{
+			platform: "mobile",
+			want: main.PurchaseInput{
+				TransactionID: "mobile_GPA.3372-1145-8892-55120", PlayerID: "mobile_mob_88213", PlayerUsername: "PocketPlayer",
+				GameTitle: "Genshin Impact", ItemType: "currency", Genre: "RPG", Platform: "mobile",
+				AmountCents: 499, Currency: "USD", PlayerLevel: 1, CreatedAt: "2024-01-15T20:00:00Z",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", "webhooks", tt.platform+".json"))
+			if err != nil {
+				t.Fatalf("Failed to read sample payload: %v", err)
+			}
+
+			got, err := main.DecodeWebhook(tt.platform, body)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Got %+v\nwant %+v", got, tt.want)
+			}
+			if err := main.ValidatePurchaseInput(got); err != nil {
+				t.Errorf("Mapped payload fails validation: %v", err)
+			}
+		})
+	}
+}
+
+// TestVerifyWebhookSignature tests HMAC verification of webhook bodies
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := []byte(`{"orderid":"4387150211"}`)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	valid := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name      string
+		secret    string
+		body      []byte
+		signature string
+		want      bool
+	}{
+		{name: "valid", secret: "s3cret", body: body, signature: valid, want: true},
+		{name: "valid with prefix", secret: "s3cret", body: body, signature: "sha256=" + valid, want: true},
+		{name: "wrong secret", secret: "other", body: body, signature: valid, want: false},
+		{name: "tampered body", secret: "s3cret", body: []byte(`{"orderid":"4387150212"}`), signature: valid, want: false},
+		{name: "missing signature", secret: "s3cret", body: body, signature: "", want: false},
+		{name: "not hex", secret: "s3cret", body: body, signature: "zz", want: false},
+		{name: "no secret configured", secret: "", body: body, signature: valid, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := main.VerifyWebhookSignature(tt.secret, tt.body, tt.signature); got != tt.want {
+				t.Errorf("Got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}